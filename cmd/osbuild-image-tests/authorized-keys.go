@@ -0,0 +1,101 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/constants"
+)
+
+// extraSSHKeysFlag implements flag.Value for the repeatable -extra-ssh-key
+// flag. The value is the path of a public key file, its keys are read
+// when the flag is parsed.
+type extraSSHKeysFlag []string
+
+func (f *extraSSHKeysFlag) String() string {
+	return strings.Join(*f, "\n")
+}
+
+func (f *extraSSHKeysFlag) Set(value string) error {
+	content, err := ioutil.ReadFile(value)
+	if err != nil {
+		return fmt.Errorf("cannot read the public key: %v", err)
+	}
+
+	keys := authorizedKeys(string(content))
+	if len(keys) == 0 {
+		return fmt.Errorf("%s contains no public key", value)
+	}
+
+	*f = append(*f, keys...)
+	return nil
+}
+
+// extraSSHKeys are the public keys given by -extra-ssh-key
+var extraSSHKeys extraSSHKeysFlag
+
+// authorizedKeys returns the keys in the authorized_keys format content,
+// comments and empty lines are skipped
+func authorizedKeys(content string) []string {
+	var keys []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+
+	return keys
+}
+
+// bootExtraSSHKeys returns the public keys authorized for the user logging
+// into the image booted according to boot, besides the generated key
+func bootExtraSSHKeys(boot *bootStruct) []string {
+	keys := make([]string, 0, len(boot.ExtraSSHKeys)+len(extraSSHKeys))
+	keys = append(keys, boot.ExtraSSHKeys...)
+	keys = append(keys, extraSSHKeys...)
+	return keys
+}
+
+// sshLoginExpectation is a user of the image, e.g. created by the users
+// customization of the blueprint, who must be able to log in using ssh
+type sshLoginExpectation struct {
+	User string
+	// PrivateKey is the path of the key the user logs in with, the key
+	// from the test data is used if empty
+	PrivateKey string `json:"private-key"`
+}
+
+// checkSSHLogins verifies that the users can log into the target with
+// their own keys, alongside the user of the target
+func checkSSHLogins(target sshTarget, logins []sshLoginExpectation) error {
+	var problems []string
+	for _, login := range logins {
+		loginTarget := target
+		loginTarget.user = login.User
+		loginTarget.privateKey = login.PrivateKey
+		if loginTarget.privateKey == "" {
+			loginTarget.privateKey = constants.TestPaths.PrivateKey
+		}
+
+		out, err := runSSHCommand(loginTarget, "id -un")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s cannot log in: %v", login.User, err))
+			continue
+		}
+
+		if user := strings.TrimSpace(out); user != login.User {
+			problems = append(problems, fmt.Sprintf("logging in as %s gave a session of %s", login.User, user))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected ssh logins:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/osbuild/osbuild-composer/internal/upload/awsupload"
 )
 
@@ -54,19 +58,23 @@ func encodeBase64(input string) string {
 	return base64.StdEncoding.EncodeToString([]byte(input))
 }
 
-// createUserData creates cloud-init's user-data that contains user redhat with
-// the specified public key
-func createUserData(publicKeyFile string) (string, error) {
+// createUserData creates cloud-init's user-data that contains the specified
+// user with the specified public key and the extra public keys
+func createUserData(publicKeyFile, user string, extraKeys []string) (string, error) {
 	publicKey, err := ioutil.ReadFile(publicKeyFile)
 	if err != nil {
 		return "", fmt.Errorf("cannot read the public key: %#v", err)
 	}
 
 	userData := fmt.Sprintf(`#cloud-config
-user: redhat
+user: %s
 ssh_authorized_keys:
   - %s
-`, string(publicKey))
+`, user, strings.TrimSpace(string(publicKey)))
+
+	for _, key := range extraKeys {
+		userData += fmt.Sprintf("  - %s\n", key)
+	}
 
 	return userData, nil
 }
@@ -83,30 +91,246 @@ func wrapErrorf(innerError error, format string, a ...interface{}) error {
 	return fmt.Errorf(format, a...)
 }
 
+const (
+	// awsImportSnapshot imports the image as a snapshot and registers the
+	// AMI from it, like osbuild-composer does
+	awsImportSnapshot = "snapshot"
+	// awsImportImage converts the image to an AMI using the VM Import
+	// ImportImage task
+	awsImportImage = "image"
+)
+
+// validateAWSImportMode returns an error if mode is not a known aws import
+// mode, the empty mode stands for awsImportSnapshot
+func validateAWSImportMode(mode string) error {
+	switch mode {
+	case "", awsImportSnapshot, awsImportImage:
+		return nil
+	}
+
+	return fmt.Errorf("unknown aws import mode %q, expected %s or %s", mode, awsImportSnapshot, awsImportImage)
+}
+
 // uploadImageToAWS mimics the upload feature of osbuild-composer.
 // It takes an image and an image name and creates an ec2 instance from them.
 // The s3 key is never returned - the same thing is done in osbuild-composer,
 // the user has no way of getting the s3 key.
-func uploadImageToAWS(c *awsCredentials, imagePath string, imageName string) error {
+// The importMode chooses how the uploaded image is turned into an AMI, see
+// awsImportSnapshot and awsImportImage. The AMI is named imageName in both
+// cases.
+// Only the upload to s3 is retried, it overwrites the same object. The
+// import creates a snapshot each time it's run, so it's not retried.
+func uploadImageToAWS(c *awsCredentials, imagePath string, imageName string, importMode string) error {
 	uploader, err := awsupload.New(c.Region, c.AccessKeyId, c.SecretAccessKey)
 	if err != nil {
 		return fmt.Errorf("cannot create aws uploader: %#v", err)
 	}
 
-	_, err = uploader.Upload(imagePath, c.Bucket, imageName)
+	err = retryWithBackoff(uploadAttempts, uploadBackoff, func() error {
+		_, err := uploader.Upload(imagePath, c.Bucket, imageName)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("cannot upload the image: %#v", err)
 	}
+
+	if importMode == awsImportImage {
+		return importImageToEC2(c, imagePath, imageName)
+	}
+
 	_, err = uploader.Register(imageName, c.Bucket, imageName)
 	if err != nil {
+		// the uploaded object is deleted only by a successful import
+		deleteErr := deleteS3Object(c, imageName)
+		if deleteErr != nil {
+			return wrapErrorf(deleteErr, "cannot register the image: %#v", err)
+		}
 		return fmt.Errorf("cannot register the image: %#v", err)
 	}
 
 	return nil
 }
 
-// newEC2 creates EC2 struct from given credentials
-func newEC2(c *awsCredentials) (*ec2.EC2, error) {
+// deleteS3Object deletes the object uploaded to the bucket under key,
+// deleting a missing object is not an error
+func deleteS3Object(c *awsCredentials, key string) error {
+	sess, err := newAWSSession(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete the uploaded image: %#v", err)
+	}
+
+	return nil
+}
+
+// ec2ImportPollInterval is the delay between two checks of an import task
+const ec2ImportPollInterval = 15 * time.Second
+
+// ec2ImportTimeout is the maximal time an import task can take, the
+// conversion usually takes between 10 and 60 minutes
+const ec2ImportTimeout = 2 * time.Hour
+
+// ec2DiskFormat returns the VM Import format of the image by its extension
+func ec2DiskFormat(imagePath string) (string, error) {
+	switch path.Ext(imagePath) {
+	case ".raw", ".img":
+		return "RAW", nil
+	case ".vhd", ".vhdx":
+		return "VHD", nil
+	case ".vmdk":
+		return "VMDK", nil
+	}
+
+	return "", fmt.Errorf("the image %s cannot be imported using ImportImage, use a raw, vhd or vmdk image", path.Base(imagePath))
+}
+
+// waitForEC2ImportImageTask polls the import task until it completes and
+// returns it. It fails if the task is deleted, i.e. the conversion failed,
+// and cancels the task if it doesn't complete in ec2ImportTimeout.
+func waitForEC2ImportImageTask(e *ec2.EC2, taskId *string) (*ec2.ImportImageTask, error) {
+	deadline := time.Now().Add(ec2ImportTimeout)
+	lastMessage := ""
+	for {
+		out, err := e.DescribeImportImageTasks(&ec2.DescribeImportImageTasksInput{
+			ImportTaskIds: []*string{taskId},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot describe the import task: %#v", err)
+		}
+		if len(out.ImportImageTasks) == 0 {
+			return nil, fmt.Errorf("the import task %s doesn't exist", *taskId)
+		}
+
+		task := out.ImportImageTasks[0]
+		status := aws.StringValue(task.Status)
+		message := aws.StringValue(task.StatusMessage)
+
+		switch status {
+		case "completed":
+			return task, nil
+		case "deleting", "deleted":
+			return nil, fmt.Errorf("the import task %s failed: %s", *taskId, message)
+		}
+
+		if message != lastMessage {
+			harnessLog.Infof("import task %s: %s %s%%", *taskId, message, aws.StringValue(task.Progress))
+			lastMessage = message
+		}
+
+		if time.Now().After(deadline) {
+			_, err := e.CancelImportTask(&ec2.CancelImportTaskInput{
+				ImportTaskId: taskId,
+				CancelReason: aws.String("osbuild-image-tests timeout"),
+			})
+			if err != nil {
+				harnessLog.Warningf("cannot cancel the import task %s: %#v", *taskId, err)
+			}
+			return nil, fmt.Errorf("the import task %s didn't complete in %v, the last status is %s: %s", *taskId, ec2ImportTimeout, status, message)
+		}
+
+		time.Sleep(ec2ImportPollInterval)
+	}
+}
+
+// importImageToEC2 converts the image uploaded to the bucket under
+// imageName into an AMI using the ImportImage task. The AMI created by the
+// task gets a generated name, so the AMI named imageName is registered
+// from its snapshot and the generated one is deregistered. The uploaded
+// object is deleted afterwards.
+func importImageToEC2(c *awsCredentials, imagePath, imageName string) (retErr error) {
+	sess, err := newAWSSession(c)
+	if err != nil {
+		return err
+	}
+	e := ec2.New(sess)
+
+	defer func() {
+		err := deleteS3Object(c, imageName)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "%v", err)
+		}
+	}()
+
+	format, err := ec2DiskFormat(imagePath)
+	if err != nil {
+		return err
+	}
+
+	importTask, err := e.ImportImage(&ec2.ImportImageInput{
+		Description: aws.String(imageName),
+		Platform:    aws.String("Linux"),
+		DiskContainers: []*ec2.ImageDiskContainer{
+			{
+				Format: aws.String(format),
+				UserBucket: &ec2.UserBucket{
+					S3Bucket: aws.String(c.Bucket),
+					S3Key:    aws.String(imageName),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot start the import task: %#v", err)
+	}
+
+	task, err := waitForEC2ImportImageTask(e, importTask.ImportTaskId)
+	if err != nil {
+		return err
+	}
+
+	// the imported AMI is only needed to get its snapshot
+	defer func() {
+		_, err := e.DeregisterImage(&ec2.DeregisterImageInput{
+			ImageId: task.ImageId,
+		})
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot deregister the imported image: %#v", err)
+		}
+	}()
+
+	if len(task.SnapshotDetails) != 1 || task.SnapshotDetails[0].SnapshotId == nil {
+		return fmt.Errorf("the import task %s didn't create exactly one snapshot", *importTask.ImportTaskId)
+	}
+	snapshotId := task.SnapshotDetails[0].SnapshotId
+
+	_, err = e.RegisterImage(&ec2.RegisterImageInput{
+		Architecture:       task.Architecture,
+		VirtualizationType: aws.String("hvm"),
+		Name:               aws.String(imageName),
+		RootDeviceName:     aws.String("/dev/sda1"),
+		EnaSupport:         aws.Bool(true),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{
+				DeviceName: aws.String("/dev/sda1"),
+				Ebs: &ec2.EbsBlockDevice{
+					SnapshotId: snapshotId,
+				},
+			},
+		},
+	})
+	if err != nil {
+		// nothing else uses the snapshot
+		_, deleteErr := e.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+			SnapshotId: snapshotId,
+		})
+		if deleteErr != nil {
+			return wrapErrorf(fmt.Errorf("cannot delete the snapshot: %#v", deleteErr), "cannot register the image: %#v", err)
+		}
+		return fmt.Errorf("cannot register the image: %#v", err)
+	}
+
+	return nil
+}
+
+// newAWSSession creates an aws session from given credentials
+func newAWSSession(c *awsCredentials) (*session.Session, error) {
 	creds := credentials.NewStaticCredentials(c.AccessKeyId, c.SecretAccessKey, "")
 	sess, err := session.NewSession(&aws.Config{
 		Credentials: creds,
@@ -116,6 +340,16 @@ func newEC2(c *awsCredentials) (*ec2.EC2, error) {
 		return nil, fmt.Errorf("cannot create aws session: %#v", err)
 	}
 
+	return sess, nil
+}
+
+// newEC2 creates EC2 struct from given credentials
+func newEC2(c *awsCredentials) (*ec2.EC2, error) {
+	sess, err := newAWSSession(c)
+	if err != nil {
+		return nil, err
+	}
+
 	return ec2.New(sess), nil
 }
 
@@ -151,6 +385,29 @@ func describeEC2Image(e *ec2.EC2, imageName string) (*imageDescription, error) {
 	}, nil
 }
 
+// listEC2Images returns the images owned by the account whose names start
+// with the prefix
+func listEC2Images(e *ec2.EC2, prefix string) ([]*ec2.Image, error) {
+	imageDescriptions, err := e.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: []*string{
+			aws.String("self"),
+		},
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("name"),
+				Values: []*string{
+					aws.String(prefix + "*"),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe the images: %#v", err)
+	}
+
+	return imageDescriptions.Images, nil
+}
+
 // deleteEC2Image deletes the specified image and its associated snapshot
 func deleteEC2Image(e *ec2.EC2, imageDesc *imageDescription) error {
 	var retErr error
@@ -176,11 +433,17 @@ func deleteEC2Image(e *ec2.EC2, imageDesc *imageDescription) error {
 	return retErr
 }
 
+// ec2InstanceType is the type of the instances booted in AWS EC2
+const ec2InstanceType = "t3.micro"
+
 // withBootedImageInEC2 runs the function f in the context of booted
-// image in AWS EC2
-func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey string, f func(address string) error) (retErr error) {
+// image in AWS EC2. The extra public keys are authorized besides the given
+// one. If privateAddress is true, f gets the private address
+// of the instance instead of the public one. If keep returns true after f,
+// the instance and its security group are left running.
+func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey, user string, extraKeys []string, privateAddress bool, keep func() bool, f func(instanceId, address string) error) (retErr error) {
 	// generate user data with given public key
-	userData, err := createUserData(publicKey)
+	userData, err := createUserData(publicKey, user, extraKeys)
 	if err != nil {
 		return err
 	}
@@ -203,6 +466,11 @@ func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey str
 	}
 
 	defer func() {
+		if keep() {
+			harnessLog.Infof("keeping the security group %s", *securityGroup.GroupId)
+			return
+		}
+
 		_, err = e.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
 			GroupId: securityGroup.GroupId,
 		})
@@ -229,7 +497,7 @@ func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey str
 		MaxCount:         aws.Int64(1),
 		MinCount:         aws.Int64(1),
 		ImageId:          imageDesc.Id,
-		InstanceType:     aws.String("t3.micro"),
+		InstanceType:     aws.String(ec2InstanceType),
 		SecurityGroupIds: []*string{securityGroup.GroupId},
 		UserData:         aws.String(encodeBase64(userData)),
 	})
@@ -246,6 +514,11 @@ func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey str
 	defer func() {
 		// We need to terminate the instance now and wait until the termination is done.
 		// Otherwise, it wouldn't be possible to delete the image.
+		if keep() {
+			harnessLog.Infof("keeping the instance %s running", *res.Instances[0].InstanceId)
+			return
+		}
+
 		_, err = e.TerminateInstances(&ec2.TerminateInstancesInput{
 			InstanceIds: []*string{
 				res.Instances[0].InstanceId,
@@ -262,20 +535,141 @@ func withBootedImageInEC2(e *ec2.EC2, imageDesc *imageDescription, publicKey str
 		}
 	}()
 
-	// The instance has no IP address yet. It's assigned when the instance
-	// is in the state "EXISTS". However, in this state the instance is not
-	// much usable, therefore wait until "RUNNING" state, in which the instance
-	// actually can do something useful for us.
-	err = e.WaitUntilInstanceRunning(describeInstanceInput)
+	// The instance has no IP address yet, wait until it's running and has
+	// the address before trying to reach it using ssh.
+	address, err := waitForEC2InstanceAddress(e, res.Instances[0].InstanceId, privateAddress)
 	if err != nil {
-		return fmt.Errorf("waiting for the instance to be running failed: %#v", err)
+		return err
 	}
 
-	// By describing the instance, we can get the ip address.
-	out, err := e.DescribeInstances(describeInstanceInput)
+	return f(*res.Instances[0].InstanceId, address)
+}
+
+// withAttachedEC2Volume creates a volume from the snapshot, attaches it to
+// the instance and runs the function f with the volume id. The volume is
+// detached and deleted after f returns.
+func withAttachedEC2Volume(e *ec2.EC2, instanceId, snapshotId string, f func(volumeId string) error) (retErr error) {
+	instances, err := e.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceId)},
+	})
 	if err != nil {
 		return fmt.Errorf("cannot describe the instance: %#v", err)
 	}
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("the instance %s doesn't exist", instanceId)
+	}
+	// the volume must be in the availability zone of the instance
+	zone := instances.Reservations[0].Instances[0].Placement.AvailabilityZone
+
+	volume, err := e.CreateVolume(&ec2.CreateVolumeInput{
+		AvailabilityZone: zone,
+		SnapshotId:       aws.String(snapshotId),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create a volume from the snapshot: %#v", err)
+	}
 
-	return f(*out.Reservations[0].Instances[0].PublicIpAddress)
+	describeVolumeInput := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{volume.VolumeId},
+	}
+
+	defer func() {
+		_, err := e.DeleteVolume(&ec2.DeleteVolumeInput{
+			VolumeId: volume.VolumeId,
+		})
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the volume: %#v", err)
+		}
+	}()
+
+	err = e.WaitUntilVolumeAvailable(describeVolumeInput)
+	if err != nil {
+		return fmt.Errorf("waiting for the volume to be available failed: %#v", err)
+	}
+
+	_, err = e.AttachVolume(&ec2.AttachVolumeInput{
+		Device:     aws.String("/dev/sdf"),
+		InstanceId: aws.String(instanceId),
+		VolumeId:   volume.VolumeId,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot attach the volume: %#v", err)
+	}
+
+	defer func() {
+		_, err := e.DetachVolume(&ec2.DetachVolumeInput{
+			VolumeId: volume.VolumeId,
+		})
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot detach the volume: %#v", err)
+			return
+		}
+
+		// the volume can be deleted only once it's detached
+		err = e.WaitUntilVolumeAvailable(describeVolumeInput)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "waiting for the volume to be detached failed: %#v", err)
+		}
+	}()
+
+	err = e.WaitUntilVolumeInUse(describeVolumeInput)
+	if err != nil {
+		return fmt.Errorf("waiting for the volume to be attached failed: %#v", err)
+	}
+
+	return f(*volume.VolumeId)
+}
+
+// ec2PollInterval is the delay between two checks of the instance state
+const ec2PollInterval = 5 * time.Second
+
+// ec2ReadyTimeout is the maximal time to wait for the instance to be
+// running and to have an address
+const ec2ReadyTimeout = 10 * time.Minute
+
+// waitForEC2InstanceAddress polls the instance until it's in the running
+// state and has an address assigned, and returns the address. It fails
+// early if the instance goes away instead of starting.
+func waitForEC2InstanceAddress(e *ec2.EC2, instanceId *string, privateAddress bool) (string, error) {
+	deadline := time.Now().Add(ec2ReadyTimeout)
+	state := "unknown"
+	for {
+		out, err := e.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{instanceId},
+		})
+		// the instance might not be visible to the API right after its
+		// creation, retry until the deadline
+		if err == nil && len(out.Reservations) > 0 && len(out.Reservations[0].Instances) > 0 {
+			instance := out.Reservations[0].Instances[0]
+			if instance.State != nil && instance.State.Name != nil {
+				state = *instance.State.Name
+			}
+
+			switch state {
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+				reason := "unknown reason"
+				if instance.StateReason != nil && instance.StateReason.Message != nil {
+					reason = *instance.StateReason.Message
+				}
+				return "", fmt.Errorf("the instance went to the state %s instead of running: %s", state, reason)
+
+			case ec2.InstanceStateNameRunning:
+				if privateAddress && instance.PrivateIpAddress != nil {
+					return *instance.PrivateIpAddress, nil
+				}
+				if !privateAddress && instance.PublicIpAddress != nil {
+					return *instance.PublicIpAddress, nil
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if state == ec2.InstanceStateNameRunning && !privateAddress {
+				return "", errors.New("the instance has no public ip address, use a jump host to reach its private address")
+			}
+			return "", fmt.Errorf("the instance wasn't running with an address in %v, the last state is %s", ec2ReadyTimeout, state)
+		}
+
+		time.Sleep(ec2PollInterval)
+	}
 }
@@ -10,6 +10,8 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-09-01/network"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
@@ -31,6 +33,9 @@ func wrapErrorf(innerError error, format string, a ...interface{}) error {
 	return fmt.Errorf(format, a...)
 }
 
+// VMSize is the size of the virtual machine set in the deployment template
+const VMSize = "Standard_B1s"
+
 type azureCredentials struct {
 	azure.Credentials
 	ContainerName  string
@@ -40,11 +45,15 @@ type azureCredentials struct {
 	TenantID       string
 	Location       string
 	ResourceGroup  string
+	// Gallery is the shared image gallery the image is published in before
+	// booting it, the managed image is booted directly if empty
+	Gallery string
 }
 
 // getAzureCredentialsFromEnv gets the credentials from environment variables
 // If none of the environment variables is set, it returns nil.
 // If some but not all environment variables are set, it returns an error.
+// AZURE_GALLERY is optional.
 func GetAzureCredentialsFromEnv() (*azureCredentials, error) {
 	storageAccount, saExists := os.LookupEnv("AZURE_STORAGE_ACCOUNT")
 	storageAccessKey, sakExists := os.LookupEnv("AZURE_STORAGE_ACCESS_KEY")
@@ -77,6 +86,7 @@ func GetAzureCredentialsFromEnv() (*azureCredentials, error) {
 		TenantID:       tenantId,
 		Location:       location,
 		ResourceGroup:  resourceGroup,
+		Gallery:        os.Getenv("AZURE_GALLERY"),
 	}, nil
 }
 
@@ -126,6 +136,36 @@ func DeleteImageFromAzure(c *azureCredentials, imageName string) error {
 	return nil
 }
 
+// ListImagesInAzure returns the names of the images uploaded to the container
+// whose names start with the prefix together with their modification times
+func ListImagesInAzure(c *azureCredentials, prefix string) (map[string]time.Time, error) {
+	credential, err := azblob.NewSharedKeyCredential(c.StorageAccount, c.StorageAccessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	URL, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", c.StorageAccount, c.ContainerName))
+	containerURL := azblob.NewContainerURL(*URL, p)
+
+	blobs := make(map[string]time.Time)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := containerURL.ListBlobsFlatSegment(context.Background(), marker, azblob.ListBlobsSegmentOptions{
+			Prefix: prefix,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list the images: %v", err)
+		}
+
+		for _, blob := range response.Segment.BlobItems {
+			blobs[blob.Name] = blob.Properties.LastModified
+		}
+		marker = response.NextMarker
+	}
+
+	return blobs, nil
+}
+
 // readPublicKey reads the public key from a file and returns it as a string
 func readPublicKey(publicKeyFile string) (string, error) {
 	publicKey, err := ioutil.ReadFile(publicKeyFile)
@@ -133,7 +173,7 @@ func readPublicKey(publicKeyFile string) (string, error) {
 		return "", fmt.Errorf("cannot read the public key file: %v", err)
 	}
 
-	return string(publicKey), nil
+	return strings.TrimSpace(string(publicKey)), nil
 }
 
 // deleteResource is a convenient wrapper around Azure SDK to delete a resource
@@ -156,9 +196,20 @@ func deleteResource(client resources.Client, id string, apiVersion string) error
 	return nil
 }
 
+// azureResource identifies a resource created by the deployment
+type azureResource struct {
+	resType    string
+	name       string
+	apiVersion string
+}
+
 // withBootedImageInAzure runs the function f in the context of booted
-// image in Azure
-func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKeyFile string, f func(address string) error) (retErr error) {
+// image in Azure. The virtual machine boots from a managed image, or from
+// a version of a shared image gallery image if the gallery is given in
+// the credentials. If privateAddress is true, f gets the private address
+// of the virtual machine instead of the public one. If keep returns true
+// after f, the deployed resources are left running.
+func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKeyFile, user string, privateAddress bool, keep func() bool, f func(address string) error) (retErr error) {
 	publicKey, err := readPublicKey(publicKeyFile)
 	if err != nil {
 		return err
@@ -192,10 +243,18 @@ func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKe
 		ImageName:                newDeploymentParameter("image-" + testId),
 		Location:                 newDeploymentParameter(creds.Location),
 		ImagePath:                newDeploymentParameter(imagePath),
-		AdminUsername:            newDeploymentParameter("redhat"),
+		AdminUsername:            newDeploymentParameter(user),
 		AdminPublicKey:           newDeploymentParameter(publicKey),
 	}
 
+	galleryImageDefinition := "def-" + testId
+	if creds.Gallery != "" {
+		err = bootFromGallery(template, creds.Gallery, galleryImageDefinition, parameters.ImageName.Value, creds.Location, testId)
+		if err != nil {
+			return fmt.Errorf("cannot add the gallery image to the deployment template: %v", err)
+		}
+	}
+
 	deploymentsClient := resources.NewDeploymentsClient(creds.SubscriptionID)
 	deploymentsClient.Authorizer = authorizer
 
@@ -209,17 +268,18 @@ func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKe
 
 	// Let's registed the clean-up function as soon as possible.
 	defer func() {
+		if keep() {
+			log.Printf("keeping the virtual machine %s in the resource group %s running", parameters.VirtualMachineName.Value, creds.ResourceGroup)
+			return
+		}
+
 		resourcesClient := resources.NewClient(creds.SubscriptionID)
 		resourcesClient.Authorizer = authorizer
 
 		// This array specifies all the resources we need to delete. The
 		// order is important, e.g. one cannot delete a network interface
 		// that is still attached to a virtual machine.
-		resourcesToDelete := []struct {
-			resType    string
-			name       string
-			apiVersion string
-		}{
+		resourcesToDelete := []azureResource{
 			{
 				resType:    "Microsoft.Compute/virtualMachines",
 				name:       parameters.VirtualMachineName.Value,
@@ -250,13 +310,31 @@ func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKe
 				name:       parameters.DiskName.Value,
 				apiVersion: "2019-07-01",
 			},
-			{
-				resType:    "Microsoft.Compute/images",
-				name:       parameters.ImageName.Value,
-				apiVersion: "2019-07-01",
-			},
 		}
 
+		// the gallery image version must be deleted before its definition
+		// and before the managed image it was created from
+		if creds.Gallery != "" {
+			resourcesToDelete = append(resourcesToDelete, []azureResource{
+				{
+					resType:    "Microsoft.Compute/galleries",
+					name:       fmt.Sprintf("%s/images/%s/versions/%s", creds.Gallery, galleryImageDefinition, galleryImageVersion),
+					apiVersion: "2019-07-01",
+				},
+				{
+					resType:    "Microsoft.Compute/galleries",
+					name:       fmt.Sprintf("%s/images/%s", creds.Gallery, galleryImageDefinition),
+					apiVersion: "2019-07-01",
+				},
+			}...)
+		}
+
+		resourcesToDelete = append(resourcesToDelete, azureResource{
+			resType:    "Microsoft.Compute/images",
+			name:       parameters.ImageName.Value,
+			apiVersion: "2019-07-01",
+		})
+
 		// Delete all the resources
 		for _, resourceToDelete := range resourcesToDelete {
 			resourceID := fmt.Sprintf(
@@ -312,6 +390,27 @@ func WithBootedImageInAzure(creds *azureCredentials, imageName, testId, publicKe
 		return fmt.Errorf("retrieving the deployment result failed: %v", err)
 	}
 
+	if privateAddress {
+		interfacesClient := network.NewInterfacesClient(creds.SubscriptionID)
+		interfacesClient.Authorizer = authorizer
+
+		iface, err := interfacesClient.Get(context.Background(), creds.ResourceGroup, parameters.NetworkInterfaceName.Value, "")
+		if err != nil {
+			return fmt.Errorf("cannot get the network interface details: %v", err)
+		}
+
+		if iface.InterfacePropertiesFormat == nil || iface.IPConfigurations == nil || len(*iface.IPConfigurations) == 0 {
+			return errors.New("the network interface has no ip configuration")
+		}
+
+		ipConfiguration := (*iface.IPConfigurations)[0]
+		if ipConfiguration.InterfaceIPConfigurationPropertiesFormat == nil || ipConfiguration.PrivateIPAddress == nil {
+			return errors.New("the network interface has no private ip address")
+		}
+
+		return f(*ipConfiguration.PrivateIPAddress)
+	}
+
 	// get the IP address
 	publicIPAddressClient := network.NewPublicIPAddressesClient(creds.SubscriptionID)
 	publicIPAddressClient.Authorizer = authorizer
@@ -0,0 +1,108 @@
+// +build integration
+
+package azuretest
+
+import (
+	"errors"
+	"fmt"
+)
+
+// galleryImageVersion is the version of the gallery image created from the
+// managed image, every test uses its own image definition
+const galleryImageVersion = "1.0.0"
+
+// galleryResources returns the image definition and the image version
+// resources publishing the managed image created by the deployment template
+// in the shared image gallery
+func galleryResources(gallery, definition, imageName, location, testId string) []interface{} {
+	definitionName := fmt.Sprintf("%s/%s", gallery, definition)
+	versionName := fmt.Sprintf("%s/%s/%s", gallery, definition, galleryImageVersion)
+
+	return []interface{}{
+		map[string]interface{}{
+			"name":       definitionName,
+			"type":       "Microsoft.Compute/galleries/images",
+			"apiVersion": "2019-07-01",
+			"location":   location,
+			"properties": map[string]interface{}{
+				"osType":           "Linux",
+				"osState":          "Generalized",
+				"hyperVGeneration": "V1",
+				"identifier": map[string]interface{}{
+					"publisher": "osbuild",
+					"offer":     "osbuild-image-tests",
+					"sku":       testId,
+				},
+			},
+		},
+		map[string]interface{}{
+			"name":       versionName,
+			"type":       "Microsoft.Compute/galleries/images/versions",
+			"apiVersion": "2019-07-01",
+			"location":   location,
+			"dependsOn": []interface{}{
+				fmt.Sprintf("[resourceId('Microsoft.Compute/galleries/images', '%s', '%s')]", gallery, definition),
+				fmt.Sprintf("[resourceId('Microsoft.Compute/images', '%s')]", imageName),
+			},
+			"properties": map[string]interface{}{
+				"publishingProfile": map[string]interface{}{
+					"replicaCount": 1,
+					"targetRegions": []interface{}{
+						map[string]interface{}{
+							"name":                 location,
+							"regionalReplicaCount": 1,
+						},
+					},
+				},
+				"storageProfile": map[string]interface{}{
+					"source": map[string]interface{}{
+						"id": fmt.Sprintf("[resourceId('Microsoft.Compute/images', '%s')]", imageName),
+					},
+				},
+			},
+		},
+	}
+}
+
+// bootFromGallery modifies the deployment template to publish the managed
+// image in the gallery and to boot the virtual machine from the gallery
+// image version instead of the managed image
+func bootFromGallery(template interface{}, gallery, definition, imageName, location, testId string) error {
+	root, ok := template.(map[string]interface{})
+	if !ok {
+		return errors.New("the deployment template is not an object")
+	}
+
+	resources, ok := root["resources"].([]interface{})
+	if !ok {
+		return errors.New("the deployment template has no resources")
+	}
+
+	var vm map[string]interface{}
+	for _, r := range resources {
+		resource, ok := r.(map[string]interface{})
+		if ok && resource["type"] == "Microsoft.Compute/virtualMachines" {
+			vm = resource
+		}
+	}
+	if vm == nil {
+		return errors.New("the deployment template has no virtual machine")
+	}
+
+	properties, _ := vm["properties"].(map[string]interface{})
+	storageProfile, _ := properties["storageProfile"].(map[string]interface{})
+	if storageProfile == nil {
+		return errors.New("the virtual machine in the deployment template has no storage profile")
+	}
+
+	versionID := fmt.Sprintf("[resourceId('Microsoft.Compute/galleries/images/versions', '%s', '%s', '%s')]", gallery, definition, galleryImageVersion)
+	storageProfile["imageReference"] = map[string]interface{}{
+		"id": versionID,
+	}
+
+	dependsOn, _ := vm["dependsOn"].([]interface{})
+	vm["dependsOn"] = append(dependsOn, versionID)
+
+	root["resources"] = append(resources, galleryResources(gallery, definition, imageName, location, testId)...)
+	return nil
+}
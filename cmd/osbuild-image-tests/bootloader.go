@@ -0,0 +1,204 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// espPartitionType is the GPT type of the EFI system partition
+	espPartitionType = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	// biosBootPartitionType is the GPT type of the partition grub embeds
+	// its core image into on BIOS systems
+	biosBootPartitionType = "21686148-6449-6E6F-744E-656564454649"
+	// espDOSPartitionType is the type of the EFI system partition in a dos
+	// partition table
+	espDOSPartitionType = "ef"
+)
+
+// bootloaderAssertions describes the expected bootloader setup of the
+// image, checked using the partition data reported by image-info
+type bootloaderAssertions struct {
+	// Family is the firmware the image boots on: "bios", "uefi" or
+	// "hybrid" for both
+	Family string
+	// EFIBinaries are paths on the EFI system partition which must exist,
+	// e.g. /EFI/BOOT/BOOTX64.EFI
+	EFIBinaries []string `json:"efi-binaries"`
+}
+
+// imageInfoBootPartition is a partition as reported by image-info, with
+// the fields describing its role in booting
+type imageInfoBootPartition struct {
+	Type   string  `json:"type"`
+	FSType *string `json:"fstype"`
+}
+
+// imageInfoBoot is the subset of the image-info output describing how the
+// image boots
+type imageInfoBoot struct {
+	Bootloader     string                   `json:"bootloader"`
+	PartitionTable string                   `json:"partition-table"`
+	Partitions     []imageInfoBootPartition `json:"partitions"`
+}
+
+// parseImageInfoBoot extracts the bootloader and the partitions from
+// the image-info output
+func parseImageInfoBoot(imageInfo interface{}) (*imageInfoBoot, error) {
+	raw, err := json.Marshal(imageInfo)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode the image info: %v", err)
+	}
+
+	var boot imageInfoBoot
+	err = json.Unmarshal(raw, &boot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the bootloader from the image info: %v", err)
+	}
+
+	return &boot, nil
+}
+
+// partitionIndex returns the index of the first partition of the type,
+// or -1 if there is none
+func (b *imageInfoBoot) partitionIndex(types ...string) int {
+	for i, p := range b.Partitions {
+		for _, t := range types {
+			if strings.EqualFold(p.Type, t) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// espIndex returns the index of the EFI system partition, or -1 if the
+// image has none
+func (b *imageInfoBoot) espIndex() int {
+	return b.partitionIndex(espPartitionType, espDOSPartitionType)
+}
+
+// testBootloader checks the bootloader family of the image. BIOS images
+// must have grub in the MBR and a BIOS boot partition if the partition
+// table is gpt, UEFI images must have a vfat EFI system partition.
+func testBootloader(imageInfo interface{}, assertions *bootloaderAssertions) error {
+	var bios, uefi bool
+	switch assertions.Family {
+	case "bios":
+		bios = true
+	case "uefi":
+		uefi = true
+	case "hybrid":
+		bios, uefi = true, true
+	default:
+		return fmt.Errorf("unknown bootloader family %q, expected bios, uefi or hybrid", assertions.Family)
+	}
+
+	boot, err := parseImageInfoBoot(imageInfo)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	if bios {
+		if boot.Bootloader != "grub" {
+			problems = append(problems, fmt.Sprintf("the MBR contains the %s bootloader instead of grub", boot.Bootloader))
+		}
+		if boot.PartitionTable == "gpt" && boot.partitionIndex(biosBootPartitionType) == -1 {
+			problems = append(problems, "the gpt partition table has no BIOS boot partition")
+		}
+	}
+
+	if uefi || len(assertions.EFIBinaries) > 0 {
+		if i := boot.espIndex(); i == -1 {
+			problems = append(problems, "the image has no EFI system partition")
+		} else if fstype := boot.Partitions[i].FSType; fstype == nil || *fstype != "vfat" {
+			problems = append(problems, "the EFI system partition has no vfat filesystem")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the image doesn't boot using %s:\n%s", assertions.Family, strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// withRawImage passes the image converted to raw to the function f, raw
+// images are passed as they are. The converted image is deleted after the
+// function returns.
+func withRawImage(image string, f func(raw string) error) error {
+	format, err := getQemuImageFormat(image)
+	if err != nil {
+		return err
+	}
+	if format == "raw" {
+		return f(image)
+	}
+
+	return withTempDir("", "osbuild-image-tests-raw", func(dir string) error {
+		raw := path.Join(dir, "image.raw")
+		cmd := exec.Command("qemu-img", "convert", "-O", "raw", image, raw)
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("cannot convert the image to raw: %v", err)
+		}
+
+		return f(raw)
+	})
+}
+
+// checkEFIBinaries mounts the EFI system partition of the image and checks
+// that the binaries exist on it
+func checkEFIBinaries(imagePath string, imageInfo interface{}, binaries []string) error {
+	boot, err := parseImageInfoBoot(imageInfo)
+	if err != nil {
+		return err
+	}
+
+	esp := boot.espIndex()
+	if esp == -1 {
+		return fmt.Errorf("the image has no EFI system partition")
+	}
+
+	var missing []string
+	err = withRawImage(imagePath, func(raw string) error {
+		return withLoopDevice(raw, func(device string, _ []string) error {
+			return withTempDir("", "osbuild-image-tests-esp", func(dir string) error {
+				err := mountReadOnly(device+"p"+strconv.Itoa(esp+1), dir)
+				if err != nil {
+					return err
+				}
+				defer unmount(dir)
+
+				for _, binary := range binaries {
+					_, err := os.Stat(path.Join(dir, binary))
+					if err != nil {
+						missing = append(missing, binary)
+					}
+				}
+
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the EFI system partition lacks the binaries:\n%s", strings.Join(missing, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/azuretest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/openstacktest"
+)
+
+// resourcePrefix starts the names of all the cloud resources created by
+// the image tests, so the leaked ones can be found
+const resourcePrefix = "osbuild-image-tests-"
+
+// cleanupAWS deletes the images and their snapshots older than maxAge
+func cleanupAWS(maxAge time.Duration) error {
+	creds, err := getAWSCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		harnessLog.Infof("no AWS credentials given, skipping the cleanup")
+		return nil
+	}
+
+	e, err := newEC2(creds)
+	if err != nil {
+		return err
+	}
+
+	ec2Images, err := listEC2Images(e, resourcePrefix)
+	if err != nil {
+		return err
+	}
+
+	var retErr error
+	for _, image := range ec2Images {
+		created, err := time.Parse(time.RFC3339, *image.CreationDate)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot parse the creation date of %s: %v", *image.Name, err)
+			continue
+		}
+		if time.Since(created) < maxAge {
+			continue
+		}
+
+		imageDesc, err := describeEC2Image(e, *image.Name)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot describe the image %s: %v", *image.Name, err)
+			continue
+		}
+
+		harnessLog.Infof("deleting the leaked AWS image %s created at %v", *image.Name, created)
+		err = deleteEC2Image(e, imageDesc)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the image %s: %v", *image.Name, err)
+		}
+	}
+
+	return retErr
+}
+
+// cleanupAzure deletes the uploaded images older than maxAge
+func cleanupAzure(maxAge time.Duration) error {
+	creds, err := azuretest.GetAzureCredentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		harnessLog.Infof("no Azure credentials given, skipping the cleanup")
+		return nil
+	}
+
+	blobs, err := azuretest.ListImagesInAzure(creds, resourcePrefix)
+	if err != nil {
+		return err
+	}
+
+	var retErr error
+	for name, modified := range blobs {
+		if time.Since(modified) < maxAge {
+			continue
+		}
+
+		harnessLog.Infof("deleting the leaked Azure image %s modified at %v", name, modified)
+		err = azuretest.DeleteImageFromAzure(creds, name)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the image %s: %v", name, err)
+		}
+	}
+
+	return retErr
+}
+
+// cleanupOpenStack deletes the images older than maxAge
+func cleanupOpenStack(maxAge time.Duration) error {
+	creds, err := openstack.AuthOptionsFromEnv()
+	if (creds == gophercloud.AuthOptions{}) {
+		harnessLog.Infof("no OpenStack credentials given, skipping the cleanup")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	provider, err := openstack.AuthenticatedClient(creds)
+	if err != nil {
+		return fmt.Errorf("cannot authenticate to openstack: %v", err)
+	}
+
+	openstackImages, err := openstacktest.ListImagesInOpenStack(provider, resourcePrefix)
+	if err != nil {
+		return err
+	}
+
+	var retErr error
+	for _, image := range openstackImages {
+		if time.Since(image.CreatedAt) < maxAge {
+			continue
+		}
+
+		harnessLog.Infof("deleting the leaked OpenStack image %s created at %v", image.Name, image.CreatedAt)
+		err = openstacktest.DeleteImageFromOpenStack(provider, image.ID)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the image %s: %v", image.Name, err)
+		}
+	}
+
+	return retErr
+}
+
+// cleanupLeakedResources deletes the cloud resources older than maxAge left
+// behind by crashed or timed out runs. All the clouds are cleaned up even
+// if some of them fail.
+// Only AWS, Azure and OpenStack are covered. The images uploaded to GCP,
+// VMware, IBM Cloud, DigitalOcean, OCI and Hetzner Cloud are named using
+// resourcePrefix too, but their leaked images have to be deleted manually.
+func cleanupLeakedResources(maxAge time.Duration) error {
+	var retErr error
+	for _, cleanupCloud := range []func(time.Duration) error{cleanupAWS, cleanupAzure, cleanupOpenStack} {
+		err := cleanupCloud(maxAge)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "%v", err)
+		}
+	}
+
+	return retErr
+}
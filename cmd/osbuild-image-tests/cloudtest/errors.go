@@ -0,0 +1,33 @@
+// +build integration
+
+// Package cloudtest contains the helpers shared by the packages uploading
+// the images to the clouds
+package cloudtest
+
+import "fmt"
+
+// wrappedError adds a context to the error of a cloud SDK, the original
+// error is kept so the harness can still tell whether it's worth retrying
+type wrappedError struct {
+	message string
+	cause   error
+}
+
+func (e *wrappedError) Error() string {
+	return e.message + ": " + e.cause.Error()
+}
+
+// Cause returns the wrapped error, the method follows the convention of
+// github.com/pkg/errors
+func (e *wrappedError) Cause() error {
+	return e.cause
+}
+
+// Wrapf returns an error with the message formatted from format and args
+// followed by the message of cause
+func Wrapf(cause error, format string, args ...interface{}) error {
+	return &wrappedError{
+		message: fmt.Sprintf(format, args...),
+		cause:   cause,
+	}
+}
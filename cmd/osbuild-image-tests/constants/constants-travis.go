@@ -21,6 +21,16 @@ func GetOsbuildCommand(store, outputDirectory string) *exec.Cmd {
 	return cmd
 }
 
+func GetOsbuildVersionCommand() *exec.Cmd {
+	cmd := exec.Command(
+		"python3",
+		"-m", "osbuild",
+		"--version",
+	)
+	cmd.Dir = "osbuild"
+	return cmd
+}
+
 func GetImageInfoCommand(imagePath string) *exec.Cmd {
 	cmd := exec.Command(
 		"tools/image-info",
@@ -37,6 +47,7 @@ var TestPaths = struct {
 	UserData                string
 	MetaData                string
 	AzureDeploymentTemplate string
+	DNFJson                 string
 }{
 	ImageInfo:               "tools/image-info",
 	PrivateKey:              "test/keyring/id_rsa",
@@ -44,4 +55,5 @@ var TestPaths = struct {
 	UserData:                "test/cloud-init/user-data",
 	MetaData:                "test/cloud-init/meta-data",
 	AzureDeploymentTemplate: "test/azure-deployment-template.json",
+	DNFJson:                 "dnf-json",
 }
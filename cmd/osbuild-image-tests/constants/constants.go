@@ -14,6 +14,13 @@ func GetOsbuildCommand(store, outputDirectory string) *exec.Cmd {
 	)
 }
 
+func GetOsbuildVersionCommand() *exec.Cmd {
+	return exec.Command(
+		"osbuild",
+		"--version",
+	)
+}
+
 func GetImageInfoCommand(imagePath string) *exec.Cmd {
 	return exec.Command(
 		"/usr/libexec/osbuild-composer/image-info",
@@ -28,6 +35,7 @@ var TestPaths = struct {
 	UserData                string
 	MetaData                string
 	AzureDeploymentTemplate string
+	DNFJson                 string
 }{
 	ImageInfo:               "/usr/libexec/osbuild-composer/image-info",
 	PrivateKey:              "/usr/share/tests/osbuild-composer/keyring/id_rsa",
@@ -35,4 +43,5 @@ var TestPaths = struct {
 	UserData:                "/usr/share/tests/osbuild-composer/cloud-init/user-data",
 	MetaData:                "/usr/share/tests/osbuild-composer/cloud-init/meta-data",
 	AzureDeploymentTemplate: "/usr/share/tests/osbuild-composer/azure-deployment-template.json",
+	DNFJson:                 "/usr/libexec/osbuild-composer/dnf-json",
 }
@@ -0,0 +1,123 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// containerLogLines is the number of lines of the container output
+// appended to the error if the test fails
+const containerLogLines = 50
+
+// podman runs podman with the arguments and returns its trimmed standard
+// output, the standard error is included in the returned error
+func podman(args ...string) (string, error) {
+	cmd := exec.Command("podman", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("podman %s failed: %v\n%s", args[0], err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("podman %s failed: %v", args[0], err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseLoadedImage returns the first image reported by podman load, e.g.
+// "Loaded image(s): localhost/bootc:latest" or "Loaded image: sha256:..."
+func parseLoadedImage(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, ": ")
+		if !strings.HasPrefix(line, "Loaded image") || i == -1 {
+			continue
+		}
+
+		image := strings.TrimSpace(strings.Split(line[i+2:], ",")[0])
+		if image != "" {
+			return image, nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot find the loaded image in the podman output: %s", output)
+}
+
+// withLoadedContainerImage loads the OCI archive into the podman storage
+// and passes the image reference to the function f. The image is removed
+// after the function returns unless keep returns true.
+func withLoadedContainerImage(archive string, keep func() bool, f func(image string) error) error {
+	out, err := podman("load", "--input", archive)
+	if err != nil {
+		return fmt.Errorf("cannot load the container image: %v", err)
+	}
+
+	image, err := parseLoadedImage(out)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if keep() {
+			return
+		}
+
+		_, err := podman("rmi", "--force", image)
+		if err != nil {
+			harnessLog.Warningf("cannot remove the container image %s: %v", image, err)
+		}
+	}()
+
+	return f(image)
+}
+
+// withRunningContainer runs the image detached with the ssh port published
+// on a random localhost port and passes the container id and the port to
+// the function f. The output of the container is appended to the error
+// returned by f. The container is removed after the function returns
+// unless keep returns true.
+func withRunningContainer(image string, keep func() bool, f func(id string, port int) error) error {
+	id, err := podman("run", "--detach", "--publish", "127.0.0.1::22", image)
+	if err != nil {
+		return fmt.Errorf("cannot run the container: %v", err)
+	}
+
+	defer func() {
+		if keep() {
+			return
+		}
+
+		_, err := podman("rm", "--force", id)
+		if err != nil {
+			harnessLog.Warningf("cannot remove the container %s: %v", id, err)
+		}
+	}()
+
+	// the output is host:port, e.g. 127.0.0.1:41623
+	address, err := podman("port", id, "22/tcp")
+	if err != nil {
+		return fmt.Errorf("cannot get the published ssh port: %v", err)
+	}
+	i := strings.LastIndex(address, ":")
+	if i == -1 {
+		return fmt.Errorf("invalid published ssh address: %s", address)
+	}
+	port, err := strconv.Atoi(address[i+1:])
+	if err != nil {
+		return fmt.Errorf("invalid published ssh address %s: %v", address, err)
+	}
+
+	err = f(id, port)
+	if err != nil {
+		logs, logsErr := podman("logs", "--tail", fmt.Sprint(containerLogLines), id)
+		if logsErr != nil {
+			logs = logsErr.Error()
+		}
+		return fmt.Errorf("%v\nthe end of the container output:\n%s", err, logs)
+	}
+
+	return nil
+}
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -24,13 +27,13 @@ import (
 func withNetworkNamespace(f func(ns netNS) error) error {
 	ns, err := newNetworkNamespace()
 	if err != nil {
-		return err
+		return &netnsError{err}
 	}
 
 	defer func() {
 		err := ns.Delete()
 		if err != nil {
-			log.Printf("cannot delete network namespace: %#v", err)
+			harnessLog.Warningf("cannot delete network namespace: %#v", err)
 		}
 	}()
 
@@ -48,7 +51,7 @@ func withTempFile(dir, pattern string, f func(file *os.File) error) error {
 	defer func() {
 		err := os.Remove(tempFile.Name())
 		if err != nil {
-			log.Printf("cannot remove the temporary file: %#v", err)
+			harnessLog.Warningf("cannot remove the temporary file: %#v", err)
 		}
 	}()
 
@@ -64,13 +67,50 @@ func withTempDir(dir, pattern string, f func(dir string) error) error {
 	defer func() {
 		err := os.RemoveAll(tempDir)
 		if err != nil {
-			log.Printf("cannot remove the temporary directory: %#v", err)
+			harnessLog.Warningf("cannot remove the temporary directory: %#v", err)
 		}
 	}()
 
 	return f(tempDir)
 }
 
+// withStoreSnapshot copies the osbuild store before running the function f.
+// If f fails, the store might contain broken objects, so it's restored from
+// the copy. osbuild doesn't tell us whether a failure was caused by the store,
+// therefore any failure causes a restore. The copy is made using reflinks
+// if the filesystem supports them.
+func withStoreSnapshot(store string, f func() error) error {
+	return withTempDir(path.Dir(store), "store-snapshot-", func(snapshot string) error {
+		cmd := exec.Command("cp", "-a", "--reflink=auto", store+"/.", snapshot)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("cannot snapshot the store: %#v", err)
+		}
+
+		fErr := f()
+		if fErr == nil {
+			return nil
+		}
+
+		harnessLog.Warningf("the build failed, restoring the store %s from the snapshot", store)
+
+		err = os.RemoveAll(store)
+		if err != nil {
+			return wrapErrorf(fErr, "cannot remove the store before restoring it: %#v", err)
+		}
+
+		// the snapshot is moved in place of the store, so withTempDir has
+		// nothing left to remove
+		err = os.Rename(snapshot, store)
+		if err != nil {
+			return wrapErrorf(fErr, "cannot restore the store from the snapshot: %#v", err)
+		}
+
+		return fErr
+	})
+}
+
 // writeCloudInitSO creates cloud-init iso from specified userData and
 // metaData and writes it to the writer
 func writeCloudInitISO(writer io.Writer, userData, metaData string) error {
@@ -95,13 +135,33 @@ func writeCloudInitISO(writer io.Writer, userData, metaData string) error {
 	return nil
 }
 
-// withBootedQemuImage boots the specified image in the specified namespace
-// using qemu. The VM is killed immediately after function returns.
-func withBootedQemuImage(image string, ns netNS, f func() error) error {
+// withCloudInitISO creates a cloud-init NoCloud iso from the user-data and
+// the test meta-data and passes its path to the function f. The test
+// user-data is used if userData is empty. The iso is deleted immediately
+// after the function returns.
+func withCloudInitISO(userData string, f func(iso string) error) error {
+	if userData == "" {
+		return writeCloudInitISOFile(constants.TestPaths.UserData, f)
+	}
+
+	return withTempDir("", "osbuild-image-tests-user-data", func(dir string) error {
+		// the file names are kept in the iso, cloud-init needs user-data
+		userDataFile := path.Join(dir, "user-data")
+		err := ioutil.WriteFile(userDataFile, []byte(userData), 0600)
+		if err != nil {
+			return fmt.Errorf("cannot write the cloud-init user-data: %#v", err)
+		}
+
+		return writeCloudInitISOFile(userDataFile, f)
+	})
+}
+
+// writeCloudInitISOFile does the actual work for withCloudInitISO
+func writeCloudInitISOFile(userDataFile string, f func(iso string) error) error {
 	return withTempFile("", "osbuild-image-tests-cloudinit", func(cloudInitFile *os.File) error {
 		err := writeCloudInitISO(
 			cloudInitFile,
-			constants.TestPaths.UserData,
+			userDataFile,
 			constants.TestPaths.MetaData,
 		)
 		if err != nil {
@@ -113,120 +173,705 @@ func withBootedQemuImage(image string, ns netNS, f func() error) error {
 			return fmt.Errorf("cannot close temporary cloudinit file: %#v", err)
 		}
 
-		var qemuCmd *exec.Cmd
-		if common.CurrentArch() == "x86_64" {
-			hostDistroName, err := distro.GetHostDistroName()
-			if err != nil {
-				return fmt.Errorf("cannot determing the current distro: %v", err)
-			}
+		return f(cloudInitFile.Name())
+	})
+}
 
-			var qemuPath string
-			if strings.HasPrefix(hostDistroName, "rhel") {
-				qemuPath = "/usr/libexec/qemu-kvm"
-			} else {
-				qemuPath = "qemu-system-x86_64"
-			}
+// qemuOptions tweaks the virtual machine started by withBootedQemuImage
+type qemuOptions struct {
+	// CPU is the qemu CPU model, "host" is used if empty
+	CPU string
+	// Overlay boots the image from a fresh qcow2 overlay with the image
+	// as a read-only backing file instead of using -snapshot
+	Overlay bool
+	// SMP is the number of vCPUs, the number of host CPUs is used if zero
+	SMP int
+	// VsockCID boots the image in a microVM without networking, the guest
+	// is reachable only using vsock at this context id
+	VsockCID uint32
+	// Binary is the qemu binary, getQemuPath is used if empty
+	Binary string
+	// ArgsTemplate replaces the default qemu arguments, see
+	// expandQemuArgsTemplate
+	ArgsTemplate string
+	// Format is the format of the image (raw or qcow2), qemu probes it
+	// if empty
+	Format string
+	// Logger receives the messages about the VM, harnessLog is used if nil
+	Logger *leveledLogger
+	// UserData is the cloud-init user-data of the NoCloud seed attached
+	// as a CD-ROM, the test user-data is used if empty
+	UserData string
+	// Memory is the guest memory in MiB, defaultQemuMemory is used if zero
+	Memory int
+	// Machine is the qemu machine type, defaultQemuMachine is used if empty.
+	// It's ignored for microVMs.
+	Machine string
+	// Kernel boots the guest directly from this kernel instead of the
+	// bootloader of the image, the image is attached as a data drive
+	Kernel string
+	// Initrd is the initrd of the directly booted kernel, it's optional
+	Initrd string
+	// Cmdline is the command line of the directly booted kernel,
+	// a serial console is added if it doesn't set one
+	Cmdline string
+}
 
-			qemuCmd = ns.NamespacedCommand(
-				qemuPath,
-				"-cpu", "host",
-				"-smp", strconv.Itoa(runtime.NumCPU()),
-				"-m", "1024",
-				"-snapshot",
-				"-M", "accel=kvm",
-				"-cdrom", cloudInitFile.Name(),
-				"-net", "nic,model=rtl8139", "-net", "user,hostfwd=tcp::22-:22",
-				"-nographic",
-				image,
-			)
-		} else if common.CurrentArch() == "aarch64" {
-			// This command does not use KVM as I was unable to make it work in Beaker,
-			// once we have machines that can use KVM, enable it to make it faster
-			qemuCmd = ns.NamespacedCommand(
-				"qemu-system-aarch64",
-				"-cpu", "host",
-				"-M", "virt",
-				"-m", "2048",
-				// As opposed to x86_64, aarch64 uses UEFI, this one comes from edk2-aarch64 package on Fedora
-				"-bios", "/usr/share/edk2/aarch64/QEMU_EFI.fd",
-				"-boot", "efi",
-				"-M", "accel=kvm",
-				"-snapshot",
-				"-cdrom", cloudInitFile.Name(),
-				"-net", "nic,model=rtl8139", "-net", "user,hostfwd=tcp::22-:22",
-				"-nographic",
-				image,
-			)
-		} else {
-			panic("Running on unknown architecture.")
+// minQemuMemory is the smallest guest memory in MiB accepted by validate,
+// no image tested here boots with less
+const minQemuMemory = 256
+
+// defaultQemuMemory returns the guest memory in MiB used if none is given
+func defaultQemuMemory() int {
+	if common.CurrentArch() == "aarch64" {
+		return 2048
+	}
+
+	return 1024
+}
+
+// defaultQemuMachine returns the machine type used if none is given,
+// an empty string means the qemu default
+func defaultQemuMachine() string {
+	if common.CurrentArch() == "aarch64" {
+		return "virt"
+	}
+
+	return ""
+}
+
+// validate returns an error if the resources requested by opts cannot
+// be used on this architecture
+func (opts qemuOptions) validate() error {
+	if opts.SMP < 0 {
+		return fmt.Errorf("the number of vCPUs cannot be negative, got %d", opts.SMP)
+	}
+
+	if opts.Memory != 0 && opts.Memory < minQemuMemory {
+		return fmt.Errorf("the guest memory must be at least %d MiB, got %d", minQemuMemory, opts.Memory)
+	}
+
+	if opts.Machine != "" && common.CurrentArch() == "aarch64" && !strings.HasPrefix(opts.Machine, "virt") {
+		return fmt.Errorf("the machine type %s cannot be used on aarch64, use virt", opts.Machine)
+	}
+
+	if opts.Kernel == "" && (opts.Initrd != "" || opts.Cmdline != "") {
+		return fmt.Errorf("the initrd and the kernel command line require a kernel")
+	}
+
+	return nil
+}
+
+// serialConsole returns the kernel console of the first serial port
+func serialConsole() string {
+	if common.CurrentArch() == "aarch64" {
+		return "ttyAMA0"
+	}
+
+	return "ttyS0"
+}
+
+// directKernelBootArgs returns the qemu arguments booting the kernel given
+// in opts instead of the bootloader of the image, or nil if none is given
+func directKernelBootArgs(opts qemuOptions) []string {
+	if opts.Kernel == "" {
+		return nil
+	}
+
+	args := []string{"-kernel", opts.Kernel}
+	if opts.Initrd != "" {
+		args = append(args, "-initrd", opts.Initrd)
+	}
+
+	cmdline := strings.TrimSpace(opts.Cmdline)
+	if !strings.Contains(" "+cmdline, " console=") {
+		cmdline = strings.TrimSpace(cmdline + " console=" + serialConsole())
+	}
+
+	return append(args, "-append", cmdline)
+}
+
+// getQemuImageFormat returns the format of the disk image as detected
+// by qemu-img
+func getQemuImageFormat(image string) (string, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", image).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get the image info: %#v", err)
+	}
+
+	var info struct {
+		Format string
+	}
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode the image info: %#v", err)
+	}
+
+	return info.Format, nil
+}
+
+// withQemuOverlay creates a qcow2 overlay backed by the image and passes
+// its path to the function f. The format of the image is detected if
+// empty. The overlay is deleted immediately after the function returns,
+// the image itself is never written to.
+func withQemuOverlay(image, format string, f func(overlay string) error) error {
+	absImage, err := filepath.Abs(image)
+	if err != nil {
+		return fmt.Errorf("cannot get the absolute path of the image: %#v", err)
+	}
+
+	if format == "" {
+		format, err = getQemuImageFormat(absImage)
+		if err != nil {
+			return err
 		}
+	}
 
-		err = qemuCmd.Start()
+	return withTempDir("", "osbuild-image-tests-overlay", func(dir string) error {
+		overlay := path.Join(dir, "overlay.qcow2")
+		cmd := exec.Command(
+			"qemu-img", "create",
+			"-f", "qcow2",
+			"-b", absImage,
+			"-F", format,
+			overlay,
+		)
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
 		if err != nil {
-			return fmt.Errorf("cannot start the qemu process: %#v", err)
+			return fmt.Errorf("cannot create the overlay: %#v", err)
 		}
 
-		defer func() {
-			err := killProcessCleanly(qemuCmd.Process, time.Second)
-			if err != nil {
-				log.Printf("cannot kill the qemu process: %#v", err)
-			}
-		}()
+		return f(overlay)
+	})
+}
+
+// getQemuPath returns the qemu binary for the current architecture
+func getQemuPath() (string, error) {
+	switch common.CurrentArch() {
+	case "x86_64":
+		hostDistroName, err := distro.GetHostDistroName()
+		if err != nil {
+			return "", fmt.Errorf("cannot determing the current distro: %v", err)
+		}
+
+		if strings.HasPrefix(hostDistroName, "rhel") {
+			return "/usr/libexec/qemu-kvm", nil
+		}
+		return "qemu-system-x86_64", nil
+	case "aarch64":
+		return "qemu-system-aarch64", nil
+	default:
+		return "", fmt.Errorf("qemu is not supported on %s", common.CurrentArch())
+	}
+}
+
+// qemuSSHPort is the port in the network namespace forwarded by qemu to
+// the ssh port of the guest
+const qemuSSHPort = 2222
+
+// freeLocalPort returns a TCP port on the loopback interface that is not
+// in use. The port is released before it's returned, so another process
+// might take it in the meantime.
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("cannot find a free port: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// qemuVM is the virtual machine started by withBootedQemuImage
+type qemuVM struct {
+	// SerialLog is the path to the file with the guest serial console output
+	SerialLog string
+	// Pid is the process id of qemu
+	Pid int
+	// SSHPort is the port forwarded to the guest ssh port, it's 0 if the
+	// guest is reachable only over vsock
+	SSHPort  int
+	exited   chan struct{}
+	keep     bool
+	watchdog *consoleWatchdog
+}
+
+// Failure returns an error if the guest is known to be hung, e.g. because
+// its console shows a kernel panic, the VM is killed then
+func (vm *qemuVM) Failure() error {
+	return vm.watchdog.Failure()
+}
+
+// KeepRunning makes the VM survive the end of withBootedQemuImage
+func (vm *qemuVM) KeepRunning() {
+	vm.keep = true
+}
+
+// WaitForExit waits until the qemu process exits. It returns false if it
+// didn't exit in the timeout.
+func (vm *qemuVM) WaitForExit(timeout time.Duration) bool {
+	select {
+	case <-vm.exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
 
-		return f()
+// withBootedQemuImage boots the specified image in the specified namespace
+// using qemu. If the namespace is empty, qemu runs in the namespace of the
+// harness and forwards a free loopback port to the guest ssh port, unless
+// opts.VsockCID is set. The VM is killed immediately after function returns
+// unless vm.KeepRunning is called.
+func withBootedQemuImage(image string, ns netNS, opts qemuOptions, f func(vm *qemuVM) error) error {
+	if opts.Overlay {
+		return withQemuOverlay(image, opts.Format, func(overlay string) error {
+			opts.Format = "qcow2"
+			return bootQemuImage(overlay, false, ns, opts, f)
+		})
+	}
+
+	return bootQemuImage(image, true, ns, opts, f)
+}
+
+// bootQemuImage does the actual work for withBootedQemuImage. If snapshot
+// is true, the image is booted using -snapshot so it's not modified.
+func bootQemuImage(image string, snapshot bool, ns netNS, opts qemuOptions, f func(vm *qemuVM) error) error {
+	return withCloudInitISO(opts.UserData, func(cloudInitISO string) error {
+		return withTempFile("", "osbuild-image-tests-serial", func(serialLog *os.File) error {
+			return runQemu(image, snapshot, ns, opts, cloudInitISO, serialLog.Name(), f)
+		})
 	})
 }
 
-// withBootedNspawnImage boots the specified image in the specified namespace
-// using nspawn. The VM is killed immediately after function returns.
-func withBootedNspawnImage(image string, ns netNS, f func() error) error {
-	cmd := exec.Command(
-		"systemd-nspawn",
-		"--boot", "--register=no",
-		"--image", image,
-		"--network-namespace-path", ns.Path(),
-	)
+// runQemu starts qemu with the image, the cloud-init iso and the serial
+// console redirected to the serialLog file
+func runQemu(image string, snapshot bool, ns netNS, opts qemuOptions, cloudInitISO, serialLog string, f func(vm *qemuVM) error) error {
+	cpu := opts.CPU
+	if cpu == "" {
+		cpu = "host"
+	}
 
-	err := cmd.Start()
+	qemuPath := opts.Binary
+	if qemuPath == "" {
+		var err error
+		qemuPath, err = getQemuPath()
+		if err != nil {
+			return err
+		}
+	}
+
+	smp := opts.SMP
+	if smp == 0 {
+		smp = runtime.NumCPU()
+	}
+
+	memory := opts.Memory
+	if memory == 0 {
+		memory = defaultQemuMemory()
+	}
+
+	machine := opts.Machine
+	if machine == "" {
+		machine = defaultQemuMachine()
+	}
+
+	var qemuArgs []string
+	if common.CurrentArch() == "x86_64" {
+		qemuArgs = []string{
+			"-cpu", cpu,
+			"-smp", strconv.Itoa(smp),
+			"-m", strconv.Itoa(memory),
+			"-M", "accel=kvm",
+		}
+		if machine != "" {
+			qemuArgs = append(qemuArgs, "-M", machine)
+		}
+	} else if common.CurrentArch() == "aarch64" {
+		// This command does not use KVM as I was unable to make it work in Beaker,
+		// once we have machines that can use KVM, enable it to make it faster
+		qemuArgs = []string{
+			"-cpu", cpu,
+			"-M", machine,
+			"-m", strconv.Itoa(memory),
+			// As opposed to x86_64, aarch64 uses UEFI, this one comes from edk2-aarch64 package on Fedora
+			"-bios", "/usr/share/edk2/aarch64/QEMU_EFI.fd",
+			"-boot", "efi",
+			"-M", "accel=kvm",
+		}
+	} else {
+		panic("Running on unknown architecture.")
+	}
+
+	if common.CurrentArch() == "aarch64" && opts.SMP != 0 {
+		qemuArgs = append(qemuArgs, "-smp", strconv.Itoa(opts.SMP))
+	}
+
+	// the arguments managed by the harness, they are put either after
+	// the default arguments or into the user-specified template
+	var diskArgs, netdevArgs []string
+	sshPort := 0
+	if snapshot {
+		diskArgs = append(diskArgs, "-snapshot")
+	}
+
+	if opts.VsockCID != 0 {
+		qemuArgs = append(qemuArgs, microVMMachineArgs()...)
+		diskArgs = append(diskArgs, microVMDiskArgs(image, opts.Format, cloudInitISO)...)
+		netdevArgs = microVMNetdevArgs(opts.VsockCID)
+	} else {
+		diskArgs = append(diskArgs, "-cdrom", cloudInitISO)
+		if opts.Format != "" {
+			diskArgs = append(diskArgs, "-drive", "file="+image+",format="+opts.Format+",index=0,media=disk")
+		} else {
+			diskArgs = append(diskArgs, image)
+		}
+		hostAddress := ""
+		sshPort = qemuSSHPort
+		if ns == "" {
+			// the port is shared with the host and the other guests
+			hostAddress = "127.0.0.1"
+			var err error
+			sshPort, err = freeLocalPort()
+			if err != nil {
+				return err
+			}
+		}
+		netdevArgs = []string{"-net", "nic,model=rtl8139", "-net", fmt.Sprintf("user,hostfwd=tcp:%s:%d-:22", hostAddress, sshPort)}
+	}
+	// the directly booted kernel replaces the boot media, it goes with
+	// the disks into the template
+	diskArgs = append(diskArgs, directKernelBootArgs(opts)...)
+
+	serialArgs := []string{
+		"-nographic",
+		"-serial", "file:" + serialLog,
+	}
+
+	if opts.ArgsTemplate != "" {
+		qemuArgs = expandQemuArgsTemplate(opts.ArgsTemplate, diskArgs, netdevArgs, serialArgs)
+	} else {
+		qemuArgs = append(qemuArgs, diskArgs...)
+		qemuArgs = append(qemuArgs, netdevArgs...)
+		qemuArgs = append(qemuArgs, serialArgs...)
+	}
+
+	var qemuCmd *exec.Cmd
+	if ns != "" {
+		qemuCmd = ns.NamespacedCommand(qemuPath, qemuArgs...)
+	} else {
+		qemuCmd = exec.Command(qemuPath, qemuArgs...)
+	}
+
+	opts.Logger.Debugf("starting %s %s", qemuPath, strings.Join(qemuArgs, " "))
+	err := qemuCmd.Start()
 	if err != nil {
-		return fmt.Errorf("cannot start the systemd-nspawn process: %#v", err)
+		return fmt.Errorf("cannot start the qemu process: %#v", err)
+	}
+
+	vm := &qemuVM{
+		SerialLog: serialLog,
+		Pid:       qemuCmd.Process.Pid,
+		SSHPort:   sshPort,
+		exited:    make(chan struct{}),
 	}
 
+	go func() {
+		_ = qemuCmd.Wait()
+		close(vm.exited)
+	}()
+
+	vm.watchdog = startConsoleWatchdog(serialLog, func() {
+		opts.Logger.Errorf("the guest is hung, killing qemu")
+		err := killProcessCleanly(qemuCmd.Process, time.Second)
+		if err != nil {
+			opts.Logger.Errorf("cannot kill the qemu process: %#v", err)
+		}
+	})
+	defer vm.watchdog.Stop()
+
 	defer func() {
-		err := killProcessCleanly(cmd.Process, time.Second)
+		// the guest might have been powered off already
+		select {
+		case <-vm.exited:
+			return
+		default:
+		}
+
+		if vm.keep {
+			return
+		}
+
+		err := killProcessCleanly(qemuCmd.Process, time.Second)
 		if err != nil {
-			log.Printf("cannot kill the systemd-nspawn process: %#v", err)
+			opts.Logger.Errorf("cannot kill the qemu process: %#v", err)
 		}
 	}()
 
-	return f()
+	return withConsoleOnError(serialLog, func(string) error {
+		return f(vm)
+	})
 }
 
-// withBootedNspawnImage boots the specified directory in the specified namespace
-// using nspawn. The VM is killed immediately after function returns.
-func withBootedNspawnDirectory(dir string, ns netNS, f func() error) error {
-	cmd := exec.Command(
-		"systemd-nspawn",
-		"--boot", "--register=no",
-		"--directory", dir,
-		"--network-namespace-path", ns.Path(),
-	)
+// pxeOptions describes the netboot artifacts, the paths are relative to
+// the directory served to the guest
+type pxeOptions struct {
+	Kernel  string
+	Initrd  string
+	Rootfs  string
+	Cmdline string
+}
+
+// pxeServerPort is the port of the HTTP server serving the netboot artifacts
+// inside the network namespace. The guest reaches it through the qemu
+// user-mode network gateway.
+const pxeServerPort = 8080
+const pxeServerURL = "http://10.0.2.2:8080/"
+
+// writeIPXEScript writes an iPXE script booting the netboot artifacts into
+// the directory and returns its name. If the rootfs is given, it's passed
+// to dracut as a live image.
+func writeIPXEScript(dir string, opts pxeOptions) (string, error) {
+	cmdline := opts.Cmdline
+	if opts.Rootfs != "" {
+		cmdline += " root=live:" + pxeServerURL + opts.Rootfs
+	}
+
+	script := fmt.Sprintf(`#!ipxe
+dhcp
+kernel %s%s initrd=%s %s
+initrd %s%s
+boot
+`, pxeServerURL, opts.Kernel, path.Base(opts.Initrd), strings.TrimSpace(cmdline), pxeServerURL, opts.Initrd)
+
+	const name = "osbuild-image-tests.ipxe"
+	err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0644)
+	if err != nil {
+		return "", fmt.Errorf("cannot write the ipxe script: %#v", err)
+	}
+
+	return name, nil
+}
+
+// withHTTPServer serves the directory over HTTP on the port inside
+// the network namespace. The server is killed immediately after
+// the function f returns.
+func withHTTPServer(dir string, port int, ns netNS, f func() error) error {
+	cmd := ns.NamespacedCommand("python3", "-m", "http.server", "--directory", dir, strconv.Itoa(port))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
 
 	err := cmd.Start()
 	if err != nil {
-		return fmt.Errorf("cannot start the systemd-nspawn process: %#v", err)
+		return fmt.Errorf("cannot start the http server: %#v", err)
 	}
 
 	defer func() {
 		err := killProcessCleanly(cmd.Process, time.Second)
 		if err != nil {
-			log.Printf("cannot kill the systemd-nspawn process: %#v", err)
+			harnessLog.Errorf("cannot kill the http server: %#v", err)
 		}
 	}()
 
+	err = waitForListener(ns, port, httpServerStartTimeout)
+	if err != nil {
+		return fmt.Errorf("the http server didn't start: %v", err)
+	}
+
 	return f()
 }
 
+// httpServerStartTimeout is the maximal time the http server serving the
+// netboot artifacts can take to start listening
+const httpServerStartTimeout = 30 * time.Second
+
+// waitForListener waits until a connection to the port inside the network
+// namespace succeeds or the timeout expires
+func waitForListener(ns netNS, port int, timeout time.Duration) error {
+	probe := fmt.Sprintf("import socket; socket.create_connection(('127.0.0.1', %d), 1).close()", port)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := ns.NamespacedCommand("python3", "-c", probe).Run()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nothing listens on the port %d after %v", port, timeout)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// withBootedPXEImage boots a diskless qemu guest in the specified namespace
+// from the netboot artifacts in the directory. The firmware loads an iPXE
+// script using the TFTP server built into qemu, the artifacts themselves are
+// downloaded over HTTP. The live rootfs is kept in the guest memory, given
+// in MiB. Like withBootedQemuImage, the serial console is written into
+// a file watched by the console watchdog. The VM and the HTTP server are
+// killed immediately after the function returns.
+func withBootedPXEImage(dir string, opts pxeOptions, memory int, ns netNS, f func(vm *qemuVM) error) error {
+	if common.CurrentArch() != "x86_64" {
+		return fmt.Errorf("pxe boot is supported only on x86_64")
+	}
+
+	script, err := writeIPXEScript(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	qemuPath, err := getQemuPath()
+	if err != nil {
+		return err
+	}
+
+	return withHTTPServer(dir, pxeServerPort, ns, func() error {
+		return withCloudInitISO("", func(cloudInitISO string) error {
+			return withTempFile("", "osbuild-image-tests-serial", func(serialLog *os.File) error {
+				qemuCmd := ns.NamespacedCommand(
+					qemuPath,
+					"-cpu", "host",
+					"-smp", strconv.Itoa(runtime.NumCPU()),
+					"-m", strconv.Itoa(memory),
+					"-M", "accel=kvm",
+					"-boot", "n",
+					"-cdrom", cloudInitISO,
+					"-netdev", "user,id=net0,tftp="+dir+",bootfile="+script+fmt.Sprintf(",hostfwd=tcp::%d-:22", qemuSSHPort),
+					"-device", "virtio-net-pci,netdev=net0",
+					"-nographic",
+					"-serial", "file:"+serialLog.Name(),
+				)
+
+				err := qemuCmd.Start()
+				if err != nil {
+					return fmt.Errorf("cannot start the qemu process: %#v", err)
+				}
+
+				vm := &qemuVM{
+					SerialLog: serialLog.Name(),
+					Pid:       qemuCmd.Process.Pid,
+					SSHPort:   qemuSSHPort,
+					exited:    make(chan struct{}),
+				}
+
+				go func() {
+					_ = qemuCmd.Wait()
+					close(vm.exited)
+				}()
+
+				vm.watchdog = startConsoleWatchdog(vm.SerialLog, func() {
+					harnessLog.Errorf("the guest is hung, killing qemu")
+					err := killProcessCleanly(qemuCmd.Process, time.Second)
+					if err != nil {
+						harnessLog.Errorf("cannot kill the qemu process: %#v", err)
+					}
+				})
+				defer vm.watchdog.Stop()
+
+				defer func() {
+					select {
+					case <-vm.exited:
+						return
+					default:
+					}
+
+					err := killProcessCleanly(qemuCmd.Process, time.Second)
+					if err != nil {
+						harnessLog.Errorf("cannot kill the qemu process: %#v", err)
+					}
+				}()
+
+				return withConsoleOnError(vm.SerialLog, func(string) error {
+					return f(vm)
+				})
+			})
+		})
+	})
+}
+
+// consoleLogLines is the number of lines of the guest console shown
+// when a boot test fails
+const consoleLogLines = 50
+
+// withConsoleOnError runs the function f with the path to the guest console
+// log, the end of the log is appended to the error returned by f
+func withConsoleOnError(consoleLog string, f func(consoleLog string) error) error {
+	err := f(consoleLog)
+	if err != nil {
+		return fmt.Errorf("%v\nthe end of the guest console:\n%s", err, tailFile(consoleLog, consoleLogLines))
+	}
+
+	return nil
+}
+
+// withBootedNspawnImage boots the specified image in the specified namespace
+// using nspawn. The output of the container is written to the file passed
+// to the function f. The VM is killed immediately after function returns.
+func withBootedNspawnImage(image string, ns netNS, f func(consoleLog string) error) error {
+	return withTempFile("", "osbuild-image-tests-console", func(consoleLog *os.File) error {
+		cmd := exec.Command(
+			"systemd-nspawn",
+			"--boot", "--register=no",
+			"--image", image,
+			"--network-namespace-path", ns.Path(),
+		)
+		cmd.Stdout = consoleLog
+		cmd.Stderr = consoleLog
+
+		err := cmd.Start()
+		if err != nil {
+			return fmt.Errorf("cannot start the systemd-nspawn process: %#v", err)
+		}
+
+		defer func() {
+			err := killProcessCleanly(cmd.Process, time.Second)
+			if err != nil {
+				harnessLog.Errorf("cannot kill the systemd-nspawn process: %#v", err)
+			}
+		}()
+
+		return withConsoleOnError(consoleLog.Name(), f)
+	})
+}
+
+// withBootedNspawnDirectory boots the specified directory in the specified
+// namespace using nspawn. The output of the container is written to the file
+// passed to the function f. The VM is killed immediately after function
+// returns. If volatile is true, the directory is not written to, the changes
+// go to a temporary overlay instead.
+func withBootedNspawnDirectory(dir string, ns netNS, volatile bool, f func(consoleLog string) error) error {
+	return withTempFile("", "osbuild-image-tests-console", func(consoleLog *os.File) error {
+		args := []string{
+			"--boot", "--register=no",
+			"--directory", dir,
+			"--network-namespace-path", ns.Path(),
+		}
+		if volatile {
+			args = append(args, "--volatile=overlay")
+		}
+
+		cmd := exec.Command("systemd-nspawn", args...)
+		cmd.Stdout = consoleLog
+		cmd.Stderr = consoleLog
+
+		err := cmd.Start()
+		if err != nil {
+			return fmt.Errorf("cannot start the systemd-nspawn process: %#v", err)
+		}
+
+		defer func() {
+			err := killProcessCleanly(cmd.Process, time.Second)
+			if err != nil {
+				harnessLog.Errorf("cannot kill the systemd-nspawn process: %#v", err)
+			}
+		}()
+
+		return withConsoleOnError(consoleLog.Name(), f)
+	})
+}
+
 // withExtractedTarArchive extracts the provided archive and passes
 // a path to the result to the function f. The result is deleted
 // immediately after the function returns.
@@ -250,13 +895,14 @@ func withExtractedTarArchive(archive string, f func(dir string) error) error {
 }
 
 // withSSHKeyPair runs the function f with a newly generated
-// ssh key-pair, they key-pair is deleted immediately after
-// the function f returns
-func withSSHKeyPair(f func(privateKey, publicKey string) error) error {
+// ssh key-pair of the given type (e.g. rsa or ed25519), they key-pair
+// is deleted immediately after the function f returns
+func withSSHKeyPair(keyType string, f func(privateKey, publicKey string) error) error {
 	return withTempDir("", "keys", func(dir string) error {
-		privateKey := dir + "/id_rsa"
-		publicKey := dir + "/id_rsa.pub"
+		privateKey := dir + "/id_" + keyType
+		publicKey := privateKey + ".pub"
 		cmd := exec.Command("ssh-keygen",
+			"-t", keyType,
 			"-N", "",
 			"-f", privateKey,
 		)
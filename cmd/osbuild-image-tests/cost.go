@@ -0,0 +1,232 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// instancePrices are the prices of the instance types in USD per hour,
+// by provider and instance type. They are rough on-demand prices meant to
+// keep the spending visible, not to match the bill.
+type instancePrices map[string]map[string]float64
+
+// defaultInstancePrices are the prices of the instance types booted by
+// default, they can be overridden and extended using -prices
+var defaultInstancePrices = instancePrices{
+	"aws": {
+		"t3.micro": 0.0104,
+	},
+	"azure": {
+		"Standard_B1s": 0.0104,
+	},
+	"digitalocean": {
+		"s-1vcpu-2gb": 0.01786,
+	},
+	"gcp": {
+		"n1-standard-1": 0.0475,
+	},
+	"hetzner": {
+		"cx22": 0.0065,
+	},
+	"ibmcloud": {
+		"bx2-2x8": 0.096,
+	},
+	"oci": {
+		"VM.Standard2.1": 0.0638,
+	},
+}
+
+// readInstancePrices decodes the prices file and merges it into the default
+// prices, the format is given by the extension (.toml or .json)
+func readInstancePrices(name string) (instancePrices, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the prices file: %v", err)
+	}
+	defer f.Close()
+
+	var overrides instancePrices
+	switch path.Ext(name) {
+	case ".toml":
+		_, err = toml.DecodeReader(f, &overrides)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&overrides)
+	default:
+		return nil, fmt.Errorf("unknown prices file format %s, use .toml or .json", path.Ext(name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the prices file: %v", err)
+	}
+
+	prices := make(instancePrices)
+	for _, source := range []instancePrices{defaultInstancePrices, overrides} {
+		for provider, types := range source {
+			if prices[provider] == nil {
+				prices[provider] = make(map[string]float64)
+			}
+			for instanceType, price := range types {
+				prices[provider][instanceType] = price
+			}
+		}
+	}
+
+	return prices, nil
+}
+
+// instanceUsage is a machine booted in a cloud by a testcase
+type instanceUsage struct {
+	Testcase     string `json:"testcase"`
+	Provider     string `json:"provider"`
+	InstanceType string `json:"instance-type"`
+	Region       string `json:"region"`
+	// Runtime is the wall-clock time between the creation of the machine
+	// and its removal, in seconds
+	Runtime float64 `json:"runtime"`
+	// Kept is true if the machine was left running, its runtime is only
+	// a lower bound then
+	Kept bool `json:"kept,omitempty"`
+	// Cost is the estimated cost in USD, it's missing if the price of
+	// the instance type is unknown
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+// cloudUsage collects the machines booted in the clouds during the run
+var cloudUsage struct {
+	mutex     sync.Mutex
+	instances []instanceUsage
+}
+
+// recordInstanceUsage records a machine booted by the testcase since start
+func recordInstanceUsage(t *testing.T, provider, instanceType, region string, start time.Time) {
+	cloudUsage.mutex.Lock()
+	defer cloudUsage.mutex.Unlock()
+
+	cloudUsage.instances = append(cloudUsage.instances, instanceUsage{
+		Testcase:     t.Name(),
+		Provider:     provider,
+		InstanceType: instanceType,
+		Region:       region,
+		Runtime:      time.Since(start).Seconds(),
+		Kept:         keepAlive(t),
+	})
+}
+
+// usageReport is the content of the -cost-output file
+type usageReport struct {
+	Instances []instanceUsage `json:"instances"`
+	// Total is the estimated cost of the instances with a known price
+	Total float64 `json:"total"`
+}
+
+// newUsageReport estimates the cost of the recorded instances, sorted by
+// the testcase name
+func newUsageReport(instances []instanceUsage, prices instancePrices) usageReport {
+	report := usageReport{Instances: make([]instanceUsage, len(instances))}
+	copy(report.Instances, instances)
+	sort.SliceStable(report.Instances, func(i, j int) bool {
+		return report.Instances[i].Testcase < report.Instances[j].Testcase
+	})
+
+	for i := range report.Instances {
+		instance := &report.Instances[i]
+		price, known := prices[instance.Provider][instance.InstanceType]
+		if !known {
+			continue
+		}
+
+		cost := price * instance.Runtime / time.Hour.Seconds()
+		instance.Cost = &cost
+		report.Total += cost
+	}
+
+	return report
+}
+
+// format returns the report as a table followed by the total per provider
+func (r usageReport) format() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TESTCASE\tPROVIDER\tINSTANCE TYPE\tREGION\tRUNTIME\tCOST (USD)")
+
+	totals := make(map[string]float64)
+	for _, instance := range r.Instances {
+		cost := "unknown"
+		if instance.Cost != nil {
+			cost = fmt.Sprintf("%.4f", *instance.Cost)
+			totals[instance.Provider] += *instance.Cost
+		}
+		runtime := (time.Duration(instance.Runtime) * time.Second).String()
+		if instance.Kept {
+			runtime += " (kept)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", instance.Testcase, instance.Provider, instance.InstanceType, instance.Region, runtime, cost)
+	}
+	_ = w.Flush()
+
+	providers := make([]string, 0, len(totals))
+	for provider := range totals {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	for _, provider := range providers {
+		fmt.Fprintf(&b, "%s total: %.4f USD\n", provider, totals[provider])
+	}
+	fmt.Fprintf(&b, "total: %.4f USD", r.Total)
+
+	return b.String()
+}
+
+// reportCloudUsage logs the instances booted in the clouds with their
+// estimated cost and writes them to -cost-output if given
+func reportCloudUsage(t *testing.T) error {
+	cloudUsage.mutex.Lock()
+	instances := cloudUsage.instances
+	cloudUsage.mutex.Unlock()
+
+	if len(instances) == 0 && *costOutput == "" {
+		return nil
+	}
+
+	prices := defaultInstancePrices
+	if *pricesPath != "" {
+		var err error
+		prices, err = readInstancePrices(*pricesPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	report := newUsageReport(instances, prices)
+	if len(instances) > 0 {
+		t.Logf("instances booted in the clouds:\n%s", report.format())
+	}
+
+	if *costOutput == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode the cloud usage: %v", err)
+	}
+
+	err = ioutil.WriteFile(*costOutput, content, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write the cloud usage: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// credentialsProviders are the sections allowed in the -credentials file
+var credentialsProviders = []string{"aws", "azure", "digitalocean", "gcp", "hetzner", "ibmcloud", "oci", "openstack", "s3", "vmware"}
+
+// credentialsFile maps the provider sections to the environment variables
+// they set, e.g.
+//
+//	[aws]
+//	AWS_REGION = "us-east-1"
+//
+// The variables are the same ones the cloud backends read from the
+// environment.
+type credentialsFile map[string]map[string]string
+
+// readCredentialsFile decodes the credentials file, the format is given
+// by the extension (.toml or .json)
+func readCredentialsFile(name string) (credentialsFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the credentials file: %v", err)
+	}
+	defer f.Close()
+
+	var creds credentialsFile
+	switch path.Ext(name) {
+	case ".toml":
+		_, err = toml.DecodeReader(f, &creds)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&creds)
+	default:
+		return nil, fmt.Errorf("unknown credentials file format %s, use .toml or .json", path.Ext(name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the credentials file: %v", err)
+	}
+
+	return creds, nil
+}
+
+// validate returns an error if the file has an unknown provider section
+func (creds credentialsFile) validate() error {
+	var unknown []string
+	for provider := range creds {
+		known := false
+		for _, p := range credentialsProviders {
+			if provider == p {
+				known = true
+			}
+		}
+		if !known {
+			unknown = append(unknown, provider)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown providers %s in the credentials file, use one of %s", strings.Join(unknown, ", "), strings.Join(credentialsProviders, ", "))
+	}
+
+	return nil
+}
+
+// loadCredentialsFile sets the environment variables given in the
+// credentials file. The variables already set in the environment take
+// precedence. A provider without a section keeps falling back to qemu
+// unless its variables are set in the environment.
+func loadCredentialsFile(name string) error {
+	creds, err := readCredentialsFile(name)
+	if err != nil {
+		return err
+	}
+
+	err = creds.validate()
+	if err != nil {
+		return err
+	}
+
+	for provider, variables := range creds {
+		for variable, value := range variables {
+			if _, exists := os.LookupEnv(variable); exists {
+				harnessLog.Debugf("%s from the %s credentials is overridden by the environment", variable, provider)
+				continue
+			}
+
+			err := os.Setenv(variable, value)
+			if err != nil {
+				return fmt.Errorf("cannot set %s from the %s credentials: %v", variable, provider, err)
+			}
+		}
+	}
+
+	return nil
+}
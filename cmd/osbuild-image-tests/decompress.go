@@ -0,0 +1,215 @@
+// +build integration
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// sparseChunkSize is the size of the chunks checked for zeroes when writing
+// the decompressed image, all-zero chunks are skipped to keep it sparse
+const sparseChunkSize = 1024 * 1024
+
+// qemuImageFormats are the formats accepted by the format field of bootStruct
+var qemuImageFormats = []string{"raw", "qcow2"}
+
+// validateQemuImageFormat returns an error if format is neither empty
+// (detected by qemu) nor one of qemuImageFormats
+func validateQemuImageFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+
+	for _, f := range qemuImageFormats {
+		if format == f {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown image format %q, expected one of %s", format, strings.Join(qemuImageFormats, ", "))
+}
+
+// isCompressedImage returns true if the image must be decompressed before
+// qemu can boot it
+func isCompressedImage(image string) bool {
+	for _, suffix := range []string{".xz", ".gz", ".bz2", ".tar"} {
+		if strings.HasSuffix(image, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xzReader returns a reader decompressing r. There's no xz decoder in the
+// standard library, so the data are streamed through the xz binary.
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "--decompress", "--stdout")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a pipe for xz: %v", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start xz: %v", err)
+	}
+
+	return &commandReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// commandReader reads the output of a command, closing it waits for the
+// command and reports its failure
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *commandReader) Close() error {
+	// the rest of the output (e.g. the tar padding) must be consumed,
+	// otherwise the command is killed by SIGPIPE
+	_, _ = io.Copy(ioutil.Discard, r.ReadCloser)
+	_ = r.ReadCloser.Close()
+	err := r.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", r.cmd.Path, err)
+	}
+
+	return nil
+}
+
+// decompressedReader returns a reader streaming the disk image from the
+// compressed image. Tarballs must contain the disk image as their first
+// regular file.
+func decompressedReader(image string, r io.Reader) (io.ReadCloser, error) {
+	name := image
+	var rc io.ReadCloser = ioutil.NopCloser(r)
+
+	switch {
+	case strings.HasSuffix(name, ".xz"):
+		xz, err := xzReader(r)
+		if err != nil {
+			return nil, err
+		}
+		rc = xz
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the gzip header: %v", err)
+		}
+		rc = gz
+	case strings.HasSuffix(name, ".bz2"):
+		rc = ioutil.NopCloser(bzip2.NewReader(r))
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, ".xz"), ".gz"), ".bz2")
+
+	if !strings.HasSuffix(name, ".tar") {
+		return rc, nil
+	}
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			rc.Close()
+			return nil, fmt.Errorf("the tarball %s contains no disk image", image)
+		}
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("cannot read the tarball: %v", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, rc}, nil
+		}
+	}
+}
+
+// writeSparse copies r into f, chunks containing only zeroes are skipped
+// so the file stays sparse
+func writeSparse(f *os.File, r io.Reader) error {
+	buf := make([]byte, sparseChunkSize)
+	zeroes := make([]byte, sparseChunkSize)
+	var size int64
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeroes[:n]) {
+				_, serr := f.Seek(int64(n), io.SeekCurrent)
+				if serr != nil {
+					return fmt.Errorf("cannot seek in the decompressed image: %v", serr)
+				}
+			} else {
+				_, werr := f.Write(buf[:n])
+				if werr != nil {
+					return fmt.Errorf("cannot write the decompressed image: %v", werr)
+				}
+			}
+			size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decompress the image: %v", err)
+		}
+	}
+
+	// a trailing hole isn't allocated by seeking, set the size explicitly
+	return f.Truncate(size)
+}
+
+// withDecompressedImage runs the function f with a path to an image
+// qemu can boot. Compressed images (.xz, .gz, .bz2, optionally containing
+// a .tar) are decompressed into a temporary file next to the image, which
+// is deleted after f returns. Other images are passed as they are.
+func withDecompressedImage(image string, f func(image string) error) error {
+	if !isCompressedImage(image) {
+		return f(image)
+	}
+
+	return withTempFile(path.Dir(image), "osbuild-image-tests-decompressed-", func(file *os.File) error {
+		defer file.Close()
+
+		compressed, err := os.Open(image)
+		if err != nil {
+			return fmt.Errorf("cannot open the compressed image: %v", err)
+		}
+		defer compressed.Close()
+
+		r, err := decompressedReader(image, compressed)
+		if err != nil {
+			return err
+		}
+
+		err = writeSparse(file, r)
+		cerr := r.Close()
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return fmt.Errorf("cannot decompress the image: %v", cerr)
+		}
+
+		return f(file.Name())
+	})
+}
@@ -0,0 +1,173 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// manifestRPMStages collects the org.osbuild.rpm stages of the pipeline and
+// of its build pipelines in a v1 manifest
+func manifestRPMStages(pipeline map[string]interface{}) []map[string]interface{} {
+	var stages []map[string]interface{}
+	if build, ok := pipeline["build"].(map[string]interface{}); ok {
+		if buildPipeline, ok := build["pipeline"].(map[string]interface{}); ok {
+			stages = append(stages, manifestRPMStages(buildPipeline)...)
+		}
+	}
+
+	list, _ := pipeline["stages"].([]interface{})
+	for _, item := range list {
+		stage, ok := item.(map[string]interface{})
+		if ok && stage["name"] == "org.osbuild.rpm" {
+			stages = append(stages, stage)
+		}
+	}
+
+	return stages
+}
+
+// packageChecksums returns the checksums of the packages listed in a v1 rpm
+// stage (options.packages) or a v2 rpm stage (inputs.packages.references),
+// the packages are either checksums or objects with a checksum
+func packageChecksums(stage map[string]interface{}) []string {
+	var packages interface{}
+	if options, ok := stage["options"].(map[string]interface{}); ok && options["packages"] != nil {
+		packages = options["packages"]
+	} else if inputs, ok := stage["inputs"].(map[string]interface{}); ok {
+		if input, ok := inputs["packages"].(map[string]interface{}); ok {
+			packages = input["references"]
+		}
+	}
+
+	var checksums []string
+	switch v := packages.(type) {
+	case []interface{}:
+		for _, item := range v {
+			switch p := item.(type) {
+			case string:
+				checksums = append(checksums, p)
+			case map[string]interface{}:
+				if checksum, ok := p["checksum"].(string); ok {
+					checksums = append(checksums, checksum)
+				}
+				if id, ok := p["id"].(string); ok {
+					checksums = append(checksums, id)
+				}
+			}
+		}
+	case map[string]interface{}:
+		for checksum := range v {
+			checksums = append(checksums, checksum)
+		}
+	}
+
+	return checksums
+}
+
+// sourceURLs returns the URLs of the sources by checksum, from
+// org.osbuild.files (v1) or org.osbuild.curl (v2). A URL is either a string
+// or an object with a url.
+func sourceURLs(sources map[string]interface{}) map[string]string {
+	urls := make(map[string]string)
+	for name, key := range map[string]string{"org.osbuild.files": "urls", "org.osbuild.curl": "items"} {
+		source, ok := sources[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		items, _ := source[key].(map[string]interface{})
+		for checksum, item := range items {
+			switch v := item.(type) {
+			case string:
+				urls[checksum] = v
+			case map[string]interface{}:
+				if u, ok := v["url"].(string); ok {
+					urls[checksum] = u
+				}
+			}
+		}
+	}
+
+	return urls
+}
+
+// manifestPackages returns the file names of the packages installed by the
+// manifest, sorted. It fails if a package has no source URL.
+func manifestPackages(manifest []byte) ([]string, error) {
+	var m struct {
+		Pipeline  map[string]interface{}   `json:"pipeline"`
+		Pipelines []map[string]interface{} `json:"pipelines"`
+		Sources   map[string]interface{}   `json:"sources"`
+	}
+	err := json.Unmarshal(manifest, &m)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the manifest: %v", err)
+	}
+
+	stages := manifestRPMStages(m.Pipeline)
+	for _, pipeline := range m.Pipelines {
+		list, _ := pipeline["stages"].([]interface{})
+		for _, item := range list {
+			stage, ok := item.(map[string]interface{})
+			if ok && stage["type"] == "org.osbuild.rpm" {
+				stages = append(stages, stage)
+			}
+		}
+	}
+
+	urls := sourceURLs(m.Sources)
+
+	var packages, missing []string
+	for _, stage := range stages {
+		for _, checksum := range packageChecksums(stage) {
+			u, exists := urls[checksum]
+			if !exists {
+				missing = append(missing, checksum)
+				continue
+			}
+			packages = append(packages, path.Base(u))
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("the manifest has no source for the packages:\n%s", strings.Join(missing, "\n"))
+	}
+
+	sort.Strings(packages)
+	return packages, nil
+}
+
+// testDepsolve checks the package sets of the testcase without building
+// it: the packages of the manifest must all have a source, and the package
+// sets of the compose request must depsolve against its repositories
+func testDepsolve(t *testing.T, testcase testcaseStruct, stores storePool) {
+	if testcase.Manifest != nil {
+		packages, err := manifestPackages(testcase.Manifest)
+		require.NoError(t, err)
+		t.Logf("the manifest installs %d packages", len(packages))
+	}
+
+	if testcase.RawComposeRequest == nil || testcase.ManifestCommand != nil {
+		t.Log("the testcase has no compose request to depsolve")
+		return
+	}
+
+	// the rpmmd cache lives in the store
+	var depsolved *depsolvedComposeRequest
+	err := stores.withStore(func(store string) error {
+		var err error
+		depsolved, err = depsolveComposeRequest(testcase.RawComposeRequest, extraRepos, path.Join(store, "rpmmd"))
+		return err
+	})
+	require.NoError(t, err, "the package sets do not depsolve")
+
+	t.Logf("the package sets depsolve to %d packages and %d build packages", len(depsolved.packageSpecs), len(depsolved.buildPackageSpecs))
+}
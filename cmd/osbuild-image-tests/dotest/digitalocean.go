@@ -0,0 +1,457 @@
+// +build integration
+
+package dotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/cloudtest"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+const (
+	apiURL = "https://api.digitalocean.com/v2"
+
+	defaultRegion = "ams3"
+	defaultSize   = "s-1vcpu-2gb"
+
+	// importURLExpiration is the lifetime of the presigned URL the image
+	// is imported from, the import starts long before it expires
+	importURLExpiration = 2 * time.Hour
+
+	// pollInterval is the delay between two checks of a resource status
+	pollInterval = 10 * time.Second
+	// waitTimeout is the maximal time to wait for a resource status
+	waitTimeout = 30 * time.Minute
+)
+
+type digitalOceanCredentials struct {
+	Token string
+	// SpacesKey and SpacesSecret are the credentials of the Spaces bucket
+	// the images are imported from
+	SpacesKey    string
+	SpacesSecret string
+	SpacesBucket string
+	// Region is used both for the bucket and for the droplets, e.g. ams3
+	Region string
+	// Size is the droplet size, e.g. s-1vcpu-2gb
+	Size string
+}
+
+// GetDigitalOceanCredentialsFromEnv gets the credentials from environment
+// variables. If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// DO_REGION and DO_SIZE are optional.
+func GetDigitalOceanCredentialsFromEnv() (*digitalOceanCredentials, error) {
+	token, tExists := os.LookupEnv("DO_API_TOKEN")
+	spacesKey, skExists := os.LookupEnv("DO_SPACES_KEY")
+	spacesSecret, ssExists := os.LookupEnv("DO_SPACES_SECRET")
+	spacesBucket, sbExists := os.LookupEnv("DO_SPACES_BUCKET")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !tExists && !skExists && !ssExists && !sbExists {
+		return nil, nil
+	}
+	// If only some of them are not set, then fail
+	if !tExists || !skExists || !ssExists || !sbExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	region, exists := os.LookupEnv("DO_REGION")
+	if !exists {
+		region = defaultRegion
+	}
+
+	size, exists := os.LookupEnv("DO_SIZE")
+	if !exists {
+		size = defaultSize
+	}
+
+	return &digitalOceanCredentials{
+		Token:        token,
+		SpacesKey:    spacesKey,
+		SpacesSecret: spacesSecret,
+		SpacesBucket: spacesBucket,
+		Region:       region,
+		Size:         size,
+	}, nil
+}
+
+// errNotFound is returned by request if the resource doesn't exist
+var errNotFound = errors.New("the resource was not found")
+
+// statusError is returned by request if the API responds with an error
+// status code
+type statusError struct {
+	method   string
+	resource string
+	status   string
+	code     int
+	message  []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s failed with %s: %s", e.method, e.resource, e.status, e.message)
+}
+
+// StatusCode returns the HTTP status code of the response
+func (e *statusError) StatusCode() int {
+	return e.code
+}
+
+// request calls the DigitalOcean API. The body is encoded as JSON if not
+// nil, the response is decoded into out if not nil.
+func request(c *digitalOceanCredentials, method, resource string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("cannot encode the request: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, apiURL+resource, reader)
+	if err != nil {
+		return fmt.Errorf("cannot create the request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cloudtest.Wrapf(err, "%s %s failed", method, resource)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{
+			method:   method,
+			resource: resource,
+			status:   resp.Status,
+			code:     resp.StatusCode,
+			message:  message,
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("cannot decode the response of %s %s: %v", method, resource, err)
+	}
+
+	return nil
+}
+
+// waitFor polls the check function until it returns true or an error
+func waitFor(what string, check func() (bool, error)) error {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't happen in %v", what, waitTimeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// newSpacesClient returns an S3 client of the Spaces endpoint in the region
+func newSpacesClient(c *digitalOceanCredentials) (*s3.S3, *s3manager.Uploader, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(c.SpacesKey, c.SpacesSecret, ""),
+		Endpoint:    aws.String(fmt.Sprintf("https://%s.digitaloceanspaces.com", c.Region)),
+		// the region is ignored by Spaces but required by the SDK
+		Region: aws.String("us-east-1"),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create the spaces session: %v", err)
+	}
+
+	return s3.New(sess), s3manager.NewUploader(sess), nil
+}
+
+// objectKey returns the key of the uploaded image in the bucket, the
+// extension tells DigitalOcean the image format
+func objectKey(imagePath, imageName string) string {
+	return imageName + path.Ext(imagePath)
+}
+
+// UploadImageToDigitalOcean uploads the image to the Spaces bucket and
+// imports it as a custom image from a presigned URL. It returns the id
+// of the imported image.
+func UploadImageToDigitalOcean(c *digitalOceanCredentials, imagePath, imageName string) (int, error) {
+	client, uploader, err := newSpacesClient(c)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open the image: %v", err)
+	}
+	defer file.Close()
+
+	key := objectKey(imagePath, imageName)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(c.SpacesBucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+	if err != nil {
+		return 0, cloudtest.Wrapf(err, "upload to spaces failed")
+	}
+
+	getRequest, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(c.SpacesBucket),
+		Key:    aws.String(key),
+	})
+	url, err := getRequest.Presign(importURLExpiration)
+	if err != nil {
+		return 0, fmt.Errorf("cannot presign the image url: %v", err)
+	}
+
+	var created struct {
+		Image struct {
+			ID int `json:"id"`
+		} `json:"image"`
+	}
+	err = request(c, http.MethodPost, "/images", map[string]interface{}{
+		"name":         imageName,
+		"url":          url,
+		"region":       c.Region,
+		"distribution": "Unknown OS",
+		"tags":         []string{"osbuild-image-tests"},
+	}, &created)
+	if err != nil {
+		return 0, cloudtest.Wrapf(err, "cannot import the image")
+	}
+
+	imageID := created.Image.ID
+	err = waitFor("the image import", func() (bool, error) {
+		var image struct {
+			Image struct {
+				Status       string `json:"status"`
+				ErrorMessage string `json:"error_message"`
+			} `json:"image"`
+		}
+		err := request(c, http.MethodGet, fmt.Sprintf("/images/%d", imageID), nil, &image)
+		if err != nil {
+			return false, err
+		}
+		if image.Image.ErrorMessage != "" {
+			return false, fmt.Errorf("the image import failed: %s", image.Image.ErrorMessage)
+		}
+
+		return image.Image.Status == "available", nil
+	})
+	if err != nil {
+		return imageID, err
+	}
+
+	return imageID, nil
+}
+
+// DeleteImageFromDigitalOcean deletes the custom image and the uploaded
+// object (created by UploadImageToDigitalOcean method).
+func DeleteImageFromDigitalOcean(c *digitalOceanCredentials, imagePath, imageName string, imageID int) error {
+	var retErr error
+
+	if imageID != 0 {
+		err := request(c, http.MethodDelete, fmt.Sprintf("/images/%d", imageID), nil, nil)
+		if err != nil && err != errNotFound {
+			retErr = wrapErrorf(retErr, "cannot delete the image %d: %v", imageID, err)
+		}
+	}
+
+	client, _, err := newSpacesClient(c)
+	if err != nil {
+		return wrapErrorf(retErr, "cannot delete the uploaded image: %v", err)
+	}
+
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(c.SpacesBucket),
+		Key:    aws.String(objectKey(imagePath, imageName)),
+	})
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the uploaded image: %v", err)
+	}
+
+	return retErr
+}
+
+// droplet is the part of the droplet resource used by the tests
+type droplet struct {
+	ID       int    `json:"id"`
+	Status   string `json:"status"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+}
+
+// address returns the public or the private IPv4 address of the droplet
+func (d droplet) address(private bool) string {
+	addressType := "public"
+	if private {
+		addressType = "private"
+	}
+
+	for _, network := range d.Networks.V4 {
+		if network.Type == addressType {
+			return network.IPAddress
+		}
+	}
+
+	return ""
+}
+
+// WithBootedImageInDigitalOcean runs the function f in the context of booted
+// image in DigitalOcean. The public key is registered in the account and
+// added to the droplet metadata, the user data are passed to cloud-init.
+// The droplet is reachable using its public address, or using its private
+// address if privateAddress is true. If keep returns true after f, the
+// droplet and the key are left in place.
+func WithBootedImageInDigitalOcean(c *digitalOceanCredentials, imageID int, testId, publicKeyFile, userData string, privateAddress bool, keep func() bool, f func(address string) error) (retErr error) {
+	publicKey, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the public key file: %v", err)
+	}
+
+	keyName := "key-" + testId
+	dropletName := "vm-" + testId
+
+	var key struct {
+		SSHKey struct {
+			ID int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err = request(c, http.MethodPost, "/account/keys", map[string]string{
+		"name":       keyName,
+		"public_key": strings.TrimSpace(string(publicKey)),
+	}, &key)
+	if err != nil {
+		return fmt.Errorf("cannot create the ssh key: %v", err)
+	}
+
+	defer func() {
+		if keep() {
+			log.Printf("keeping the ssh key %s", keyName)
+			return
+		}
+
+		err := request(c, http.MethodDelete, fmt.Sprintf("/account/keys/%d", key.SSHKey.ID), nil, nil)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the ssh key %s: %v", keyName, err)
+		}
+	}()
+
+	var created struct {
+		Droplet droplet `json:"droplet"`
+	}
+	err = request(c, http.MethodPost, "/droplets", map[string]interface{}{
+		"name":      dropletName,
+		"region":    c.Region,
+		"size":      c.Size,
+		"image":     imageID,
+		"ssh_keys":  []int{key.SSHKey.ID},
+		"user_data": userData,
+		"tags":      []string{"osbuild-image-tests"},
+	}, &created)
+	if err != nil {
+		return fmt.Errorf("creating a droplet failed: %v", err)
+	}
+
+	dropletPath := fmt.Sprintf("/droplets/%d", created.Droplet.ID)
+
+	// The droplet must be gone before the image can be deleted.
+	defer func() {
+		if keep() {
+			log.Printf("keeping the droplet %s in the region %s running", dropletName, c.Region)
+			return
+		}
+
+		err := request(c, http.MethodDelete, dropletPath, nil, nil)
+		if err != nil {
+			log.Printf("deleting the droplet %s errored: %v", dropletName, err)
+			retErr = wrapErrorf(retErr, "cannot delete the droplet %s: %v", dropletName, err)
+			return
+		}
+
+		err = waitFor("the droplet deletion", func() (bool, error) {
+			err := request(c, http.MethodGet, dropletPath, nil, nil)
+			if err == errNotFound {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			retErr = wrapErrorf(retErr, "waiting for the droplet deletion failed: %v", err)
+		}
+	}()
+
+	var current struct {
+		Droplet droplet `json:"droplet"`
+	}
+	err = waitFor("the droplet start", func() (bool, error) {
+		err := request(c, http.MethodGet, dropletPath, nil, &current)
+		if err != nil {
+			return false, err
+		}
+
+		return current.Droplet.Status == "active", nil
+	})
+	if err != nil {
+		return fmt.Errorf("the droplet didn't start: %v", err)
+	}
+
+	address := current.Droplet.address(privateAddress)
+	if address == "" {
+		return fmt.Errorf("the droplet %s has no address", dropletName)
+	}
+
+	return f(address)
+}
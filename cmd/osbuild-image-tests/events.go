@@ -0,0 +1,134 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the kinds of the progress events
+const (
+	eventCaseStarted = "case_started"
+	eventBuildDone   = "build_done"
+	eventBootStarted = "boot_started"
+	eventCaseResult  = "case_result"
+)
+
+// progressEvent is a line of the -events-output stream
+type progressEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Case is the name of the test case run, see repeatedCaseName
+	Case     string `json:"case"`
+	Distro   string `json:"distro"`
+	Arch     string `json:"arch"`
+	Filename string `json:"filename"`
+	// BootType is set in boot_started
+	BootType string `json:"boot-type,omitempty"`
+	// Result and Message are set in case_result
+	Result  string `json:"result,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Duration is the duration of the build in build_done and of the whole
+	// test case in case_result, in seconds
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// progressEvents is the destination of the events, events are dropped if
+// it's nil
+var progressEvents struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+	failed  bool
+}
+
+// openEventsOutput opens the -events-output destination: "-" is the
+// standard output, fd:N is the already open file descriptor N and anything
+// else is a file, truncated if it exists
+func openEventsOutput(destination string) error {
+	var w io.WriteCloser
+	switch {
+	case destination == "-":
+		w = os.Stdout
+	case strings.HasPrefix(destination, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(destination, "fd:"))
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid file descriptor in %s", destination)
+		}
+		w = os.NewFile(uintptr(fd), destination)
+	default:
+		f, err := os.Create(destination)
+		if err != nil {
+			return fmt.Errorf("cannot create the events output: %v", err)
+		}
+		w = f
+	}
+
+	progressEvents.mutex.Lock()
+	defer progressEvents.mutex.Unlock()
+
+	progressEvents.encoder = json.NewEncoder(w)
+	if w != os.Stdout {
+		progressEvents.closer = w
+	}
+
+	return nil
+}
+
+// closeEventsOutput closes the -events-output destination, the standard
+// output is left open
+func closeEventsOutput() error {
+	progressEvents.mutex.Lock()
+	defer progressEvents.mutex.Unlock()
+
+	progressEvents.encoder = nil
+	if progressEvents.closer == nil {
+		return nil
+	}
+
+	err := progressEvents.closer.Close()
+	progressEvents.closer = nil
+	if err != nil {
+		return fmt.Errorf("cannot close the events output: %v", err)
+	}
+
+	return nil
+}
+
+// newCaseEvent returns the event of the test case run by t
+func newCaseEvent(t *testing.T, kind string, testcase testcaseStruct) progressEvent {
+	return progressEvent{
+		Event:    kind,
+		Time:     time.Now().UTC(),
+		Case:     path.Base(t.Name()),
+		Distro:   testcase.ComposeRequest.Distro,
+		Arch:     testcase.ComposeRequest.Arch,
+		Filename: testcase.ComposeRequest.Filename,
+	}
+}
+
+// emitEvent writes the event as a line of JSON if -events-output is given.
+// A failing destination is reported once, the tests go on without it.
+func emitEvent(event progressEvent) {
+	progressEvents.mutex.Lock()
+	defer progressEvents.mutex.Unlock()
+
+	if progressEvents.encoder == nil || progressEvents.failed {
+		return
+	}
+
+	err := progressEvents.encoder.Encode(event)
+	if err != nil {
+		harnessLog.Warningf("cannot write to the events output, no more events are written: %v", err)
+		progressEvents.failed = true
+	}
+}
@@ -0,0 +1,212 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/constants"
+	"github.com/osbuild/osbuild-composer/internal/blueprint"
+	"github.com/osbuild/osbuild-composer/internal/distro"
+	"github.com/osbuild/osbuild-composer/internal/distro/fedora31"
+	"github.com/osbuild/osbuild-composer/internal/distro/fedora32"
+	"github.com/osbuild/osbuild-composer/internal/distro/rhel8"
+	"github.com/osbuild/osbuild-composer/internal/rpmmd"
+)
+
+// extraRepo is a repository injected into every manifest
+type extraRepo struct {
+	BaseURL string
+	// GPGKey is the armored key, packages are not checked if empty
+	GPGKey string
+}
+
+// extraReposFlag implements flag.Value for the repeatable -extra-repo flag.
+// The value is BASEURL or BASEURL,gpgkey=PATH.
+type extraReposFlag []extraRepo
+
+func (f *extraReposFlag) String() string {
+	var urls []string
+	for _, repo := range *f {
+		urls = append(urls, repo.BaseURL)
+	}
+	return strings.Join(urls, " ")
+}
+
+func (f *extraReposFlag) Set(value string) error {
+	parts := strings.SplitN(value, ",", 2)
+	repo := extraRepo{BaseURL: parts[0]}
+
+	if len(parts) == 2 {
+		if !strings.HasPrefix(parts[1], "gpgkey=") {
+			return fmt.Errorf("unknown extra repo option %s", parts[1])
+		}
+
+		key, err := ioutil.ReadFile(strings.TrimPrefix(parts[1], "gpgkey="))
+		if err != nil {
+			return fmt.Errorf("cannot read the gpg key: %v", err)
+		}
+		repo.GPGKey = string(key)
+	}
+
+	*f = append(*f, repo)
+	return nil
+}
+
+// checkRepoReachable verifies that the repository metadata can be fetched
+func checkRepoReachable(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository url %s: %v", baseURL, err)
+	}
+
+	if u.Scheme == "file" {
+		_, err := os.Stat(path.Join(u.Path, "repodata/repomd.xml"))
+		if err != nil {
+			return fmt.Errorf("repository %s is not reachable: %v", baseURL, err)
+		}
+		return nil
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(baseURL, "/") + "/repodata/repomd.xml")
+	if err != nil {
+		return fmt.Errorf("repository %s is not reachable: %v", baseURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("repository %s is not reachable: %s", baseURL, resp.Status)
+	}
+
+	return nil
+}
+
+// composeRequest is the complete compose request of a testcase, the same
+// struct is used by osbuild-pipeline to generate the manifests
+type composeRequest struct {
+	Distro       string              `json:"distro"`
+	Arch         string              `json:"arch"`
+	ImageType    string              `json:"image-type"`
+	Blueprint    blueprint.Blueprint `json:"blueprint"`
+	Repositories []struct {
+		BaseURL    string `json:"baseurl,omitempty"`
+		Metalink   string `json:"metalink,omitempty"`
+		MirrorList string `json:"mirrorlist,omitempty"`
+		GPGKey     string `json:"gpgkey,omitempty"`
+		CheckGPG   bool   `json:"check_gpg,omitempty"`
+	} `json:"repositories"`
+}
+
+// depsolvedComposeRequest is a compose request with its package sets
+// depsolved
+type depsolvedComposeRequest struct {
+	request           composeRequest
+	imageType         distro.ImageType
+	repos             []rpmmd.RepoConfig
+	packageSpecs      []rpmmd.PackageSpec
+	buildPackageSpecs []rpmmd.PackageSpec
+}
+
+// depsolveComposeRequest depsolves the package sets of the compose request
+// the same way osbuild-pipeline does, with the extra repositories added
+func depsolveComposeRequest(rawComposeRequest json.RawMessage, extraRepos []extraRepo, cacheDir string) (*depsolvedComposeRequest, error) {
+	var cr composeRequest
+	err := json.Unmarshal(rawComposeRequest, &cr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the compose request: %v", err)
+	}
+
+	distros, err := distro.NewRegistry(fedora31.New(), fedora32.New(), rhel8.New())
+	if err != nil {
+		return nil, err
+	}
+
+	d := distros.GetDistro(cr.Distro)
+	if d == nil {
+		return nil, fmt.Errorf("unknown distro %s", cr.Distro)
+	}
+
+	arch, err := d.GetArch(cr.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	imageType, err := arch.GetImageType(cr.ImageType)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []rpmmd.RepoConfig
+	for i, repo := range cr.Repositories {
+		repos = append(repos, rpmmd.RepoConfig{
+			Name:       fmt.Sprintf("repo-%d", i),
+			BaseURL:    repo.BaseURL,
+			Metalink:   repo.Metalink,
+			MirrorList: repo.MirrorList,
+			GPGKey:     repo.GPGKey,
+			CheckGPG:   repo.CheckGPG,
+		})
+	}
+	for i, repo := range extraRepos {
+		repos = append(repos, rpmmd.RepoConfig{
+			Name:     fmt.Sprintf("extra-repo-%d", i),
+			BaseURL:  repo.BaseURL,
+			GPGKey:   repo.GPGKey,
+			CheckGPG: repo.GPGKey != "",
+		})
+	}
+
+	rpm := rpmmd.NewRPMMD(cacheDir, constants.TestPaths.DNFJson)
+
+	packages, excludePackages := imageType.Packages(cr.Blueprint)
+	packageSpecs, _, err := rpm.Depsolve(packages, excludePackages, repos, d.ModulePlatformID(), arch.Name())
+	if err != nil {
+		return nil, fmt.Errorf("cannot depsolve the packages: %v", err)
+	}
+
+	buildPackageSpecs, _, err := rpm.Depsolve(imageType.BuildPackages(), nil, repos, d.ModulePlatformID(), arch.Name())
+	if err != nil {
+		return nil, fmt.Errorf("cannot depsolve the build packages: %v", err)
+	}
+
+	return &depsolvedComposeRequest{
+		request:           cr,
+		imageType:         imageType,
+		repos:             repos,
+		packageSpecs:      packageSpecs,
+		buildPackageSpecs: buildPackageSpecs,
+	}, nil
+}
+
+// manifestWithExtraRepos generates the manifest for the compose request
+// the same way osbuild-pipeline does, but with the extra repositories added.
+// The package sets are depsolved again, so packages from the extra
+// repositories replace the older ones.
+func manifestWithExtraRepos(rawComposeRequest json.RawMessage, extraRepos []extraRepo, cacheDir string) ([]byte, error) {
+	depsolved, err := depsolveComposeRequest(rawComposeRequest, extraRepos, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := depsolved.imageType.Manifest(
+		depsolved.request.Blueprint.Customizations,
+		distro.ImageOptions{
+			Size: depsolved.imageType.Size(0),
+		},
+		depsolved.repos,
+		depsolved.packageSpecs,
+		depsolved.buildPackageSpecs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the manifest: %v", err)
+	}
+
+	return json.Marshal(manifest)
+}
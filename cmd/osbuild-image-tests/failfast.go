@@ -0,0 +1,25 @@
+// +build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// earlierFailureMessage is the reason of the testcases skipped by -fail-fast
+const earlierFailureMessage = "skipped due to an earlier failure (-fail-fast)"
+
+// errAborted is returned by the operations stopped because the run was
+// aborted
+var errAborted = errors.New("aborted due to an earlier failure")
+
+// abortedRun is cancelled by abortRun when a testcase fails and -fail-fast
+// is given. The running testcases stop their builds and ssh attempts and
+// the remaining ones are skipped.
+var abortedRun, abortRun = context.WithCancel(context.Background())
+
+// runAborted reports whether a testcase failed and -fail-fast is given
+func runAborted() bool {
+	return abortedRun.Err() != nil
+}
@@ -0,0 +1,96 @@
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// canonicalJSON marshals the value indented by two spaces with object keys
+// sorted. Every line but the first one is prefixed by prefix.
+func canonicalJSON(value interface{}, prefix string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent(prefix, "  ")
+
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// replaceTopLevelValue replaces the value of the top-level key in the JSON
+// document. The rest of the document is kept byte-for-byte intact, so the
+// field order and formatting of the testcase files are preserved.
+func replaceTopLevelValue(document []byte, key string, value []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("the document is not a JSON object")
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start := decoder.InputOffset()
+
+		var raw json.RawMessage
+		err = decoder.Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if token == key {
+			end := decoder.InputOffset()
+
+			var result bytes.Buffer
+			result.Write(document[:start])
+			result.WriteString(": ")
+			result.Write(value)
+			result.Write(document[end:])
+			return result.Bytes(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("the document has no %s key", key)
+}
+
+// updateImageInfoFixture writes the image info into the testcase file,
+// replacing the expected one
+func updateImageInfoFixture(testcasePath string, imageInfo interface{}) error {
+	document, err := ioutil.ReadFile(testcasePath)
+	if err != nil {
+		return fmt.Errorf("cannot read the test case: %v", err)
+	}
+
+	// the image-info key is nested one level deep, therefore the prefix
+	value, err := canonicalJSON(imageInfo, "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal the image info: %v", err)
+	}
+
+	document, err = replaceTopLevelValue(document, "image-info", value)
+	if err != nil {
+		return fmt.Errorf("cannot update the test case: %v", err)
+	}
+
+	err = ioutil.WriteFile(testcasePath, document, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write the test case: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+// +build integration
+
+package gcptest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+const (
+	defaultZone        = "us-central1-a"
+	defaultMachineType = "n1-standard-1"
+)
+
+type gcpCredentials struct {
+	// CredentialsFile is the service account key in the JSON format
+	CredentialsFile string
+	Project         string
+	Bucket          string
+	Zone            string
+	MachineType     string
+}
+
+// GetGCPCredentialsFromEnv gets the credentials from environment variables
+// If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// GCP_ZONE and GCP_MACHINE_TYPE are optional.
+func GetGCPCredentialsFromEnv() (*gcpCredentials, error) {
+	credentialsFile, cfExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	project, pExists := os.LookupEnv("GCP_PROJECT")
+	bucket, bExists := os.LookupEnv("GCP_BUCKET")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !cfExists && !pExists && !bExists {
+		return nil, nil
+	}
+	// If only one/two of them are not set, then fail
+	if !cfExists || !pExists || !bExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	zone, exists := os.LookupEnv("GCP_ZONE")
+	if !exists {
+		zone = defaultZone
+	}
+
+	machineType, exists := os.LookupEnv("GCP_MACHINE_TYPE")
+	if !exists {
+		machineType = defaultMachineType
+	}
+
+	return &gcpCredentials{
+		CredentialsFile: credentialsFile,
+		Project:         project,
+		Bucket:          bucket,
+		Zone:            zone,
+		MachineType:     machineType,
+	}, nil
+}
+
+// runGcloud runs gcloud authenticated using the credentials and returns
+// its standard output
+func runGcloud(c *gcpCredentials, args ...string) (string, error) {
+	cmd := exec.Command("gcloud", append(args, "--quiet")...)
+	cmd.Env = append(os.Environ(),
+		"CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE="+c.CredentialsFile,
+		"CLOUDSDK_CORE_PROJECT="+c.Project,
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gcloud %s failed: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// objectURI returns the URI of the uploaded image archive in the bucket
+func objectURI(c *gcpCredentials, imageName string) string {
+	return fmt.Sprintf("gs://%s/%s.tar.gz", c.Bucket, imageName)
+}
+
+// UploadImageToGCP uploads the image to the bucket and creates a GCE image
+// from it. GCE requires raw images packed as disk.raw in a tar.gz archive,
+// raw images are packed automatically.
+func UploadImageToGCP(c *gcpCredentials, imagePath string, imageName string) error {
+	archive := imagePath
+	if !strings.HasSuffix(imagePath, ".tar.gz") {
+		dir, err := ioutil.TempDir("", "gcp-image-")
+		if err != nil {
+			return fmt.Errorf("cannot create a temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		archive = path.Join(dir, "image.tar.gz")
+		cmd := exec.Command(
+			"tar", "-Sczf", archive,
+			"-C", path.Dir(imagePath),
+			"--transform", "s|.*|disk.raw|",
+			path.Base(imagePath),
+		)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("cannot pack the image: %v", err)
+		}
+	}
+
+	_, err := runGcloud(c, "storage", "cp", archive, objectURI(c, imageName))
+	if err != nil {
+		return fmt.Errorf("upload to gcp failed: %v", err)
+	}
+
+	_, err = runGcloud(c, "compute", "images", "create", imageName, "--source-uri", objectURI(c, imageName))
+	if err != nil {
+		return fmt.Errorf("cannot create the gce image: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteImageFromGCP deletes the GCE image and the uploaded archive
+// (created by UploadImageToGCP method).
+func DeleteImageFromGCP(c *gcpCredentials, imageName string) error {
+	var retErr error
+
+	_, err := runGcloud(c, "compute", "images", "delete", imageName)
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the gce image: %v", err)
+	}
+
+	_, err = runGcloud(c, "storage", "rm", objectURI(c, imageName))
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the uploaded image: %v", err)
+	}
+
+	return retErr
+}
+
+// WithBootedImageInGCP runs the function f in the context of booted
+// image in GCP. The extra public keys are authorized for the user besides
+// the given one. If privateAddress is true, the instance gets no external
+// address and f gets the internal one. If keep returns true after f,
+// the instance is left running.
+func WithBootedImageInGCP(c *gcpCredentials, imageName, testId, publicKeyFile, user string, extraKeys []string, privateAddress bool, keep func() bool, f func(address string) error) (retErr error) {
+	publicKey, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the public key file: %v", err)
+	}
+
+	// the keys are passed in the instance metadata as user:key lines
+	metadata, err := ioutil.TempFile("", "gcp-ssh-keys-")
+	if err != nil {
+		return fmt.Errorf("cannot create the metadata file: %v", err)
+	}
+	defer os.Remove(metadata.Name())
+
+	keys := user + ":" + strings.TrimSpace(string(publicKey)) + "\n"
+	for _, key := range extraKeys {
+		keys += user + ":" + key + "\n"
+	}
+	_, err = metadata.WriteString(keys)
+	metadata.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write the metadata file: %v", err)
+	}
+
+	instanceName := "vm-" + testId
+
+	createArgs := []string{"compute", "instances", "create", instanceName,
+		"--zone", c.Zone,
+		"--machine-type", c.MachineType,
+		"--image", imageName,
+		"--metadata-from-file", "ssh-keys=" + metadata.Name(),
+	}
+	if privateAddress {
+		createArgs = append(createArgs, "--no-address")
+	}
+	_, err = runGcloud(c, createArgs...)
+
+	// Let's register the clean-up function as soon as possible, the instance
+	// might exist even if the creation failed
+	defer func() {
+		if keep() {
+			log.Printf("keeping the instance %s in the zone %s running", instanceName, c.Zone)
+			return
+		}
+
+		_, err := runGcloud(c, "compute", "instances", "delete", instanceName, "--zone", c.Zone)
+		if err != nil {
+			log.Printf("deleting the instance %s errored: %v", instanceName, err)
+			retErr = wrapErrorf(retErr, "cannot delete the instance %s: %v", instanceName, err)
+		}
+	}()
+
+	if err != nil {
+		return fmt.Errorf("creating an instance failed: %v", err)
+	}
+
+	addressField := "networkInterfaces[0].accessConfigs[0].natIP"
+	if privateAddress {
+		addressField = "networkInterfaces[0].networkIP"
+	}
+
+	address, err := runGcloud(c, "compute", "instances", "describe", instanceName,
+		"--zone", c.Zone,
+		"--format", "get("+addressField+")",
+	)
+	if err != nil {
+		return fmt.Errorf("cannot get the ip address of the instance: %v", err)
+	}
+
+	return f(address)
+}
@@ -0,0 +1,1324 @@
+// +build integration
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// guestCommandRunner runs a shell command inside the booted guest and returns
+// its standard output
+type guestCommandRunner func(command string) (string, error)
+
+// checkSkippedError is returned by a check that cannot be run in the guest,
+// e.g. because a required tool is not installed
+type checkSkippedError struct {
+	reason string
+}
+
+func (e *checkSkippedError) Error() string { return e.reason }
+
+// mountOptionsExpectation lists mount options that must be, and must not be,
+// set on a mountpoint
+type mountOptionsExpectation struct {
+	Required  []string
+	Forbidden []string
+}
+
+// parseMountTable parses a whitespace-separated table (findmnt output or
+// fstab) into a map from a mountpoint to its set of options. Comments and
+// lines with too few fields are ignored.
+func parseMountTable(table string, mountpointField, optionsField int) map[string]map[string]bool {
+	result := make(map[string]map[string]bool)
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) <= mountpointField || len(fields) <= optionsField || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		options := make(map[string]bool)
+		for _, option := range strings.Split(fields[optionsField], ",") {
+			options[option] = true
+		}
+		result[fields[mountpointField]] = options
+	}
+
+	return result
+}
+
+// compareMountOptions checks the mount options of every expected mountpoint
+// and returns a list of human-readable discrepancies. Mountpoints missing
+// in the table are reported only when required is true.
+func compareMountOptions(source string, table map[string]map[string]bool, expected map[string]mountOptionsExpectation, required bool) []string {
+	var problems []string
+	for mountpoint, expectation := range expected {
+		options, exists := table[mountpoint]
+		if !exists {
+			if required {
+				problems = append(problems, fmt.Sprintf("%s: %s is not mounted", source, mountpoint))
+			}
+			continue
+		}
+
+		for _, option := range expectation.Required {
+			if !options[option] {
+				problems = append(problems, fmt.Sprintf("%s: %s is missing required option %s", source, mountpoint, option))
+			}
+		}
+
+		for _, option := range expectation.Forbidden {
+			if options[option] {
+				problems = append(problems, fmt.Sprintf("%s: %s has forbidden option %s", source, mountpoint, option))
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkMountOptions verifies the mount options of the running system using
+// findmnt and cross-checks them with /etc/fstab. Mountpoints which are not
+// listed in fstab (e.g. tmpfs mounted by systemd) are checked only at runtime.
+func checkMountOptions(run guestCommandRunner, expected map[string]mountOptionsExpectation) error {
+	findmnt, err := run("findmnt --list --noheadings -o TARGET,OPTIONS")
+	if err != nil {
+		return fmt.Errorf("cannot list the mounted filesystems: %v", err)
+	}
+
+	fstab, err := run("cat /etc/fstab")
+	if err != nil {
+		return fmt.Errorf("cannot read /etc/fstab: %v", err)
+	}
+
+	problems := compareMountOptions("findmnt", parseMountTable(findmnt, 0, 1), expected, true)
+	problems = append(problems, compareMountOptions("fstab", parseMountTable(fstab, 1, 3), expected, false)...)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected mount options:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// parseCPUFlags returns the set of CPU flags from the content of /proc/cpuinfo.
+// Both the x86 "flags" and the aarch64 "Features" lines are recognized.
+func parseCPUFlags(cpuinfo string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if key != "flags" && key != "Features" {
+			continue
+		}
+
+		for _, flag := range strings.Fields(parts[1]) {
+			flags[flag] = true
+		}
+	}
+
+	return flags
+}
+
+// missingCPUFlags returns the expected flags not present in the cpuinfo
+func missingCPUFlags(cpuinfo string, expected []string) []string {
+	flags := parseCPUFlags(cpuinfo)
+
+	var missing []string
+	for _, flag := range expected {
+		if !flags[flag] {
+			missing = append(missing, flag)
+		}
+	}
+
+	return missing
+}
+
+// checkCPUFlags verifies that all the expected CPU flags are visible
+// in /proc/cpuinfo of the guest
+func checkCPUFlags(run guestCommandRunner, expected []string) error {
+	cpuinfo, err := run("cat /proc/cpuinfo")
+	if err != nil {
+		return fmt.Errorf("cannot read /proc/cpuinfo: %v", err)
+	}
+
+	missing := missingCPUFlags(cpuinfo, expected)
+	if len(missing) > 0 {
+		return fmt.Errorf("the guest is missing CPU flags: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// firewallExpectation describes the default firewall configuration
+type firewallExpectation struct {
+	// Backend is one of firewalld, nftables or none
+	Backend string
+	// Services must be allowed by firewalld
+	Services []string
+	// Ports must be allowed, in the port/protocol format, e.g. 22/tcp
+	Ports []string
+}
+
+// detectFirewallBackend returns firewalld if the firewalld service is active,
+// nftables if there's a non-empty nftables ruleset and none otherwise.
+// The nftables ruleset is returned too.
+func detectFirewallBackend(run guestCommandRunner) (string, string, error) {
+	active, err := run("systemctl is-active firewalld || true")
+	if err != nil {
+		return "", "", fmt.Errorf("cannot get the firewalld state: %v", err)
+	}
+
+	// nft might not be installed at all, that means no nftables ruleset
+	ruleset, err := run("if command -v nft >/dev/null; then sudo nft list ruleset; fi")
+	if err != nil {
+		return "", "", fmt.Errorf("cannot list the nftables ruleset: %v", err)
+	}
+
+	if strings.TrimSpace(active) == "active" {
+		return "firewalld", ruleset, nil
+	}
+
+	if strings.TrimSpace(ruleset) != "" {
+		return "nftables", ruleset, nil
+	}
+
+	return "none", ruleset, nil
+}
+
+// nftablesAllowsPort does a best-effort search for an nftables rule
+// matching the destination port, both a single port and an anonymous set
+// are recognized
+func nftablesAllowsPort(ruleset, port, protocol string) bool {
+	protocol = regexp.QuoteMeta(protocol)
+	single := regexp.MustCompile(protocol + ` dport ` + regexp.QuoteMeta(port) + `\b`)
+	set := regexp.MustCompile(protocol + ` dport \{[^}]*\b` + regexp.QuoteMeta(port) + `\b[^}]*\}`)
+
+	return single.MatchString(ruleset) || set.MatchString(ruleset)
+}
+
+// checkFirewall verifies the firewall backend and that the expected services
+// and ports are allowed. The actual configuration is part of the error.
+func checkFirewall(run guestCommandRunner, expected *firewallExpectation) error {
+	backend, ruleset, err := detectFirewallBackend(run)
+	if err != nil {
+		return err
+	}
+
+	if backend != expected.Backend {
+		return fmt.Errorf("expected firewall backend %s, got %s, the nftables ruleset is:\n%s", expected.Backend, backend, ruleset)
+	}
+
+	var problems []string
+	var actual string
+
+	switch backend {
+	case "firewalld":
+		services, err := run("sudo firewall-cmd --list-services")
+		if err != nil {
+			return fmt.Errorf("cannot list firewalld services: %v", err)
+		}
+
+		ports, err := run("sudo firewall-cmd --list-ports")
+		if err != nil {
+			return fmt.Errorf("cannot list firewalld ports: %v", err)
+		}
+
+		actual = fmt.Sprintf("services: %s\nports: %s", strings.TrimSpace(services), strings.TrimSpace(ports))
+		problems = append(problems, missingWords(services, expected.Services, "service")...)
+		problems = append(problems, missingWords(ports, expected.Ports, "port")...)
+
+	case "nftables":
+		actual = ruleset
+		if len(expected.Services) > 0 {
+			problems = append(problems, "services can be checked only with firewalld")
+		}
+
+		for _, port := range expected.Ports {
+			parts := strings.SplitN(port, "/", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid port %s, expected port/protocol", port)
+			}
+
+			if !nftablesAllowsPort(ruleset, parts[0], parts[1]) {
+				problems = append(problems, fmt.Sprintf("port %s is not allowed", port))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected firewall configuration:\n%s\n\nactual configuration:\n%s", strings.Join(problems, "\n"), actual)
+	}
+
+	return nil
+}
+
+// missingWords returns a problem description for every expected word which
+// is not present in the whitespace-separated list
+func missingWords(list string, expected []string, kind string) []string {
+	present := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		present[word] = true
+	}
+
+	var problems []string
+	for _, word := range expected {
+		if !present[word] {
+			problems = append(problems, fmt.Sprintf("%s %s is not allowed", kind, word))
+		}
+	}
+
+	return problems
+}
+
+// sysctlExpectation maps sysctl keys to their expected values
+type sysctlExpectation struct {
+	Values map[string]string
+	// CheckConfig also requires the values to be set in /etc/sysctl.conf
+	// or /etc/sysctl.d, so they don't come only from kernel defaults
+	CheckConfig bool `json:"check-config"`
+}
+
+// normalizeSysctlValue collapses whitespace, multi-value sysctls are printed
+// separated by tabs
+func normalizeSysctlValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// parseSysctlConfig parses the key = value lines of sysctl configuration
+// files. Later assignments override earlier ones.
+func parseSysctlConfig(config string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		// keys can use slashes instead of dots as separators
+		key := strings.Replace(strings.TrimSpace(parts[0]), "/", ".", -1)
+		values[strings.TrimPrefix(key, "-")] = normalizeSysctlValue(parts[1])
+	}
+
+	return values
+}
+
+// checkSysctl verifies the runtime values of sysctls and optionally
+// their configuration
+func checkSysctl(run guestCommandRunner, expected *sysctlExpectation) error {
+	var config map[string]string
+	if expected.CheckConfig {
+		raw, err := run("cat /usr/lib/sysctl.d/*.conf /run/sysctl.d/*.conf /etc/sysctl.d/*.conf /etc/sysctl.conf 2>/dev/null || true")
+		if err != nil {
+			return fmt.Errorf("cannot read the sysctl configuration: %v", err)
+		}
+		config = parseSysctlConfig(raw)
+	}
+
+	var problems []string
+	for key, value := range expected.Values {
+		value = normalizeSysctlValue(value)
+
+		actual, err := run("sysctl -n " + key)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: cannot read: %v", key, err))
+			continue
+		}
+
+		actual = normalizeSysctlValue(actual)
+		if actual != value {
+			problems = append(problems, fmt.Sprintf("%s: expected %q, got %q", key, value, actual))
+		}
+
+		if config != nil {
+			configured, exists := config[key]
+			if !exists {
+				problems = append(problems, fmt.Sprintf("%s: not set in the sysctl configuration", key))
+			} else if configured != value {
+				problems = append(problems, fmt.Sprintf("%s: expected %q, configured %q", key, value, configured))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected sysctl values:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// fileExpectation describes the expected content of a file in the image.
+// Either the SHA-256 digest or the whole content can be given.
+type fileExpectation struct {
+	SHA256  string
+	Content *string
+}
+
+// checkFiles verifies the content of files in the booted image. A diff
+// is reported for files with the inline content.
+func checkFiles(run guestCommandRunner, expected map[string]fileExpectation) error {
+	var problems []string
+	for filePath, expectation := range expected {
+		if expectation.SHA256 == "" && expectation.Content == nil {
+			return fmt.Errorf("%s: either sha256 or content must be specified", filePath)
+		}
+
+		out, err := run("sudo sha256sum " + filePath)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: cannot compute the digest: %v", filePath, err))
+			continue
+		}
+
+		fields := strings.Fields(out)
+		if len(fields) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: sha256sum returned no output", filePath))
+			continue
+		}
+		actualDigest := fields[0]
+
+		expectedDigest := expectation.SHA256
+		if expectation.Content != nil {
+			sum := sha256.Sum256([]byte(*expectation.Content))
+			expectedDigest = hex.EncodeToString(sum[:])
+		}
+
+		if actualDigest == strings.ToLower(expectedDigest) {
+			continue
+		}
+
+		problem := fmt.Sprintf("%s: expected sha256 %s, got %s", filePath, expectedDigest, actualDigest)
+		if expectation.Content != nil {
+			content, err := run("sudo cat " + filePath)
+			if err == nil {
+				problem += "\n" + lineDiff(*expectation.Content, content)
+			}
+		}
+		problems = append(problems, problem)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected file contents:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// lineDiff returns a line-by-line diff between the expected and actual text
+func lineDiff(expected, actual string) string {
+	return cmp.Diff(strings.Split(expected, "\n"), strings.Split(actual, "\n"))
+}
+
+// buildInfoExpectation describes the build metadata file embedded
+// in the image. The file uses the os-release KEY=VALUE format.
+type buildInfoExpectation struct {
+	// Path defaults to /etc/os-build-info
+	Path string
+	// Fields maps keys that must be present to regular expressions
+	// their values must match, an empty expression matches anything
+	Fields map[string]string
+	// OsbuildVersionField is a key whose value must be the version of
+	// osbuild the image was built with
+	OsbuildVersionField string `json:"osbuild-version-field"`
+}
+
+// parseKeyValueFile parses a file in the os-release format
+func parseKeyValueFile(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		values[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+
+	return values
+}
+
+// checkBuildInfo verifies the build metadata file in the booted image, the
+// osbuild version is read from the output directory of the image
+func checkBuildInfo(run guestCommandRunner, expected *buildInfoExpectation, outputDirectory string) error {
+	filePath := expected.Path
+	if filePath == "" {
+		filePath = "/etc/os-build-info"
+	}
+
+	content, err := run("cat " + filePath)
+	if err != nil {
+		return fmt.Errorf("cannot read the build metadata: %v", err)
+	}
+	values := parseKeyValueFile(content)
+
+	var problems []string
+	for key, pattern := range expected.Fields {
+		value, exists := values[key]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("%s is missing", key))
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern for %s: %v", key, err)
+		}
+
+		if !re.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%s: %q doesn't match %q", key, value, pattern))
+		}
+	}
+
+	if expected.OsbuildVersionField != "" {
+		// the image might have been built remotely or taken from the cache,
+		// not by the local osbuild
+		version, err := builtByOsbuildVersion(outputDirectory)
+		if err != nil {
+			return err
+		}
+
+		value := values[expected.OsbuildVersionField]
+		if value != version {
+			problems = append(problems, fmt.Sprintf("%s: expected osbuild version %q, got %q", expected.OsbuildVersionField, version, value))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected build metadata in %s:\n%s", filePath, strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// integrityExpectation configures the check for packaging defects
+type integrityExpectation struct {
+	// SymlinkPaths are scanned for broken symlinks, / is used if empty
+	SymlinkPaths []string `json:"symlink-paths"`
+	// IgnoreSymlinks are glob patterns of broken symlinks that are expected
+	IgnoreSymlinks []string `json:"ignore-symlinks"`
+	// Binaries must have all their shared libraries resolvable
+	Binaries []string
+}
+
+// checkIntegrity looks for broken symlinks and binaries with unresolved
+// shared library dependencies in the booted image
+func checkIntegrity(run guestCommandRunner, expected *integrityExpectation) error {
+	paths := expected.SymlinkPaths
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	// -xdev keeps find out of /proc, /sys and other virtual filesystems,
+	// the paths are separated by NUL as they can contain any other character
+	out, err := run("sudo find " + strings.Join(paths, " ") + " -xdev -xtype l -print0 2>/dev/null || true")
+	if err != nil {
+		return fmt.Errorf("cannot search for broken symlinks: %v", err)
+	}
+
+	var problems []string
+	for _, link := range strings.Split(out, "\x00") {
+		if link == "" {
+			continue
+		}
+
+		ignored := false
+		for _, pattern := range expected.IgnoreSymlinks {
+			if matched, _ := path.Match(pattern, link); matched {
+				ignored = true
+				break
+			}
+		}
+
+		if !ignored {
+			problems = append(problems, fmt.Sprintf("broken symlink: %s", link))
+		}
+	}
+
+	for _, binary := range expected.Binaries {
+		out, err := run("ldd " + binary + " 2>&1 || true")
+		if err != nil {
+			return fmt.Errorf("cannot run ldd on %s: %v", binary, err)
+		}
+
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "not found") || strings.Contains(line, "No such file") {
+				problems = append(problems, fmt.Sprintf("%s: %s", binary, strings.TrimSpace(line)))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the image has packaging defects:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// repositoryExpectation describes a dnf repository configured in the image
+type repositoryExpectation struct {
+	Enabled bool
+	// BaseURL and Mirrorlist are regular expressions, ignored if empty
+	BaseURL    string `json:"baseurl"`
+	Mirrorlist string
+	Metalink   string
+}
+
+// parseRepoFiles parses the content of yum repository files into a map
+// from a repository id to its options
+func parseRepoFiles(content string) map[string]map[string]string {
+	repos := make(map[string]map[string]string)
+
+	var current map[string]string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = make(map[string]string)
+			repos[strings.Trim(line, "[]")] = current
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if current == nil || len(parts) != 2 {
+			continue
+		}
+
+		current[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return repos
+}
+
+// checkRepositories verifies the dnf repositories in the booted image.
+// The enabled state comes from dnf repolist, the URLs from the repo files.
+// Enabled repositories which are not expected are reported as extra.
+func checkRepositories(run guestCommandRunner, expected map[string]repositoryExpectation) error {
+	enabledOut, err := run("dnf repolist --enabled -q 2>/dev/null | awk 'NR > 1 { print $1 }'")
+	if err != nil {
+		return fmt.Errorf("cannot list the enabled repositories: %v", err)
+	}
+	enabled := make(map[string]bool)
+	for _, id := range strings.Fields(enabledOut) {
+		enabled[id] = true
+	}
+
+	repoFiles, err := run("cat /etc/yum.repos.d/*.repo 2>/dev/null || true")
+	if err != nil {
+		return fmt.Errorf("cannot read the repository files: %v", err)
+	}
+	repos := parseRepoFiles(repoFiles)
+
+	var problems []string
+	for id, expectation := range expected {
+		options, exists := repos[id]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("%s: missing", id))
+			continue
+		}
+
+		if enabled[id] != expectation.Enabled {
+			problems = append(problems, fmt.Sprintf("%s: expected enabled=%t, got enabled=%t", id, expectation.Enabled, enabled[id]))
+		}
+
+		urlPatterns := []struct {
+			option  string
+			pattern string
+		}{
+			{"baseurl", expectation.BaseURL},
+			{"mirrorlist", expectation.Mirrorlist},
+			{"metalink", expectation.Metalink},
+		}
+		for _, u := range urlPatterns {
+			if u.pattern == "" {
+				continue
+			}
+
+			re, err := regexp.Compile(u.pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid %s pattern: %v", id, u.option, err)
+			}
+
+			if !re.MatchString(options[u.option]) {
+				problems = append(problems, fmt.Sprintf("%s: %s %q doesn't match %q", id, u.option, options[u.option], u.pattern))
+			}
+		}
+	}
+
+	for id := range enabled {
+		if _, exists := expected[id]; !exists {
+			problems = append(problems, fmt.Sprintf("%s: enabled but not expected", id))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected repository configuration:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// gpgKeysExpectation lists the GPG keys imported in the rpm database
+type gpgKeysExpectation struct {
+	// Keys are key ids or fingerprints
+	Keys []string
+	// AllowUnexpected doesn't report imported keys which are not listed
+	AllowUnexpected bool `json:"allow-unexpected"`
+}
+
+// rpmKeyID returns the short key id as used by rpm for the gpg-pubkey
+// version from a key id or a fingerprint
+func rpmKeyID(key string) string {
+	key = strings.ToLower(strings.Replace(key, " ", "", -1))
+	key = strings.TrimPrefix(key, "0x")
+	if len(key) > 8 {
+		key = key[len(key)-8:]
+	}
+
+	return key
+}
+
+// checkGPGKeys verifies the keys imported in the rpm database of
+// the booted image
+func checkGPGKeys(run guestCommandRunner, expected *gpgKeysExpectation) error {
+	out, err := run("rpm -q gpg-pubkey --qf '%{VERSION} %{SUMMARY}\\n' || true")
+	if err != nil {
+		return fmt.Errorf("cannot list the imported gpg keys: %v", err)
+	}
+
+	imported := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		// "package gpg-pubkey is not installed" has more words
+		if len(fields) != 2 || len(fields[0]) != 8 {
+			continue
+		}
+		imported[fields[0]] = fields[1]
+	}
+
+	expectedIDs := make(map[string]bool)
+	var problems []string
+	for _, key := range expected.Keys {
+		id := rpmKeyID(key)
+		expectedIDs[id] = true
+
+		if _, exists := imported[id]; !exists {
+			problems = append(problems, fmt.Sprintf("key %s is not imported", key))
+		}
+	}
+
+	if !expected.AllowUnexpected {
+		for id, summary := range imported {
+			if !expectedIDs[id] {
+				problems = append(problems, fmt.Sprintf("unexpected key %s: %s", id, summary))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("unexpected gpg keys in the rpm database:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// checkKernelRelease verifies that the guest runs the expected kernel, the
+// expectation is either a prefix of the release or a regular expression
+// matching its beginning. Kernel selection falls back to the default
+// kernel silently, the image boots fine then.
+func checkKernelRelease(run guestCommandRunner, expected string) error {
+	out, err := run("uname -r")
+	if err != nil {
+		return fmt.Errorf("cannot get the kernel release: %v", err)
+	}
+	actual := strings.TrimSpace(out)
+
+	if strings.HasPrefix(actual, expected) {
+		return nil
+	}
+
+	re, err := regexp.Compile("^(?:" + expected + ")")
+	if err != nil {
+		return fmt.Errorf("the kernel release %s doesn't start with %s, which is not a valid pattern either: %v", actual, expected, err)
+	}
+
+	if !re.MatchString(actual) {
+		return fmt.Errorf("unexpected kernel release: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
+
+// checkCryptoPolicy verifies the system-wide crypto policy of the guest
+func checkCryptoPolicy(run guestCommandRunner, expected string) error {
+	out, err := run("update-crypto-policies --show")
+	if err != nil {
+		return fmt.Errorf("cannot get the crypto policy: %v", err)
+	}
+
+	actual := strings.TrimSpace(out)
+	if actual != expected {
+		return fmt.Errorf("unexpected crypto policy: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
+
+// checkFIPS verifies that the guest runs in FIPS mode, both the kernel and
+// the user space configuration must agree
+func checkFIPS(run guestCommandRunner) error {
+	enabled, err := run("cat /proc/sys/crypto/fips_enabled")
+	if err != nil {
+		return fmt.Errorf("cannot get the kernel FIPS mode: %v", err)
+	}
+
+	// fips-mode-setup exits with non-zero if FIPS mode is not enabled,
+	// parse its output instead to include it in the error
+	check, err := run("fips-mode-setup --check || true")
+	if err != nil {
+		return fmt.Errorf("cannot check the FIPS mode: %v", err)
+	}
+
+	var problems []string
+	if strings.TrimSpace(enabled) != "1" {
+		problems = append(problems, fmt.Sprintf("/proc/sys/crypto/fips_enabled is %s, expected 1", strings.TrimSpace(enabled)))
+	}
+	if !strings.Contains(check, "FIPS mode is enabled") {
+		problems = append(problems, fmt.Sprintf("fips-mode-setup --check: %s", strings.TrimSpace(check)))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the guest is not in FIPS mode:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// detectEtcManagement returns "ostree" if /etc of the guest is
+// a three-way-merged copy of /usr/etc, or "traditional" for a plain /etc
+func detectEtcManagement(run guestCommandRunner) (string, error) {
+	out, err := run("if [ -e /run/ostree-booted ]; then echo ostree; else echo traditional; fi")
+	if err != nil {
+		return "", fmt.Errorf("cannot detect the /etc management model: %v", err)
+	}
+
+	model := strings.TrimSpace(out)
+	if model != "ostree" {
+		return model, nil
+	}
+
+	// the deployment must be known to rpm-ostree and ship the pristine
+	// configuration used as the base of the merge
+	_, err = run("rpm-ostree status --booted && test -d /usr/etc")
+	if err != nil {
+		return "", fmt.Errorf("the guest is booted using ostree but /etc is not managed by it: %v", err)
+	}
+
+	return model, nil
+}
+
+// checkEtcManagement verifies the /etc management model of the guest
+func checkEtcManagement(run guestCommandRunner, expected string) error {
+	if expected != "ostree" && expected != "traditional" {
+		return fmt.Errorf("unknown /etc management model %s", expected)
+	}
+
+	actual, err := detectEtcManagement(run)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("unexpected /etc management model: expected %s, got %s", expected, actual)
+	}
+
+	return nil
+}
+
+// selinuxExpectation describes SELinux booleans and file contexts
+// expected in the booted image
+type selinuxExpectation struct {
+	Booleans map[string]bool
+	// Contexts maps paths to their expected contexts, either the full
+	// context (e.g. "system_u:object_r:etc_t:s0") or only its type
+	Contexts map[string]string
+}
+
+// parseSELinuxBooleans parses the output of getsebool
+func parseSELinuxBooleans(output string) map[string]bool {
+	booleans := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "-->")
+		if len(fields) != 2 {
+			continue
+		}
+		booleans[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1]) == "on"
+	}
+
+	return booleans
+}
+
+// contextMatches returns true if the actual SELinux context equals
+// the expected one or if the expected one is the type of the actual one
+func contextMatches(actual, expected string) bool {
+	if actual == expected {
+		return true
+	}
+
+	fields := strings.Split(actual, ":")
+	return len(fields) >= 3 && fields[2] == expected
+}
+
+// checkSELinux verifies the SELinux booleans and file contexts of the guest
+func checkSELinux(run guestCommandRunner, expected *selinuxExpectation) error {
+	var problems []string
+
+	if len(expected.Booleans) > 0 {
+		var names []string
+		for name := range expected.Booleans {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		out, err := run("getsebool " + strings.Join(names, " "))
+		if err != nil {
+			return fmt.Errorf("cannot get the selinux booleans: %v", err)
+		}
+		actual := parseSELinuxBooleans(out)
+
+		for _, name := range names {
+			value, exists := actual[name]
+			if !exists {
+				problems = append(problems, fmt.Sprintf("boolean %s does not exist", name))
+			} else if value != expected.Booleans[name] {
+				problems = append(problems, fmt.Sprintf("boolean %s: expected %t, got %t", name, expected.Booleans[name], value))
+			}
+		}
+	}
+
+	var paths []string
+	for p := range expected.Contexts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		out, err := run("sudo stat -c %C " + p)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot get the context of %s: %v", p, err))
+			continue
+		}
+
+		actual := strings.TrimSpace(out)
+		if !contextMatches(actual, expected.Contexts[p]) {
+			problems = append(problems, fmt.Sprintf("%s: expected context %s, got %s", p, expected.Contexts[p], actual))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected selinux configuration:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// selinuxRelabelThreshold is the number of files restorecon may relabel
+// before the filesystem is considered mislabeled, a few files created
+// at runtime are expected
+const selinuxRelabelThreshold = 10
+
+// checkSELinuxEnforcing verifies that SELinux is enforcing and that the
+// filesystem is labeled, i.e. restorecon wouldn't relabel more than
+// selinuxRelabelThreshold files
+func checkSELinuxEnforcing(run guestCommandRunner) error {
+	mode, err := run("getenforce")
+	if err != nil {
+		return fmt.Errorf("cannot get the selinux mode: %v", err)
+	}
+
+	var problems []string
+	if strings.TrimSpace(mode) != "Enforcing" {
+		problems = append(problems, fmt.Sprintf("selinux is %s, expected Enforcing", strings.TrimSpace(mode)))
+	}
+
+	// one more line than the threshold is enough to know it's exceeded
+	out, err := run(fmt.Sprintf("sudo restorecon -nv -r / 2>/dev/null | head -n %d", selinuxRelabelThreshold+1))
+	if err != nil {
+		return fmt.Errorf("cannot check the selinux labels: %v", err)
+	}
+
+	relabeled := strings.Split(strings.TrimSpace(out), "\n")
+	if len(relabeled) > selinuxRelabelThreshold {
+		problems = append(problems, fmt.Sprintf("restorecon would relabel more than %d files, e.g.:\n%s", selinuxRelabelThreshold, strings.Join(relabeled[:selinuxRelabelThreshold], "\n")))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected selinux state:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// kernelModulesExpectation describes kernel modules expected to be loaded
+// or blacklisted in the booted image
+type kernelModulesExpectation struct {
+	Loaded      []string
+	Blacklisted []string
+}
+
+// normalizeModuleName returns the module name as listed by lsmod,
+// dashes and underscores are interchangeable in module names
+func normalizeModuleName(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// parseLsmod returns the set of modules listed by lsmod
+func parseLsmod(output string) map[string]bool {
+	modules := make(map[string]bool)
+	for i, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// skip the header
+		if i == 0 || len(fields) == 0 {
+			continue
+		}
+		modules[normalizeModuleName(fields[0])] = true
+	}
+
+	return modules
+}
+
+// parseModprobeBlacklist returns the set of modules blacklisted in
+// the output of modprobe --showconfig
+func parseModprobeBlacklist(output string) map[string]bool {
+	blacklisted := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "blacklist" {
+			blacklisted[normalizeModuleName(fields[1])] = true
+		}
+	}
+
+	return blacklisted
+}
+
+// checkKernelModules verifies the loaded and blacklisted kernel modules
+// of the guest
+func checkKernelModules(run guestCommandRunner, expected *kernelModulesExpectation) error {
+	out, err := run("lsmod")
+	if err != nil {
+		return fmt.Errorf("cannot list the loaded modules: %v", err)
+	}
+	loaded := parseLsmod(out)
+
+	var problems []string
+	for _, module := range expected.Loaded {
+		if !loaded[normalizeModuleName(module)] {
+			problems = append(problems, fmt.Sprintf("module %s is not loaded", module))
+		}
+	}
+
+	if len(expected.Blacklisted) > 0 {
+		out, err := run("sudo modprobe --showconfig")
+		if err != nil {
+			return fmt.Errorf("cannot get the modprobe configuration: %v", err)
+		}
+		blacklisted := parseModprobeBlacklist(out)
+
+		for _, module := range expected.Blacklisted {
+			name := normalizeModuleName(module)
+			if !blacklisted[name] {
+				problems = append(problems, fmt.Sprintf("module %s is not blacklisted", module))
+			}
+			if loaded[name] {
+				problems = append(problems, fmt.Sprintf("blacklisted module %s is loaded", module))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected kernel modules:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// countCPUs returns the number of CPUs in a cpu list like "0-3,5"
+// used in /sys/devices/system/cpu
+func countCPUs(list string) (int, error) {
+	count := 0
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+
+		var first, last int
+		if strings.Contains(part, "-") {
+			_, err := fmt.Sscanf(part, "%d-%d", &first, &last)
+			if err != nil {
+				return 0, fmt.Errorf("invalid cpu list %s: %v", list, err)
+			}
+		} else {
+			_, err := fmt.Sscanf(part, "%d", &first)
+			if err != nil {
+				return 0, fmt.Errorf("invalid cpu list %s: %v", list, err)
+			}
+			last = first
+		}
+		count += last - first + 1
+	}
+
+	return count, nil
+}
+
+// checkOnlineCPUs verifies the number of online CPUs in the guest
+func checkOnlineCPUs(run guestCommandRunner, expected int) error {
+	out, err := run("cat /sys/devices/system/cpu/online")
+	if err != nil {
+		return fmt.Errorf("cannot get the online cpus: %v", err)
+	}
+
+	actual, err := countCPUs(out)
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("unexpected number of online cpus: expected %d, got %d (%s)", expected, actual, strings.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// auditExpectation describes the audit rules expected to be loaded
+// in the booted image, auditd must be enabled and running
+type auditExpectation struct {
+	// Rules in the format printed by auditctl -l
+	Rules []string
+	// AllowUnexpected allows loaded rules which are not listed
+	AllowUnexpected bool `json:"allow-unexpected"`
+}
+
+// parseAuditRules returns the rules from auditctl -l output or from rules
+// files with normalized whitespace, comments and control lines are skipped
+func parseAuditRules(content string) []string {
+	var rules []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// only watches (-w) and syscall rules (-a) are interesting, the rest
+		// configures the kernel (-D, -b, -f, -e, ...)
+		if fields[0] != "-w" && fields[0] != "-a" {
+			continue
+		}
+
+		rules = append(rules, strings.Join(fields, " "))
+	}
+
+	return rules
+}
+
+// checkAudit verifies that auditd is enabled and running, and that both
+// the loaded rules and the rules files contain the expected rules
+func checkAudit(run guestCommandRunner, expected *auditExpectation) error {
+	var problems []string
+
+	// each query has its own expected answer, an enabled but stopped auditd
+	// is a failure
+	for _, query := range []struct {
+		command  string
+		expected string
+	}{
+		{"is-enabled", "enabled"},
+		{"is-active", "active"},
+	} {
+		out, err := run("systemctl " + query.command + " auditd || true")
+		if err != nil {
+			return fmt.Errorf("cannot get the state of auditd: %v", err)
+		}
+
+		state := strings.TrimSpace(out)
+		if state != query.expected {
+			problems = append(problems, fmt.Sprintf("auditd is %s, expected %s", state, query.expected))
+		}
+	}
+
+	loadedOut, err := run("sudo auditctl -l")
+	if err != nil {
+		return fmt.Errorf("cannot list the loaded audit rules: %v", err)
+	}
+	loaded := parseAuditRules(loadedOut)
+
+	// a directory without any rules files contains no rules
+	filesOut, err := run("sudo find /etc/audit/rules.d -maxdepth 1 -name '*.rules' -exec cat {} +")
+	if err != nil {
+		return fmt.Errorf("cannot read the audit rules files: %v", err)
+	}
+	inFiles := parseAuditRules(filesOut)
+
+	isLoaded := make(map[string]bool)
+	for _, rule := range loaded {
+		isLoaded[rule] = true
+	}
+	isInFiles := make(map[string]bool)
+	for _, rule := range inFiles {
+		isInFiles[rule] = true
+	}
+
+	isExpected := make(map[string]bool)
+	for _, rule := range parseAuditRules(strings.Join(expected.Rules, "\n")) {
+		isExpected[rule] = true
+		if !isLoaded[rule] {
+			problems = append(problems, fmt.Sprintf("rule %q is not loaded", rule))
+		}
+		if !isInFiles[rule] {
+			problems = append(problems, fmt.Sprintf("rule %q is not in /etc/audit/rules.d", rule))
+		}
+	}
+
+	if !expected.AllowUnexpected {
+		for _, rule := range loaded {
+			if !isExpected[rule] {
+				problems = append(problems, fmt.Sprintf("unexpected rule %q is loaded", rule))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected audit configuration:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
+
+// checkCloudInit waits for cloud-init to finish and fails if it reports
+// an error, the analysis of its boot stages is included in the error
+func checkCloudInit(run guestCommandRunner) error {
+	// cloud-init status exits with non-zero if cloud-init failed, parse
+	// its output instead to include it in the error
+	status, err := run("cloud-init status --wait --long || true")
+	if err != nil {
+		return fmt.Errorf("cannot get the cloud-init status: %v", err)
+	}
+
+	state := ""
+	for _, line := range strings.Split(status, "\n") {
+		if strings.HasPrefix(line, "status:") {
+			state = strings.TrimSpace(strings.TrimPrefix(line, "status:"))
+		}
+	}
+	if state == "done" {
+		return nil
+	}
+
+	analysis, err := run("sudo cloud-init analyze show")
+	if err != nil {
+		analysis = fmt.Sprintf("cannot analyze the cloud-init boot: %v", err)
+	}
+
+	return fmt.Errorf("cloud-init did not finish successfully:\n%s\n%s", strings.TrimSpace(status), strings.TrimSpace(analysis))
+}
+
+// cloudInitSecondBootExpectation describes cloud-init modules expected
+// to run or not to run during the second boot of the image
+type cloudInitSecondBootExpectation struct {
+	// OncePerInstance modules must not run again, e.g. users-groups
+	OncePerInstance []string `json:"once-per-instance"`
+	// PerBoot modules must run again, e.g. bootcmd or scripts-per-boot
+	PerBoot []string `json:"per-boot"`
+}
+
+// lastCloudInitBoot returns the part of cloud-init.log written during
+// the last boot. Every boot starts with the init-local stage.
+func lastCloudInitBoot(log string) string {
+	const marker = "running 'init-local'"
+
+	index := strings.LastIndex(log, marker)
+	if index == -1 {
+		return log
+	}
+
+	lineStart := strings.LastIndex(log[:index], "\n") + 1
+	return log[lineStart:]
+}
+
+// checkCloudInitSecondBoot verifies cloud-init's behaviour during the second
+// boot using its log. It's meant to be run after the guest was rebooted.
+func checkCloudInitSecondBoot(run guestCommandRunner, expected *cloudInitSecondBootExpectation) error {
+	rawLog, err := run("sudo cat /var/log/cloud-init.log")
+	if err != nil {
+		return fmt.Errorf("cannot read the cloud-init log: %v", err)
+	}
+	secondBoot := lastCloudInitBoot(rawLog)
+
+	var problems []string
+	for _, module := range expected.OncePerInstance {
+		if strings.Contains(secondBoot, "Running module "+module+" ") {
+			problems = append(problems, fmt.Sprintf("once-per-instance module %s ran again", module))
+		}
+	}
+
+	for _, module := range expected.PerBoot {
+		if !strings.Contains(secondBoot, "Running module "+module+" ") {
+			problems = append(problems, fmt.Sprintf("per-boot module %s did not run", module))
+		}
+	}
+
+	for _, line := range strings.Split(secondBoot, "\n") {
+		if strings.Contains(line, "already exists") && (strings.Contains(line, "WARNING") || strings.Contains(line, "ERROR")) {
+			problems = append(problems, fmt.Sprintf("existing resource error: %s", strings.TrimSpace(line)))
+		}
+	}
+
+	duplicates, err := run("cut -d: -f1 /etc/passwd | sort | uniq -d")
+	if err != nil {
+		return fmt.Errorf("cannot check for duplicate users: %v", err)
+	}
+	for _, user := range strings.Fields(duplicates) {
+		problems = append(problems, fmt.Sprintf("duplicate user %s", user))
+	}
+
+	status, err := run("cloud-init status || true")
+	if err != nil {
+		return fmt.Errorf("cannot get the cloud-init status: %v", err)
+	}
+	if strings.Contains(status, "error") {
+		problems = append(problems, fmt.Sprintf("cloud-init status: %s", strings.TrimSpace(status)))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("unexpected cloud-init behaviour during the second boot:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// +build integration
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountTable(t *testing.T) {
+	findmnt := `/                      rw,relatime,seclabel
+/boot                  rw,nosuid,nodev,relatime
+/tmp
+`
+	assert.Equal(t, map[string]map[string]bool{
+		"/":     {"rw": true, "relatime": true, "seclabel": true},
+		"/boot": {"rw": true, "nosuid": true, "nodev": true, "relatime": true},
+	}, parseMountTable(findmnt, 0, 1))
+
+	fstab := `# /etc/fstab
+UUID=1234 / xfs defaults 0 0
+UUID=5678 /boot ext4 defaults,nodev 1 2
+`
+	assert.Equal(t, map[string]map[string]bool{
+		"/":     {"defaults": true},
+		"/boot": {"defaults": true, "nodev": true},
+	}, parseMountTable(fstab, 1, 3))
+}
+
+func TestCompareMountOptions(t *testing.T) {
+	table := map[string]map[string]bool{
+		"/boot": {"rw": true, "nodev": true, "exec": true},
+	}
+
+	tests := []struct {
+		name     string
+		expected map[string]mountOptionsExpectation
+		required bool
+		problems []string
+	}{
+		{
+			name:     "matching",
+			expected: map[string]mountOptionsExpectation{"/boot": {Required: []string{"nodev"}, Forbidden: []string{"ro"}}},
+		},
+		{
+			name:     "missing required option",
+			expected: map[string]mountOptionsExpectation{"/boot": {Required: []string{"nosuid"}}},
+			problems: []string{"findmnt: /boot is missing required option nosuid"},
+		},
+		{
+			name:     "forbidden option",
+			expected: map[string]mountOptionsExpectation{"/boot": {Forbidden: []string{"exec"}}},
+			problems: []string{"findmnt: /boot has forbidden option exec"},
+		},
+		{
+			name:     "missing mountpoint",
+			expected: map[string]mountOptionsExpectation{"/var": {Required: []string{"nodev"}}},
+			required: true,
+			problems: []string{"findmnt: /var is not mounted"},
+		},
+		{
+			name:     "missing optional mountpoint",
+			expected: map[string]mountOptionsExpectation{"/var": {Required: []string{"nodev"}}},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.problems, compareMountOptions("findmnt", table, test.expected, test.required), test.name)
+	}
+}
+
+func TestParseSysctlConfig(t *testing.T) {
+	config := `# comment
+; another comment
+net.ipv4.ip_forward = 0
+kernel/yama/ptrace_scope=1
+-net.ipv4.conf.all.rp_filter = 1
+net.ipv4.ip_local_port_range = 32768	60999
+kernel.yama.ptrace_scope = 2
+invalid line
+`
+	assert.Equal(t, map[string]string{
+		"net.ipv4.ip_forward":          "0",
+		"kernel.yama.ptrace_scope":     "2",
+		"net.ipv4.conf.all.rp_filter":  "1",
+		"net.ipv4.ip_local_port_range": "32768 60999",
+	}, parseSysctlConfig(config))
+}
+
+func TestParseRepoFiles(t *testing.T) {
+	content := `ignored=before any section
+[baseos]
+name = BaseOS
+baseurl=https://example.com/baseos
+# enabled=0
+enabled=1
+
+[appstream]
+metalink=https://example.com/metalink?repo=appstream
+`
+	assert.Equal(t, map[string]map[string]string{
+		"baseos": {
+			"name":    "BaseOS",
+			"baseurl": "https://example.com/baseos",
+			"enabled": "1",
+		},
+		"appstream": {
+			"metalink": "https://example.com/metalink?repo=appstream",
+		},
+	}, parseRepoFiles(content))
+}
+
+func TestParseAuditRules(t *testing.T) {
+	content := `## First rule - delete all
+-D
+-b 8192
+-w /etc/passwd  -p wa -k identity
+-a always,exit -F arch=b64 -S adjtimex -k time-change
+-e 2
+`
+	assert.Equal(t, []string{
+		"-w /etc/passwd -p wa -k identity",
+		"-a always,exit -F arch=b64 -S adjtimex -k time-change",
+	}, parseAuditRules(content))
+
+	assert.Empty(t, parseAuditRules("No rules\n"))
+}
+
+func TestParseSELinuxBooleans(t *testing.T) {
+	output := `httpd_can_network_connect --> off
+virt_use_nfs --> on
+getsebool:  SELinux is disabled
+`
+	assert.Equal(t, map[string]bool{
+		"httpd_can_network_connect": false,
+		"virt_use_nfs":              true,
+	}, parseSELinuxBooleans(output))
+}
+
+func TestParseLsmod(t *testing.T) {
+	output := `Module                  Size  Used by
+nf_conntrack          172032  1 nf_nat
+virtio-net             57344  0
+
+`
+	assert.Equal(t, map[string]bool{
+		"nf_conntrack": true,
+		"virtio_net":   true,
+	}, parseLsmod(output))
+}
+
+func TestLastCloudInitBoot(t *testing.T) {
+	firstBoot := "2020-01-01 10:00:00,000 - util.py[DEBUG]: Cloud-init v. 19.4 running 'init-local' at Wed, 01 Jan 2020\n" +
+		"2020-01-01 10:00:01,000 - handlers.py[DEBUG]: finish: init-network/config-users-groups: SUCCESS\n"
+	secondBoot := "2020-01-01 10:05:00,000 - util.py[DEBUG]: Cloud-init v. 19.4 running 'init-local' at Wed, 01 Jan 2020\n" +
+		"2020-01-01 10:05:01,000 - helpers.py[DEBUG]: config-users-groups already ran (freq=once-per-instance)\n"
+
+	assert.Equal(t, secondBoot, lastCloudInitBoot(firstBoot+secondBoot))
+	assert.Equal(t, firstBoot, lastCloudInitBoot(firstBoot))
+
+	// a log without the marker is returned as a whole
+	assert.Equal(t, "no stages\n", lastCloudInitBoot("no stages\n"))
+}
+
+func TestRPMKeyID(t *testing.T) {
+	tests := []struct {
+		key string
+		id  string
+	}{
+		{"fd431d51", "fd431d51"},
+		{"0xFD431D51", "fd431d51"},
+		{"199E2F91FD431D51", "fd431d51"},
+		{"567E 347A D004 4ADE 55BA  8A5F 199E 2F91 FD43 1D51", "fd431d51"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.id, rpmKeyID(test.key), test.key)
+	}
+}
@@ -3,12 +3,22 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/google/uuid"
+	"github.com/gophercloud/gophercloud"
 )
 
 // durationMin returns the smaller of two given durations
@@ -24,7 +34,7 @@ func durationMin(a, b time.Duration) time.Duration {
 func killProcessCleanly(process *os.Process, timeout time.Duration) error {
 	err := process.Signal(syscall.SIGTERM)
 	if err != nil {
-		log.Printf("cannot send SIGTERM to process, sending SIGKILL instead: %#v", err)
+		harnessLog.Warningf("cannot send SIGTERM to process, sending SIGKILL instead: %#v", err)
 		return process.Kill()
 	}
 
@@ -63,3 +73,184 @@ func generateRandomString(prefix string) (string, error) {
 
 	return prefix + id.String(), nil
 }
+
+// errorCauses returns the error followed by the errors it was caused by.
+// The cloud SDKs and the cloud packages of the harness keep the original
+// errors in different ways.
+func errorCauses(err error) []error {
+	var causes []error
+	for err != nil {
+		causes = append(causes, err)
+
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case awserr.Error:
+			err = e.OrigErr()
+		case autorest.DetailedError:
+			err = e.Original
+		case *autorest.DetailedError:
+			err = e.Original
+		case *url.Error:
+			err = e.Err
+		default:
+			err = nil
+		}
+	}
+
+	return causes
+}
+
+// httpStatusCode returns the HTTP status code of the response which caused
+// the error of a cloud SDK
+func httpStatusCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case awserr.RequestFailure:
+		return e.StatusCode(), true
+	case autorest.DetailedError:
+		code, ok := e.StatusCode.(int)
+		return code, ok && code != 0
+	case *autorest.DetailedError:
+		code, ok := e.StatusCode.(int)
+		return code, ok && code != 0
+	case gophercloud.ErrDefault401:
+		return http.StatusUnauthorized, true
+	case gophercloud.ErrDefault403:
+		return http.StatusForbidden, true
+	case gophercloud.ErrDefault408:
+		return http.StatusRequestTimeout, true
+	case gophercloud.ErrDefault429:
+		return http.StatusTooManyRequests, true
+	case gophercloud.ErrDefault500:
+		return http.StatusInternalServerError, true
+	case gophercloud.ErrDefault503:
+		return http.StatusServiceUnavailable, true
+	case gophercloud.ErrUnexpectedResponseCode:
+		return e.Actual, true
+	case interface{ StatusCode() int }:
+		// the errors of the API clients of the cloud packages
+		return e.StatusCode(), true
+	}
+
+	return 0, false
+}
+
+// isTransientError reports whether the error was caused by a network or
+// a server-side failure. Only the typed errors of the SDKs are classified,
+// an error carrying no status code or network error is not retried.
+func isTransientError(err error) bool {
+	for _, cause := range errorCauses(err) {
+		if request.IsErrorThrottle(cause) {
+			return true
+		}
+
+		if code, ok := httpStatusCode(cause); ok {
+			return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+		}
+
+		// the connection was closed in the middle of a response
+		if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+			return true
+		}
+
+		if netErr, ok := cause.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryWithBackoff calls fn until it succeeds, returns a non-transient error
+// or the attempts run out. The delay between the attempts starts at base and
+// doubles after each attempt.
+func retryWithBackoff(attempts int, base time.Duration, fn func() error) error {
+	delay := base
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+
+		if i < attempts-1 {
+			harnessLog.Warningf("attempt %d of %d failed, retrying in %v: %v", i+1, attempts, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %v", attempts, err)
+}
+
+// semaphore limits the number of goroutines running a section of code
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore allowing n concurrent holders
+func newSemaphore(n int) semaphore {
+	return make(semaphore, n)
+}
+
+// tryAcquire acquires the semaphore if it's possible without blocking and
+// reports whether it succeeded
+func (s semaphore) tryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire blocks until the semaphore is acquired
+func (s semaphore) acquire() {
+	s <- struct{}{}
+}
+
+// release releases the semaphore acquired by acquire or tryAcquire
+func (s semaphore) release() {
+	<-s
+}
+
+// storePool hands out the osbuild stores. osbuild doesn't support
+// concurrent builds using the same store, so each concurrently running
+// build gets its own store and the sources cached in it are reused by
+// the next build getting the same store.
+type storePool chan string
+
+// newStorePool returns a pool of the given stores
+func newStorePool(stores []string) storePool {
+	p := make(storePool, len(stores))
+	for _, store := range stores {
+		p <- store
+	}
+
+	return p
+}
+
+// withStore runs the function f with a store nobody else uses until
+// f returns
+func (p storePool) withStore(f func(store string) error) error {
+	store := <-p
+	defer func() {
+		p <- store
+	}()
+
+	return f(store)
+}
+
+// tailFile returns the last n lines of the file. Errors are returned
+// in place of the content as it's meant only for diagnostics.
+func tailFile(filePath string, n int) string {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return fmt.Sprintf("cannot read %s: %v", filePath, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
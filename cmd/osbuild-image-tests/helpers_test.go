@@ -0,0 +1,78 @@
+// +build integration
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/gophercloud/gophercloud"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/cloudtest"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"aws 500", awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "id"), true},
+		{"aws 429", awserr.NewRequestFailure(awserr.New("TooManyRequests", "slow down", nil), 429, "id"), true},
+		{"aws 404", awserr.NewRequestFailure(awserr.New("NotFound", "no such image", nil), 404, "id"), false},
+		{"aws throttling", awserr.New("Throttling", "rate exceeded", nil), true},
+		{"azure 503", autorest.DetailedError{StatusCode: 503}, true},
+		{"azure 400", &autorest.DetailedError{StatusCode: 400}, false},
+		{"openstack 500", gophercloud.ErrDefault500{}, true},
+		{"openstack 401", gophercloud.ErrDefault401{}, false},
+		{"openstack 408", gophercloud.ErrDefault408{}, true},
+		{"wrapped 502", cloudtest.Wrapf(awserr.NewRequestFailure(awserr.New("BadGateway", "oops", nil), 502, "id"), "cannot upload"), true},
+		{"wrapped 403", cloudtest.Wrapf(gophercloud.ErrDefault403{}, "cannot upload"), false},
+		{"net timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"url timeout", &url.Error{Op: "Get", URL: "https://example.com", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, true},
+		{"unexpected eof", cloudtest.Wrapf(io.ErrUnexpectedEOF, "cannot read the response"), true},
+		{"plain error", errors.New("the image is invalid"), false},
+		{"wrapped plain error", cloudtest.Wrapf(errors.New("the image is invalid"), "cannot upload"), false},
+		{"nil", nil, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.transient, isTransientError(test.err), test.name)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	transient := gophercloud.ErrDefault503{}
+	permanent := errors.New("the image is invalid")
+
+	tests := []struct {
+		name    string
+		errs    []error
+		calls   int
+		success bool
+	}{
+		{"success", []error{nil}, 1, true},
+		{"transient then success", []error{transient, transient, nil}, 3, true},
+		{"transient until giving up", []error{transient, transient, transient}, 3, false},
+		{"permanent is not retried", []error{permanent, nil}, 1, false},
+		{"transient then permanent", []error{transient, permanent, nil}, 2, false},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := retryWithBackoff(3, 0, func() error {
+			err := test.errs[calls]
+			calls++
+			return err
+		})
+
+		assert.Equal(t, test.calls, calls, test.name)
+		assert.Equal(t, test.success, err == nil, test.name)
+	}
+}
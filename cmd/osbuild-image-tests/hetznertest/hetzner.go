@@ -0,0 +1,555 @@
+// +build integration
+
+package hetznertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+const (
+	apiURL = "https://api.hetzner.cloud/v1"
+
+	defaultServerType = "cx22"
+	defaultLocation   = "fsn1"
+
+	// builderImage is the image of the server the uploaded image is written
+	// to, it's booted into the rescue system so its content doesn't matter
+	builderImage = "debian-12"
+
+	// pollInterval is the delay between two checks of a resource status
+	pollInterval = 10 * time.Second
+	// waitTimeout is the maximal time to wait for a resource status
+	waitTimeout = 30 * time.Minute
+)
+
+type hetznerCredentials struct {
+	Token string
+	// ServerType is the type of the servers, e.g. cx22
+	ServerType string
+	// Location is the location of the servers, e.g. fsn1
+	Location string
+	// Network is the id of the private network the servers are attached
+	// to, it's required to reach them using their private addresses
+	Network string
+}
+
+// GetHetznerCredentialsFromEnv gets the credentials from environment
+// variables. If HETZNER_API_TOKEN is not set, it returns nil.
+// HETZNER_SERVER_TYPE, HETZNER_LOCATION and HETZNER_NETWORK are optional.
+func GetHetznerCredentialsFromEnv() (*hetznerCredentials, error) {
+	token, exists := os.LookupEnv("HETZNER_API_TOKEN")
+	// Workaround Travis security feature. If the token is not set, just ignore the test
+	if !exists {
+		return nil, nil
+	}
+	if token == "" {
+		return nil, errors.New("HETZNER_API_TOKEN is empty")
+	}
+
+	serverType, exists := os.LookupEnv("HETZNER_SERVER_TYPE")
+	if !exists {
+		serverType = defaultServerType
+	}
+
+	location, exists := os.LookupEnv("HETZNER_LOCATION")
+	if !exists {
+		location = defaultLocation
+	}
+
+	return &hetznerCredentials{
+		Token:      token,
+		ServerType: serverType,
+		Location:   location,
+		Network:    os.Getenv("HETZNER_NETWORK"),
+	}, nil
+}
+
+// errNotFound is returned by request if the resource doesn't exist
+var errNotFound = errors.New("the resource was not found")
+
+// request calls the Hetzner Cloud API. The body is encoded as JSON if not
+// nil, the response is decoded into out if not nil.
+func request(c *hetznerCredentials, method, resource string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("cannot encode the request: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, apiURL+resource, reader)
+	if err != nil {
+		return fmt.Errorf("cannot create the request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v", method, resource, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s failed with %s: %s", method, resource, resp.Status, message)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("cannot decode the response of %s %s: %v", method, resource, err)
+	}
+
+	return nil
+}
+
+// waitFor polls the check function until it returns true or an error
+func waitFor(what string, check func() (bool, error)) error {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't happen in %v", what, waitTimeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// action is the part of the action resource used by the tests
+type action struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// waitForAction polls the action until it succeeds, it fails if the action
+// fails
+func waitForAction(c *hetznerCredentials, what string, id int) error {
+	return waitFor(what, func() (bool, error) {
+		var current struct {
+			Action action `json:"action"`
+		}
+		err := request(c, http.MethodGet, fmt.Sprintf("/actions/%d", id), nil, &current)
+		if err != nil {
+			return false, err
+		}
+
+		switch current.Action.Status {
+		case "success":
+			return true, nil
+		case "error":
+			message := "unknown error"
+			if current.Action.Error != nil {
+				message = current.Action.Error.Message
+			}
+			return false, fmt.Errorf("%s failed: %s", what, message)
+		}
+
+		return false, nil
+	})
+}
+
+// serverAction runs the action on the server and waits for it, the body
+// can be nil
+func serverAction(c *hetznerCredentials, serverID int, name string, body interface{}) error {
+	var started struct {
+		Action action `json:"action"`
+	}
+	err := request(c, http.MethodPost, fmt.Sprintf("/servers/%d/actions/%s", serverID, name), body, &started)
+	if err != nil {
+		return fmt.Errorf("cannot run %s on the server %d: %v", name, serverID, err)
+	}
+
+	return waitForAction(c, name, started.Action.ID)
+}
+
+// server is the part of the server resource used by the tests
+type server struct {
+	ID        int    `json:"id"`
+	Status    string `json:"status"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+	} `json:"public_net"`
+	PrivateNet []struct {
+		IP string `json:"ip"`
+	} `json:"private_net"`
+}
+
+// address returns the public or the private IPv4 address of the server
+func (s server) address(private bool) string {
+	if !private {
+		return s.PublicNet.IPv4.IP
+	}
+
+	if len(s.PrivateNet) == 0 {
+		return ""
+	}
+
+	return s.PrivateNet[0].IP
+}
+
+// createServer creates a server from the image with the ssh key and waits
+// until it's running. The id of the server is returned even if it failed
+// to start, so it can be deleted.
+func createServer(c *hetznerCredentials, name, image string, keyID int, userData string) (int, error) {
+	body := map[string]interface{}{
+		"name":        name,
+		"server_type": c.ServerType,
+		"location":    c.Location,
+		"image":       image,
+		"ssh_keys":    []int{keyID},
+		"labels":      map[string]string{"osbuild-image-tests": ""},
+	}
+	if userData != "" {
+		body["user_data"] = userData
+	}
+	if c.Network != "" {
+		network, err := strconv.Atoi(c.Network)
+		if err != nil {
+			return 0, fmt.Errorf("invalid network id %s: %v", c.Network, err)
+		}
+		body["networks"] = []int{network}
+	}
+
+	var created struct {
+		Server server `json:"server"`
+		Action action `json:"action"`
+	}
+	err := request(c, http.MethodPost, "/servers", body, &created)
+	if err != nil {
+		return 0, fmt.Errorf("creating a server failed: %v", err)
+	}
+
+	err = waitForAction(c, "the server creation", created.Action.ID)
+	if err != nil {
+		return created.Server.ID, err
+	}
+
+	return created.Server.ID, nil
+}
+
+// getServer returns the current state of the server
+func getServer(c *hetznerCredentials, serverID int) (*server, error) {
+	var current struct {
+		Server server `json:"server"`
+	}
+	err := request(c, http.MethodGet, fmt.Sprintf("/servers/%d", serverID), nil, &current)
+	if err != nil {
+		return nil, err
+	}
+
+	return &current.Server, nil
+}
+
+// deleteServer deletes the server and waits until it's gone
+func deleteServer(c *hetznerCredentials, serverID int) error {
+	serverPath := fmt.Sprintf("/servers/%d", serverID)
+	err := request(c, http.MethodDelete, serverPath, nil, nil)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot delete the server %d: %v", serverID, err)
+	}
+
+	return waitFor("the server deletion", func() (bool, error) {
+		err := request(c, http.MethodGet, serverPath, nil, nil)
+		if err == errNotFound {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
+// withSSHKey registers the public key in the project for the duration of
+// the function f, which gets its id. If keep returns true after f, the key
+// is left in place.
+func withSSHKey(c *hetznerCredentials, name, publicKeyFile string, keep func() bool, f func(keyID int) error) (retErr error) {
+	publicKey, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the public key file: %v", err)
+	}
+
+	var key struct {
+		SSHKey struct {
+			ID int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err = request(c, http.MethodPost, "/ssh_keys", map[string]interface{}{
+		"name":       name,
+		"public_key": strings.TrimSpace(string(publicKey)),
+		"labels":     map[string]string{"osbuild-image-tests": ""},
+	}, &key)
+	if err != nil {
+		return fmt.Errorf("cannot create the ssh key: %v", err)
+	}
+
+	defer func() {
+		if keep() {
+			log.Printf("keeping the ssh key %s", name)
+			return
+		}
+
+		err := request(c, http.MethodDelete, fmt.Sprintf("/ssh_keys/%d", key.SSHKey.ID), nil, nil)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the ssh key %s: %v", name, err)
+		}
+	}()
+
+	return f(key.SSHKey.ID)
+}
+
+// rescueSSH returns the command running the shell command in the rescue
+// system of the server at the address
+func rescueSSH(address, privateKeyFile, command string) *exec.Cmd {
+	return exec.Command("ssh",
+		"-i", privateKeyFile,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=10",
+		"-o", "BatchMode=yes",
+		"root@"+address,
+		command,
+	)
+}
+
+// writeImageToServer writes the raw image to the disk of the server booted
+// into the rescue system
+func writeImageToServer(address, privateKeyFile, imagePath string) error {
+	err := waitFor("the rescue system start", func() (bool, error) {
+		return rescueSSH(address, privateKeyFile, "true").Run() == nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("cannot open the image: %v", err)
+	}
+	defer image.Close()
+
+	cmd := rescueSSH(address, privateKeyFile, "dd of=/dev/sda bs=4M conv=fsync")
+	cmd.Stdin = image
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("cannot write the image to the server disk: %v\n%s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// UploadImageToHetzner turns the image into a snapshot, it returns the id
+// of the snapshot. Hetzner Cloud cannot import images, so the image is
+// written to the disk of a temporary server booted into the rescue system
+// and the disk is snapshotted. The key pair is used to log into the rescue
+// system. Images in other formats than raw are converted first.
+func UploadImageToHetzner(c *hetznerCredentials, imagePath, imageName, publicKeyFile, privateKeyFile string) (int, error) {
+	raw := imagePath
+	if path.Ext(imagePath) != ".raw" {
+		dir, err := ioutil.TempDir("", "hetzner-image-")
+		if err != nil {
+			return 0, fmt.Errorf("cannot create a temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		raw = path.Join(dir, "image.raw")
+		cmd := exec.Command("qemu-img", "convert", "-O", "raw", imagePath, raw)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert the image to raw: %v", err)
+		}
+	}
+
+	// the temporary resources are always deleted
+	keep := func() bool { return false }
+
+	imageID := 0
+	err := withSSHKey(c, imageName+"-builder", publicKeyFile, keep, func(keyID int) (retErr error) {
+		// the server name is a hostname, whose labels are limited to 63
+		// characters
+		serverID, err := createServer(c, imageName+".builder", builderImage, keyID, "")
+
+		defer func() {
+			if serverID == 0 {
+				return
+			}
+			err := deleteServer(c, serverID)
+			if err != nil {
+				retErr = wrapErrorf(retErr, "cannot delete the builder server: %v", err)
+			}
+		}()
+
+		if err != nil {
+			return err
+		}
+
+		err = serverAction(c, serverID, "enable_rescue", map[string]interface{}{
+			"type":     "linux64",
+			"ssh_keys": []int{keyID},
+		})
+		if err != nil {
+			return err
+		}
+
+		// the rescue system is used from the next boot on
+		err = serverAction(c, serverID, "reset", nil)
+		if err != nil {
+			return err
+		}
+
+		builder, err := getServer(c, serverID)
+		if err != nil {
+			return fmt.Errorf("cannot get the builder server: %v", err)
+		}
+
+		err = writeImageToServer(builder.address(false), privateKeyFile, raw)
+		if err != nil {
+			return err
+		}
+
+		err = serverAction(c, serverID, "poweroff", nil)
+		if err != nil {
+			return err
+		}
+
+		var created struct {
+			Image struct {
+				ID int `json:"id"`
+			} `json:"image"`
+			Action action `json:"action"`
+		}
+		err = request(c, http.MethodPost, fmt.Sprintf("/servers/%d/actions/create_image", serverID), map[string]interface{}{
+			"type":        "snapshot",
+			"description": imageName,
+			"labels":      map[string]string{"osbuild-image-tests": ""},
+		}, &created)
+		if err != nil {
+			return fmt.Errorf("cannot create the snapshot: %v", err)
+		}
+
+		// the id is returned even if the snapshot fails, so it can be
+		// deleted
+		imageID = created.Image.ID
+		return waitForAction(c, "the snapshot creation", created.Action.ID)
+	})
+
+	return imageID, err
+}
+
+// DeleteImageFromHetzner deletes the snapshot (created by
+// UploadImageToHetzner method). The id is zero if no snapshot was created.
+func DeleteImageFromHetzner(c *hetznerCredentials, imageID int) error {
+	if imageID == 0 {
+		return nil
+	}
+
+	err := request(c, http.MethodDelete, fmt.Sprintf("/images/%d", imageID), nil, nil)
+	if err != nil && err != errNotFound {
+		return fmt.Errorf("cannot delete the snapshot %d: %v", imageID, err)
+	}
+
+	return nil
+}
+
+// WithBootedImageInHetzner runs the function f in the context of booted
+// image in Hetzner Cloud. The public key is registered in the project and
+// authorized for root, the user data are passed to cloud-init. The server
+// is reachable using its public address, or using its private address if
+// privateAddress is true, which requires HETZNER_NETWORK. If keep returns
+// true after f, the server and the key are left in place.
+func WithBootedImageInHetzner(c *hetznerCredentials, imageID int, testId, publicKeyFile, userData string, privateAddress bool, keep func() bool, f func(address string) error) error {
+	if privateAddress && c.Network == "" {
+		return errors.New("the server has a private address only if HETZNER_NETWORK is given")
+	}
+
+	serverName := "vm-" + testId
+
+	return withSSHKey(c, "key-"+testId, publicKeyFile, keep, func(keyID int) (retErr error) {
+		serverID, err := createServer(c, serverName, strconv.Itoa(imageID), keyID, userData)
+
+		// The server must be gone before the snapshot can be deleted.
+		defer func() {
+			if serverID == 0 {
+				return
+			}
+			if keep() {
+				log.Printf("keeping the server %s in the location %s running", serverName, c.Location)
+				return
+			}
+
+			err := deleteServer(c, serverID)
+			if err != nil {
+				retErr = wrapErrorf(retErr, "cannot delete the server %s: %v", serverName, err)
+			}
+		}()
+
+		if err != nil {
+			return fmt.Errorf("the server didn't start: %v", err)
+		}
+
+		current, err := getServer(c, serverID)
+		if err != nil {
+			return fmt.Errorf("cannot get the server: %v", err)
+		}
+		if current.Status != "running" {
+			return fmt.Errorf("the server %s is %s instead of running", serverName, current.Status)
+		}
+
+		address := current.address(privateAddress)
+		if address == "" {
+			return fmt.Errorf("the server %s has no address", serverName)
+		}
+
+		return f(address)
+	})
+}
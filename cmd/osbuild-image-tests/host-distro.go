@@ -0,0 +1,74 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/osbuild/osbuild-composer/internal/distro"
+)
+
+// getHostDistro returns the distro given by -host-distro, or the distro
+// of the current host read from /etc/os-release if the flag is empty
+func getHostDistro() (string, error) {
+	if *hostDistro != "" {
+		return *hostDistro, nil
+	}
+
+	name, err := distro.GetHostDistroName()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine the host distro, use -host-distro: %v", err)
+	}
+
+	return name, nil
+}
+
+// distroFamily returns the family of a distro name like rhel-8 or
+// fedora-32 and its major release. RHEL and CentOS (including CentOS
+// Stream) share the same family because one can be built on the other.
+func distroFamily(name string) (string, int, error) {
+	i := strings.LastIndex(name, "-")
+	if i == -1 {
+		return "", 0, fmt.Errorf("invalid distro name %s: no release", name)
+	}
+
+	family := name[:i]
+	release := strings.SplitN(name[i+1:], ".", 2)[0]
+	major, err := strconv.Atoi(release)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid distro name %s: %v", name, err)
+	}
+
+	if family == "centos" {
+		family = "rhel"
+	}
+
+	return family, major, nil
+}
+
+// buildableOnHost reports whether an image of the distro can be built on
+// the host distro. Fedora hosts can build any Fedora release, the other
+// families need the same major release on the host and in the image.
+func buildableOnHost(imageDistro, host string) (bool, error) {
+	imageFamily, imageMajor, err := distroFamily(imageDistro)
+	if err != nil {
+		return false, err
+	}
+
+	hostFamily, hostMajor, err := distroFamily(host)
+	if err != nil {
+		return false, err
+	}
+
+	if imageFamily != hostFamily {
+		return false, nil
+	}
+
+	if imageFamily == "fedora" {
+		return true, nil
+	}
+
+	return imageMajor == hostMajor, nil
+}
@@ -0,0 +1,427 @@
+// +build integration
+
+package ibmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+const (
+	defaultProfile = "bx2-2x8"
+	defaultOSName  = "red-8-amd64-byol"
+
+	// pollInterval is the delay between two checks of a resource status
+	pollInterval = 10 * time.Second
+	// waitTimeout is the maximal time to wait for a resource status
+	waitTimeout = 20 * time.Minute
+)
+
+type ibmCloudCredentials struct {
+	APIKey        string
+	Region        string
+	ResourceGroup string
+	// Bucket is the Cloud Object Storage bucket the images are imported from
+	Bucket string
+	Zone   string
+	VPC    string
+	Subnet string
+	// Profile is the instance profile, e.g. bx2-2x8
+	Profile string
+	// OSName is the operating system of the imported images
+	OSName string
+
+	// home is the IBMCLOUD_HOME of the logged in session, it's set
+	// by WithIBMCloudSession
+	home string
+}
+
+// GetIBMCloudCredentialsFromEnv gets the credentials from environment variables
+// If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// IBMCLOUD_PROFILE and IBMCLOUD_OS_NAME are optional.
+func GetIBMCloudCredentialsFromEnv() (*ibmCloudCredentials, error) {
+	apiKey, akExists := os.LookupEnv("IBMCLOUD_API_KEY")
+	region, rExists := os.LookupEnv("IBMCLOUD_REGION")
+	resourceGroup, rgExists := os.LookupEnv("IBMCLOUD_RESOURCE_GROUP")
+	bucket, bExists := os.LookupEnv("IBMCLOUD_BUCKET")
+	zone, zExists := os.LookupEnv("IBMCLOUD_ZONE")
+	vpc, vExists := os.LookupEnv("IBMCLOUD_VPC")
+	subnet, sExists := os.LookupEnv("IBMCLOUD_SUBNET")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !akExists && !rExists && !rgExists && !bExists && !zExists && !vExists && !sExists {
+		return nil, nil
+	}
+	// If only some of them are not set, then fail
+	if !akExists || !rExists || !rgExists || !bExists || !zExists || !vExists || !sExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	profile, exists := os.LookupEnv("IBMCLOUD_PROFILE")
+	if !exists {
+		profile = defaultProfile
+	}
+
+	osName, exists := os.LookupEnv("IBMCLOUD_OS_NAME")
+	if !exists {
+		osName = defaultOSName
+	}
+
+	return &ibmCloudCredentials{
+		APIKey:        apiKey,
+		Region:        region,
+		ResourceGroup: resourceGroup,
+		Bucket:        bucket,
+		Zone:          zone,
+		VPC:           vpc,
+		Subnet:        subnet,
+		Profile:       profile,
+		OSName:        osName,
+	}, nil
+}
+
+// runIBMCloud runs ibmcloud in the session created by WithIBMCloudSession
+// and returns its standard output
+func runIBMCloud(c *ibmCloudCredentials, args ...string) (string, error) {
+	if c.home == "" {
+		return "", errors.New("ibmcloud must be run in a session created by WithIBMCloudSession")
+	}
+
+	cmd := exec.Command("ibmcloud", args...)
+	cmd.Env = append(os.Environ(),
+		"IBMCLOUD_HOME="+c.home,
+		"IBMCLOUD_API_KEY="+c.APIKey,
+		"IBMCLOUD_COLOR=false",
+		"IBMCLOUD_VERSION_CHECK=false",
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ibmcloud %s failed: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runIBMCloudJSON runs ibmcloud with JSON output and decodes it into v
+func runIBMCloudJSON(c *ibmCloudCredentials, v interface{}, args ...string) error {
+	out, err := runIBMCloud(c, append(args, "--output", "JSON")...)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(out), v)
+	if err != nil {
+		return fmt.Errorf("cannot decode the output of ibmcloud %s: %v", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// WithIBMCloudSession runs the function f with ibmcloud logged in to the
+// region and the resource group given by the credentials. The session is
+// isolated from the user's ibmcloud configuration and deleted after f
+// returns.
+func WithIBMCloudSession(c *ibmCloudCredentials, f func() error) error {
+	home, err := ioutil.TempDir("", "ibmcloud-home-")
+	if err != nil {
+		return fmt.Errorf("cannot create a directory for the ibmcloud session: %v", err)
+	}
+	defer os.RemoveAll(home)
+
+	c.home = home
+	defer func() {
+		c.home = ""
+	}()
+
+	_, err = runIBMCloud(c, "login", "-r", c.Region, "-g", c.ResourceGroup, "--quiet")
+	if err != nil {
+		return fmt.Errorf("cannot log in to ibmcloud: %v", err)
+	}
+
+	return f()
+}
+
+// waitForStatus polls the resource described by the ibmcloud args until
+// its status is the expected one. It fails early if the resource reports
+// the failed status.
+func waitForStatus(c *ibmCloudCredentials, expected string, args ...string) error {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		var resource struct {
+			Status string `json:"status"`
+		}
+		err := runIBMCloudJSON(c, &resource, args...)
+		if err != nil {
+			return err
+		}
+
+		if resource.Status == expected {
+			return nil
+		}
+		if resource.Status == "failed" {
+			return fmt.Errorf("ibmcloud %s reports the failed status", strings.Join(args, " "))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ibmcloud %s didn't reach the %s status in %v, the last status is %s", strings.Join(args, " "), expected, waitTimeout, resource.Status)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// waitForDeletion polls the resource described by the ibmcloud args until
+// it doesn't exist anymore
+func waitForDeletion(c *ibmCloudCredentials, args ...string) error {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		_, err := runIBMCloud(c, args...)
+		if err != nil {
+			// the resource cannot be shown anymore
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ibmcloud %s still exists after %v", strings.Join(args, " "), waitTimeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// objectKey returns the key of the uploaded image in the bucket
+func objectKey(imageName string) string {
+	return imageName + ".qcow2"
+}
+
+// UploadImageToIBMCloud uploads the image to the bucket and imports it
+// as a VPC custom image. VPC requires qcow2 images, raw images are
+// converted automatically.
+func UploadImageToIBMCloud(c *ibmCloudCredentials, imagePath string, imageName string) error {
+	qcow2 := imagePath
+	if path.Ext(imagePath) != ".qcow2" {
+		dir, err := ioutil.TempDir("", "ibmcloud-image-")
+		if err != nil {
+			return fmt.Errorf("cannot create a temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		qcow2 = path.Join(dir, "image.qcow2")
+		cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", imagePath, qcow2)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("cannot convert the image to qcow2: %v", err)
+		}
+	}
+
+	_, err := runIBMCloud(c, "cos", "upload",
+		"--bucket", c.Bucket,
+		"--key", objectKey(imageName),
+		"--file", qcow2,
+		"--region", c.Region,
+	)
+	if err != nil {
+		return fmt.Errorf("upload to ibmcloud failed: %v", err)
+	}
+
+	_, err = runIBMCloud(c, "is", "image-create", imageName,
+		"--file", fmt.Sprintf("cos://%s/%s/%s", c.Region, c.Bucket, objectKey(imageName)),
+		"--os-name", c.OSName,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot import the vpc image: %v", err)
+	}
+
+	err = waitForStatus(c, "available", "is", "image", imageName)
+	if err != nil {
+		return fmt.Errorf("the vpc image didn't become available: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteImageFromIBMCloud deletes the VPC image and the uploaded object
+// (created by UploadImageToIBMCloud method).
+func DeleteImageFromIBMCloud(c *ibmCloudCredentials, imageName string) error {
+	var retErr error
+
+	_, err := runIBMCloud(c, "is", "image-delete", imageName, "--force")
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the vpc image: %v", err)
+	}
+
+	_, err = runIBMCloud(c, "cos", "object-delete",
+		"--bucket", c.Bucket,
+		"--key", objectKey(imageName),
+		"--region", c.Region,
+		"--force",
+	)
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the uploaded image: %v", err)
+	}
+
+	return retErr
+}
+
+// keyTypeArgs returns the arguments selecting the type of the public key,
+// VPC assumes rsa keys if the type is not given
+func keyTypeArgs(publicKey string) []string {
+	if strings.HasPrefix(publicKey, "ssh-ed25519 ") {
+		return []string{"--key-type", "ed25519"}
+	}
+
+	return nil
+}
+
+// WithBootedImageInIBMCloud runs the function f in the context of booted
+// image in IBM Cloud VPC. The public key is registered as a VPC key and
+// the user data are passed to cloud-init. The instance is reachable using
+// a floating IP, or using its private address if privateAddress is true.
+// If keep returns true after f, the instance and the resources attached
+// to it are left running.
+func WithBootedImageInIBMCloud(c *ibmCloudCredentials, imageName, testId, publicKeyFile, userData string, privateAddress bool, keep func() bool, f func(address string) error) (retErr error) {
+	publicKey, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the public key file: %v", err)
+	}
+
+	userDataFile, err := ioutil.TempFile("", "ibmcloud-user-data-")
+	if err != nil {
+		return fmt.Errorf("cannot create the user data file: %v", err)
+	}
+	defer os.Remove(userDataFile.Name())
+
+	_, err = userDataFile.WriteString(userData)
+	userDataFile.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write the user data file: %v", err)
+	}
+
+	keyName := "key-" + testId
+	instanceName := "vm-" + testId
+	floatingIPName := "ip-" + testId
+
+	keyArgs := append([]string{"is", "key-create", keyName, strings.TrimSpace(string(publicKey))}, keyTypeArgs(string(publicKey))...)
+	_, err = runIBMCloud(c, keyArgs...)
+	if err != nil {
+		return fmt.Errorf("cannot create the vpc key: %v", err)
+	}
+
+	defer func() {
+		if keep() {
+			log.Printf("keeping the key %s", keyName)
+			return
+		}
+
+		_, err := runIBMCloud(c, "is", "key-delete", keyName, "--force")
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the key %s: %v", keyName, err)
+		}
+	}()
+
+	var instance struct {
+		ID                      string `json:"id"`
+		PrimaryNetworkInterface struct {
+			ID        string `json:"id"`
+			PrimaryIP struct {
+				Address string `json:"address"`
+			} `json:"primary_ip"`
+		} `json:"primary_network_interface"`
+	}
+	err = runIBMCloudJSON(c, &instance, "is", "instance-create", instanceName, c.VPC, c.Zone, c.Profile, c.Subnet,
+		"--image", imageName,
+		"--keys", keyName,
+		"--user-data", "@"+userDataFile.Name(),
+	)
+
+	// Let's register the clean-up function as soon as possible, the instance
+	// might exist even if the creation failed. The instance must be gone
+	// before the image can be deleted.
+	defer func() {
+		if keep() {
+			log.Printf("keeping the instance %s in the zone %s running", instanceName, c.Zone)
+			return
+		}
+
+		_, err := runIBMCloud(c, "is", "instance-delete", instanceName, "--force")
+		if err != nil {
+			log.Printf("deleting the instance %s errored: %v", instanceName, err)
+			retErr = wrapErrorf(retErr, "cannot delete the instance %s: %v", instanceName, err)
+			return
+		}
+
+		err = waitForDeletion(c, "is", "instance", instanceName)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "waiting for the instance deletion failed: %v", err)
+		}
+	}()
+
+	if err != nil {
+		return fmt.Errorf("creating an instance failed: %v", err)
+	}
+
+	err = waitForStatus(c, "running", "is", "instance", instanceName)
+	if err != nil {
+		return fmt.Errorf("the instance didn't start: %v", err)
+	}
+
+	if privateAddress {
+		// the address is assigned by the time the instance is running
+		err = runIBMCloudJSON(c, &instance, "is", "instance", instanceName)
+		if err != nil {
+			return fmt.Errorf("cannot get the instance details: %v", err)
+		}
+
+		return f(instance.PrimaryNetworkInterface.PrimaryIP.Address)
+	}
+
+	var floatingIP struct {
+		Address string `json:"address"`
+	}
+	err = runIBMCloudJSON(c, &floatingIP, "is", "floating-ip-reserve", floatingIPName,
+		"--nic", instance.PrimaryNetworkInterface.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot reserve a floating ip: %v", err)
+	}
+
+	defer func() {
+		if keep() {
+			log.Printf("keeping the floating ip %s", floatingIPName)
+			return
+		}
+
+		_, err := runIBMCloud(c, "is", "floating-ip-release", floatingIPName, "--force")
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot release the floating ip %s: %v", floatingIPName, err)
+		}
+	}()
+
+	return f(floatingIP.Address)
+}
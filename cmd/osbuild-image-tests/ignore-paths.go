@@ -0,0 +1,91 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseIgnorePath splits a JSON pointer like /partitions/*/uuid into its
+// tokens. The * token matches every key of an object or every element of
+// an array.
+func parseIgnorePath(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid ignore path %q: it must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		// ~1 must be replaced first, see RFC 6901
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// withoutPath returns a copy of the decoded JSON document without the
+// values at the path, the document itself is not modified. Parts of the
+// path missing in the document are ignored.
+func withoutPath(doc interface{}, tokens []string) interface{} {
+	if len(tokens) == 0 {
+		return doc
+	}
+	token, rest := tokens[0], tokens[1:]
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if token != "*" && token != key {
+				result[key] = value
+				continue
+			}
+			if len(rest) > 0 {
+				result[key] = withoutPath(value, rest)
+			}
+		}
+		return result
+
+	case []interface{}:
+		index := -1
+		if token != "*" {
+			var err error
+			index, err = strconv.Atoi(token)
+			if err != nil {
+				return v
+			}
+		}
+
+		result := make([]interface{}, 0, len(v))
+		for i, value := range v {
+			if token != "*" && i != index {
+				result = append(result, value)
+				continue
+			}
+			if len(rest) > 0 {
+				result = append(result, withoutPath(value, rest))
+			}
+		}
+		return result
+
+	default:
+		return doc
+	}
+}
+
+// withoutIgnoredPaths returns a copy of the decoded JSON document without
+// the values at all the paths
+func withoutIgnoredPaths(doc interface{}, pointers []string) (interface{}, error) {
+	for _, pointer := range pointers {
+		tokens, err := parseIgnorePath(pointer)
+		if err != nil {
+			return nil, err
+		}
+
+		doc = withoutPath(doc, tokens)
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,71 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithoutIgnoredPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		pointers []string
+		expected string
+	}{
+		{
+			name:     "object key",
+			doc:      `{"a": 1, "b": 2}`,
+			pointers: []string{"/a"},
+			expected: `{"b": 2}`,
+		},
+		{
+			name:     "wildcard in an array",
+			doc:      `{"partitions": [{"uuid": "x", "size": 1}, {"uuid": "y", "size": 2}]}`,
+			pointers: []string{"/partitions/*/uuid"},
+			expected: `{"partitions": [{"size": 1}, {"size": 2}]}`,
+		},
+		{
+			name:     "array index",
+			doc:      `{"list": [1, 2, 3]}`,
+			pointers: []string{"/list/1"},
+			expected: `{"list": [1, 3]}`,
+		},
+		{
+			name:     "escaped key",
+			doc:      `{"a/b": 1, "c~d": 2, "e": 3}`,
+			pointers: []string{"/a~1b", "/c~0d"},
+			expected: `{"e": 3}`,
+		},
+		{
+			name:     "missing path",
+			doc:      `{"a": {"b": 1}}`,
+			pointers: []string{"/a/c/d", "/x"},
+			expected: `{"a": {"b": 1}}`,
+		},
+	}
+
+	for _, test := range tests {
+		var doc, expected interface{}
+		require.NoError(t, json.Unmarshal([]byte(test.doc), &doc), test.name)
+		require.NoError(t, json.Unmarshal([]byte(test.expected), &expected), test.name)
+
+		result, err := withoutIgnoredPaths(doc, test.pointers)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, expected, result, test.name)
+	}
+
+	// the document is not modified
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"a": 1, "b": 2}`), &doc))
+	_, err := withoutIgnoredPaths(doc, []string{"/a"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": 1.0, "b": 2.0}, doc)
+
+	_, err = withoutIgnoredPaths(doc, []string{"a"})
+	assert.Error(t, err)
+}
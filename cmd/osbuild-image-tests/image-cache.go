@@ -0,0 +1,290 @@
+// +build integration
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/constants"
+)
+
+// sha256File returns the hex-encoded SHA-256 digest of the file
+func sha256File(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %s: %v", filePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %v", filePath, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getOsbuildVersion returns the version of osbuild used for building
+func getOsbuildVersion() (string, error) {
+	out, err := constants.GetOsbuildVersionCommand().Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get the osbuild version: %v", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// osbuildVersionFile is written into the output directory next to the image,
+// it contains the output of osbuild --version of the osbuild which built it
+const osbuildVersionFile = "osbuild-version"
+
+// recordOsbuildVersion writes the version of the osbuild which built the
+// image into the output directory
+func recordOsbuildVersion(outputDirectory, version string) error {
+	err := ioutil.WriteFile(path.Join(outputDirectory, osbuildVersionFile), []byte(strings.TrimSpace(version)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot record the osbuild version: %v", err)
+	}
+
+	return nil
+}
+
+// builtByOsbuildVersion returns the version of the osbuild which built the
+// image in the output directory, without the "osbuild " prefix
+func builtByOsbuildVersion(outputDirectory string) (string, error) {
+	version, err := ioutil.ReadFile(path.Join(outputDirectory, osbuildVersionFile))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the version of the osbuild which built the image: %v", err)
+	}
+
+	// osbuild --version prints "osbuild VERSION"
+	return strings.TrimPrefix(strings.TrimSpace(string(version)), "osbuild "), nil
+}
+
+// imageCacheKey returns the key of the output built from the manifest.
+// The key is a digest of the manifest, the environment osbuild runs with
+// and the osbuild version, so a new osbuild release never reuses images
+// built by the old one.
+func imageCacheKey(manifest []byte, env map[string]string) (string, error) {
+	version, err := getOsbuildVersion()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_, _ = h.Write(manifest)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = h.Write([]byte("\x00" + name + "=" + env[name]))
+	}
+	_, _ = h.Write([]byte("\x00osbuild " + version))
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheChecksumURL returns the URL of the SHA-256 digest stored next to the
+// cached image at url
+func cacheChecksumURL(url string) string {
+	return url + ".sha256"
+}
+
+// downloadCachedChecksum returns the SHA-256 digest of the cached image at
+// url, or an empty string if the cache doesn't have it
+func downloadCachedChecksum(url string) (string, error) {
+	resp, err := http.Get(cacheChecksumURL(url))
+	if err != nil {
+		return "", fmt.Errorf("cannot query the image cache: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the image cache returned %s", resp.Status)
+	}
+
+	checksum, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot download the checksum of the cached image: %v", err)
+	}
+
+	return strings.TrimSpace(string(checksum)), nil
+}
+
+// downloadCachedOutput downloads the archive of the output directory from
+// the cache and extracts it into outputDirectory. It returns false if the
+// cache doesn't have the archive or its checksum. The archive is downloaded
+// into a temporary file next to the output directory and extracted only if
+// its digest matches the checksum, so a failed download never leaves
+// truncated artifacts behind.
+func downloadCachedOutput(url, outputDirectory string) (bool, error) {
+	checksum, err := downloadCachedChecksum(url)
+	if err != nil {
+		return false, err
+	}
+	if checksum == "" {
+		return false, nil
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return false, fmt.Errorf("cannot query the image cache: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("the image cache returned %s", resp.Status)
+	}
+
+	f, err := ioutil.TempFile(path.Dir(outputDirectory), "image-cache-download-*.tar")
+	if err != nil {
+		return false, fmt.Errorf("cannot create a temporary file for the download: %v", err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("cannot download the cached output: %v", err)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != checksum {
+		harnessLog.Warningf("the cached output %s is corrupted, its sha256 is %s instead of %s", url, digest, checksum)
+		return false, nil
+	}
+
+	err = f.Close()
+	if err != nil {
+		return false, fmt.Errorf("cannot write the cached output: %v", err)
+	}
+
+	out, err := exec.Command("tar", "-S", "-C", outputDirectory, "-xf", f.Name()).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("cannot extract the cached output into %s: %v\n%s", outputDirectory, err, out)
+	}
+
+	return true, nil
+}
+
+// uploadToCache stores the body in the cache using a PUT request
+func uploadToCache(url string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return fmt.Errorf("cannot create the upload request: %v", err)
+	}
+	req.ContentLength = size
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot upload to the cache: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the image cache refused the upload: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// uploadOutputToCache stores an archive of the output directory and its
+// SHA-256 digest in the cache. The digest is stored last, an archive without
+// it is never used.
+func uploadOutputToCache(url, outputDirectory string) error {
+	// the archive cannot live in the directory it archives
+	f, err := ioutil.TempFile(path.Dir(outputDirectory), "image-cache-upload-*.tar")
+	if err != nil {
+		return fmt.Errorf("cannot create a temporary file for the archive: %v", err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	out, err := exec.Command("tar", "-S", "-C", outputDirectory, "-cf", f.Name(), ".").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot archive %s: %v\n%s", outputDirectory, err, out)
+	}
+
+	checksum, err := sha256File(f.Name())
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %v", f.Name(), err)
+	}
+
+	err = uploadToCache(url, f, stat.Size())
+	if err != nil {
+		return err
+	}
+
+	return uploadToCache(cacheChecksumURL(url), strings.NewReader(checksum), int64(len(checksum)))
+}
+
+// withImageCache provides the output of the build of the manifest in
+// outputDirectory. The whole directory is cached, so the artifacts produced
+// next to the image and the recorded osbuild version are restored as well.
+// It is looked up in the cache as a tar archive under
+// <cacheURL>/<key>/<filename>.tar, its SHA-256 digest is stored next to it
+// with the .sha256 extension. If the cache doesn't have it, the build
+// function is called and the result is uploaded to the cache. A failed upload
+// doesn't fail the build, it's only logged.
+func withImageCache(cacheURL string, manifest []byte, env map[string]string, outputDirectory, filename string, timings *caseTimings, build func() error) error {
+	key, err := imageCacheKey(manifest, env)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(cacheURL, "/") + "/" + key + "/" + filename + ".tar"
+
+	start := time.Now()
+	hit, err := downloadCachedOutput(url, outputDirectory)
+	if err != nil {
+		return err
+	}
+	if hit {
+		timings.recordCacheRestore(time.Since(start))
+		harnessLog.Infof("image cache hit for %s, skipping the build", url)
+		return nil
+	}
+
+	harnessLog.Infof("image cache miss for %s, building the image", url)
+	err = build()
+	if err != nil {
+		return err
+	}
+
+	err = uploadOutputToCache(url, outputDirectory)
+	if err != nil {
+		harnessLog.Warningf("cannot store the output in the cache: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// expectedImageInfo is the image info the image given by -image is
+// compared with
+type expectedImageInfo struct {
+	imageInfo   json.RawMessage
+	ignorePaths []string
+	// testcasePath is the test case the image info was read from, it's
+	// empty if the file is the image-info output itself
+	testcasePath string
+}
+
+// readExpectedImageInfo reads the -expected-info file, either a test case
+// with the image-info key or the output of image-info itself
+func readExpectedImageInfo(filePath string) (*expectedImageInfo, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the expected image info: %v", err)
+	}
+
+	var document map[string]json.RawMessage
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the expected image info: %v", err)
+	}
+
+	if _, exists := document["image-info"]; !exists {
+		return &expectedImageInfo{imageInfo: content}, nil
+	}
+
+	var testcase testcaseStruct
+	err = json.Unmarshal(content, &testcase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot decode test case: %v", filePath, err)
+	}
+
+	return &expectedImageInfo{
+		imageInfo:    testcase.ImageInfo,
+		ignorePaths:  testcase.IgnorePaths,
+		testcasePath: filePath,
+	}, nil
+}
+
+// testPrebuiltImage runs only the image info test on the already built
+// image, nothing is built or booted. The ignore paths of the test case
+// apply, and -update-fixtures updates it.
+func testPrebuiltImage(t *testing.T, imagePath, expectedPath string) {
+	t.Run(path.Base(imagePath), func(t *testing.T) {
+		expected, err := readExpectedImageInfo(expectedPath)
+		require.NoError(t, err)
+
+		if *updateFixtures && expected.testcasePath == "" {
+			t.Fatal("-update-fixtures requires -expected-info to be a test case")
+		}
+
+		testImageInfo(t, expected.testcasePath, imagePath, expected.imageInfo, expected.ignorePaths)
+	})
+}
@@ -0,0 +1,56 @@
+// +build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// keepAlive reports whether the machine booted for the test should be left
+// running for debugging instead of being torn down
+func keepAlive(t *testing.T) bool {
+	return *keepOnFailure && t.Failed()
+}
+
+// preservePrivateKey copies the private key out of the temporary directory
+// created by withSSHKeyPair, so it survives the test
+func preservePrivateKey(privateKey string) (string, error) {
+	content, err := ioutil.ReadFile(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the private key: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "osbuild-image-tests-key-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create a file for the private key: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	if err != nil {
+		return "", fmt.Errorf("cannot write the private key: %v", err)
+	}
+
+	return f.Name(), nil
+}
+
+// reportKeptMachine logs how to connect to the machine left running by
+// -keep-on-failure. The prefix is prepended to the ssh command, e.g. to enter
+// the network namespace of the machine.
+func reportKeptMachine(t *testing.T, target sshTarget, prefix, details string) {
+	privateKey, err := preservePrivateKey(target.privateKey)
+	if err != nil {
+		t.Logf("cannot preserve the private key, the machine might be unreachable: %v", err)
+	} else {
+		target.privateKey = privateKey
+	}
+
+	cmd := sshCommandContext(context.Background(), target, "")
+	command := strings.TrimSpace(prefix + " " + strings.Join(cmd.Args, " "))
+
+	t.Logf("the machine is kept running for debugging (%s), connect using:\n%s", details, command)
+}
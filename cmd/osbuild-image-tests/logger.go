@@ -0,0 +1,93 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// logLevel is the severity of a log message, messages below -log-level
+// are dropped
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarning
+	logError
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel returns the level named by name, see logLevelNames
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if name == n {
+			return logLevel(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// minLogLevel is set from -log-level before any test case runs
+var minLogLevel = logInfo
+
+// timestampedLog writes all messages with timestamps precise enough to
+// correlate them with the osbuild and qemu output
+var timestampedLog = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+
+// leveledLogger writes leveled messages, prefixed by the test case they
+// belong to. A nil logger writes messages without a prefix, it's used by
+// the helpers not tied to a single test case.
+type leveledLogger struct {
+	prefix string
+}
+
+// harnessLog is the logger for messages not tied to a test case
+var harnessLog *leveledLogger
+
+// newCaseLogger returns a logger prefixing the messages with the distro,
+// the arch and the filename of the testcase
+func newCaseLogger(testcase testcaseStruct) *leveledLogger {
+	request := testcase.ComposeRequest
+	return &leveledLogger{
+		prefix: fmt.Sprintf("%s/%s/%s", request.Distro, request.Arch, request.Filename),
+	}
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, a ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+
+	message := fmt.Sprintf(format, a...)
+	if l != nil && l.prefix != "" {
+		message = "[" + l.prefix + "] " + message
+	}
+
+	timestampedLog.Printf("%-7s %s", strings.ToUpper(level.String()), message)
+}
+
+func (l *leveledLogger) Debugf(format string, a ...interface{}) {
+	l.logf(logDebug, format, a...)
+}
+
+func (l *leveledLogger) Infof(format string, a ...interface{}) {
+	l.logf(logInfo, format, a...)
+}
+
+func (l *leveledLogger) Warningf(format string, a ...interface{}) {
+	l.logf(logWarning, format, a...)
+}
+
+func (l *leveledLogger) Errorf(format string, a ...interface{}) {
+	l.logf(logError, format, a...)
+}
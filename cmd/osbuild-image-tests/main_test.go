@@ -6,26 +6,40 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/azuretest"
 	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/constants"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/dotest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/gcptest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/hetznertest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/ibmtest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/ocitest"
 	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/openstacktest"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/s3test"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/summary"
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/vmwaretest"
 	"github.com/osbuild/osbuild-composer/internal/common"
 )
 
@@ -35,96 +49,551 @@ type testcaseStruct struct {
 		Arch     string
 		Filename string
 	} `json:"compose-request"`
-	Manifest  json.RawMessage
-	ImageInfo json.RawMessage `json:"image-info"`
-	Boot      *struct {
-		Type string
-	}
+	// RawComposeRequest is the complete compose request, it's needed
+	// to generate the manifest again
+	RawComposeRequest json.RawMessage `json:"-"`
+	// AcceptableDistros are glob patterns of distros the testcase is
+	// valid for, ComposeRequest.Distro is used if empty
+	AcceptableDistros []string `json:"acceptable-distros"`
+	Manifest          json.RawMessage
+	ManifestCommand   *manifestCommand `json:"manifest-command"`
+	ImageInfo         json.RawMessage  `json:"image-info"`
+	// IgnorePaths are JSON pointers (e.g. /partitions/*/uuid) to values
+	// left out of the image info comparison, * matches any key or index
+	IgnorePaths []string `json:"ignore-paths"`
+	SBOM        *sbomExpectation
+	// PartitionAssertions are targeted checks of the partition layout
+	// reported by image-info, they don't require the full ImageInfo
+	PartitionAssertions *partitionAssertions `json:"partition-assertions"`
+	// ServiceAssertions are targeted checks of the systemd units reported
+	// by image-info, they don't require the full ImageInfo
+	ServiceAssertions *serviceAssertions `json:"service-assertions"`
+	// BootloaderAssertions check the bootloader family and the EFI
+	// binaries using the partitions reported by image-info
+	BootloaderAssertions *bootloaderAssertions `json:"bootloader-assertions"`
+	// RequirePackages must be installed in the image and ForbidPackages
+	// must not be, see testPackages for the syntax
+	RequirePackages []string `json:"require-packages"`
+	ForbidPackages  []string `json:"forbid-packages"`
+	// ExpectedSize is the expected size of the image in bytes
+	ExpectedSize int64 `json:"expected-size"`
+	// SHA256 is the expected hex digest of the image
+	SHA256 string `json:"sha256"`
+	// Env is set in the environment of osbuild on top of the inherited
+	// one, e.g. proxy settings or OSBUILD_EXPERIMENTAL
+	Env  map[string]string
+	Boot *bootStruct
+
+	// path to the testcase file
+	path string
+}
+
+// bootStruct describes how to boot the image and what is expected
+// from the booted system
+type bootStruct struct {
+	Type         string
+	MountOptions map[string]mountOptionsExpectation `json:"mount-options"`
+	// Format is the format of the image booted in qemu (raw or qcow2),
+	// qemu probes it if empty. Compressed images are decompressed first.
+	Format string `json:"format"`
+	// CPUModel is passed to qemu as -cpu
+	CPUModel string `json:"cpu-model"`
+	// CPUFlags must be present in the guest's /proc/cpuinfo
+	CPUFlags []string `json:"cpu-flags"`
+	// SSHUser is the user used to log into the image, defaultSSHUser is used
+	// if empty. Cloud backends create it, for local boots it must already
+	// exist in the image.
+	SSHUser string `json:"ssh-user"`
+	// SSHKeyType is the type of the key generated for logging into images
+	// booted in the clouds, -ssh-key-type is used if empty
+	SSHKeyType string `json:"ssh-key-type"`
+	// ExtraSSHKeys are public keys authorized for SSHUser besides the
+	// generated one, -extra-ssh-key adds more. They are injected using
+	// cloud-init, azure doesn't support them.
+	ExtraSSHKeys []string `json:"extra-ssh-keys"`
+	// SSHLogins are users of the image, e.g. from the users customization,
+	// who must be able to log in with their own keys
+	SSHLogins []sshLoginExpectation `json:"ssh-logins"`
+	OpenSCAP  *openSCAPExpectation
+	Firewall  *firewallExpectation
+	Sysctl    *sysctlExpectation
+	// Files maps paths in the image to their expected content
+	Files     map[string]fileExpectation
+	BuildInfo *buildInfoExpectation `json:"build-info"`
+	Integrity *integrityExpectation
+	// PXE describes the netboot artifacts for the pxe boot type, the live
+	// rootfs is kept in the guest memory, so Memory has to fit it
+	PXE *pxeOptions
+	// Repositories maps dnf repository ids to their expected configuration
+	Repositories map[string]repositoryExpectation
+	// ShutdownTimeout is the maximal time the guest can take to power off,
+	// e.g. "30s", it's measured only when booting using qemu
+	ShutdownTimeout string              `json:"shutdown-timeout"`
+	GPGKeys         *gpgKeysExpectation `json:"gpg-keys"`
+	// ExpectedKernel is the expected release of the running kernel (uname -r),
+	// either a prefix of it, e.g. "5.8.15-201", or a regular expression
+	// matching its beginning, e.g. ".*\.rt[0-9.]+" for kernel-rt
+	ExpectedKernel string `json:"expected-kernel"`
+	// CryptoPolicy is the expected system-wide crypto policy, e.g. "FUTURE"
+	CryptoPolicy string `json:"expect-crypto-policy"`
+	// EtcManagement is the expected /etc management model, either
+	// "ostree" or "traditional"
+	EtcManagement string `json:"etc-management"`
+	SELinux       *selinuxExpectation
+	KernelModules *kernelModulesExpectation `json:"kernel-modules"`
+	// VCPUs is the number of vCPUs of the qemu guest, the number of host
+	// CPUs is used if zero
+	VCPUs int `json:"vcpus"`
+	// Memory is the memory of the qemu guest in MiB, 1024 (2048 on aarch64)
+	// is used if zero
+	Memory int `json:"memory"`
+	// Machine is the qemu machine type, e.g. q35 or virt. The qemu default
+	// (virt on aarch64) is used if empty.
+	Machine string `json:"machine"`
+	// Kernel makes qemu boot this kernel directly instead of the bootloader
+	// of the image, for images without one. The path is relative to the
+	// directory with the built image.
+	Kernel string `json:"kernel"`
+	// Initrd is the initrd of the directly booted Kernel, relative to the
+	// directory with the built image
+	Initrd string `json:"initrd"`
+	// Cmdline is the command line of the directly booted Kernel, it must
+	// set the root filesystem
+	Cmdline string `json:"cmdline"`
+	// OnlineCPUs is the number of CPUs expected to be online in the guest
+	OnlineCPUs int `json:"online-cpus"`
+	Audit      *auditExpectation
+	// Upgrade upgrades the guest in place after all other checks
+	Upgrade *upgradeExpectation
+	// AWSImportMode chooses how the image uploaded to aws becomes an AMI,
+	// "snapshot" (the default) imports it as a snapshot like
+	// osbuild-composer, "image" uses the VM Import ImportImage task
+	AWSImportMode string `json:"aws-import-mode"`
+	// VerifyCloudInit waits for cloud-init to finish and fails if it
+	// reports an error, for images shipping cloud-init
+	VerifyCloudInit bool `json:"verify-cloud-init"`
+	// VerifySELinux fails if SELinux is not enforcing or if the filesystem
+	// is not labeled correctly
+	VerifySELinux bool `json:"verify-selinux"`
+	// VerifyFIPS fails if the guest doesn't run in FIPS mode, for images
+	// built with the fips customization
+	VerifyFIPS bool `json:"verify-fips"`
+	// CloudInitSecondBoot reboots the guest after all other checks and
+	// verifies how cloud-init behaved during the second boot
+	CloudInitSecondBoot *cloudInitSecondBootExpectation `json:"cloud-init-second-boot"`
+	// imageArch is the arch of the image, it's set by testImage because
+	// images built by remote builders don't match the current arch
+	imageArch string
+	// remoteImageInfo is set by testImage if the image info is collected
+	// in the booted instance because of -remote-image-info
+	remoteImageInfo *remoteImageInfoCheck
+}
+
+// manifestCommand describes an external tool that generates the manifest
+// on its standard output instead of it being inlined in the testcase
+type manifestCommand struct {
+	Command string
+	Args    []string
 }
 
+var reproducibilityCheck = flag.Bool("reproducibility-check", false, "when this flag is given, each image is built a second time and the image info and the file digests of both builds are compared")
+var depsolveOnly = flag.Bool("depsolve-only", false, "when this flag is given, the package sets of the test cases are only depsolved against their repositories and the manifest packages are checked to have a source, nothing is built")
+var buildOnly = flag.Bool("build-only", false, "when this flag is given, the images are only built and checked to exist, the image info and boot tests are skipped")
 var disableLocalBoot = flag.Bool("disable-local-boot", false, "when this flag is given, no images are booted locally using qemu (this does not affect testing in clouds)")
+var sshAttempts = flag.Int("ssh-attempts", 20, "the number of attempts to connect to an unreachable system using ssh")
+var sshInterval = flag.Duration("ssh-interval", 10*time.Second, "the delay between the attempts to connect using ssh")
+var sshTimeout = flag.Duration("ssh-timeout", 10*time.Second, "the timeout of a single attempt to connect using ssh")
+var slowCheckTimeout = flag.Duration("slow-check-timeout", 15*time.Minute, "the maximal duration of a slow command run in the guest, e.g. waiting for cloud-init or walking the whole filesystem, the other commands are limited to a minute")
+var sshStartingPatience = flag.Duration("ssh-starting-patience", 10*time.Minute, "how long to wait for a system that is reachable using ssh but still starting up")
+var imageCacheURL = flag.String("image-cache", "", "when this flag is given, output directories of the builds are looked up in and uploaded to the image cache server at this URL")
+var updateFixtures = flag.Bool("update-fixtures", false, "when this flag is given, the image info is not compared but written into the test cases instead")
+var qemuOverlay = flag.Bool("qemu-overlay", false, "when this flag is given, qemu boots images from a temporary qcow2 overlay so the built image stays untouched, the overlay is always used with -repeat")
+var targetAddress = flag.String("target-address", "", "when this flag is given, images are not booted, the boot tests are run against the already running machine at this address instead")
+var sshKeyType = flag.String("ssh-key-type", "rsa", "the type of the ssh key generated for logging into images booted in the clouds, rsa or ed25519")
+var targetPort = flag.Int("target-port", 22, "the ssh port of the machine given by -target-address")
+var targetUser = flag.String("target-user", defaultSSHUser, "the user used to log into the machine given by -target-address")
+var sshJump = flag.String("ssh-jump", "", "when this flag is given, images booted in the clouds are reached through this bastion host (user@host[:port]) using their private addresses")
+var sshJumpKey = flag.String("ssh-jump-key", "", "the private key used to log into the -ssh-jump host, the ssh client defaults are used if empty")
+var sshPrivateKey = flag.String("ssh-private-key", "", "the private key used to log into the machine given by -target-address, the key from the test data is used by default")
+var maxParallel = flag.Int("max-parallel", 1, "the maximal number of test cases run concurrently, the test cases are run serially by default (-test.parallel limits the concurrency too)")
+var maxCloudUploads = flag.Int("max-cloud-uploads", 1, "the maximal number of concurrent uploads to clouds")
+var targetDistro = flag.String("distro", "", "when this flag is given, only test cases valid for this distro are run")
+var hostDistro = flag.String("host-distro", "", "the distro of the host used to skip test cases that cannot be built on it (e.g. rhel-8), read from /etc/os-release by default")
+var filterDistro = flag.String("filter-distro", "", "when this flag is given, only test cases whose compose request distro matches this glob pattern are run")
+var filterArch = flag.String("filter-arch", "", "when this flag is given, only test cases whose compose request arch matches this glob pattern are run")
+var filterName = flag.String("filter-name", "", "when this flag is given, only test cases whose compose request filename matches this glob pattern are run")
+var credentialsPath = flag.String("credentials", "", "when this flag is given, the cloud credentials are read from this TOML or JSON file with a section per provider mapping the environment variables to their values, the environment takes precedence")
+var cleanup = flag.Bool("cleanup", false, "when this flag is given, nothing is tested, cloud resources leaked by previous runs to AWS, Azure and OpenStack are deleted instead")
+var cleanupAge = flag.Duration("cleanup-age", 24*time.Hour, "the minimal age of the leaked resources deleted by -cleanup")
+var extraRepos extraReposFlag
+var junitOutput = flag.String("junit-output", "", "when this flag is given, a JUnit XML report of the results is written to this file")
+var eventsOutput = flag.String("events-output", "", "when this flag is given, progress events are written to this file as newline-delimited JSON, - is the standard output and fd:N an open file descriptor")
+var timingOutput = flag.String("timing-output", "", "when this flag is given, the build, upload and boot-to-ssh durations of each test case are written to this file as JSON")
+var summaryJSON = flag.String("summary-json", "", "when this flag is given, a machine readable summary of the results is written to this file")
+var mergeSummaries = flag.String("merge-summaries", "", "when this flag is given, nothing is tested, the summary files given as arguments are merged into this file instead")
+var mergedJUnit = flag.String("merged-junit", "", "when this flag is given together with -merge-summaries, the merged results are also written to this file as JUnit XML")
+var prebuiltImage = flag.String("image", "", "when this flag is given, nothing is built or booted, image-info is run on this already built image and compared with -expected-info instead")
+var expectedInfo = flag.String("expected-info", "", "the test case or the image-info output the image given by -image is compared with")
+var qemuBinary = flag.String("qemu-binary", "", "when this flag is given, this qemu binary or wrapper is used instead of the default one for the architecture")
+var qemuArgsTemplate = flag.String("qemu-args-template", "", "when this flag is given, qemu is run with these whitespace-separated arguments, the {disk}, {netdev} and {serial} placeholders are replaced with the arguments managed by the harness")
+var noNetns = flag.Bool("no-netns", false, "when this flag is given, qemu boots images in the network namespace of the harness with user-mode networking forwarding a free localhost port to the guest, for runners without CAP_NET_ADMIN (the nspawn and pxe boot types still require a namespace)")
+var microVM = flag.Bool("microvm", false, "when this flag is given, qemu boots images in a microVM reachable using vsock instead of using a network namespace")
+var repeat = flag.Int("repeat", 1, "the number of times each test case is run, the pass/fail counts are reported at the end")
+var reuseImage = flag.Bool("reuse-image", false, "when this flag is given, the image of a test case repeated by -repeat is built only once and reused by all the runs")
+var replayDirectory = flag.String("replay", "", "when this flag is given, no images are built or booted, the image info assertions are run against the artifacts stored in this directory instead")
+var buildTimeout = flag.Duration("build-timeout", 60*time.Minute, "the maximal duration of a single osbuild run, osbuild is killed afterwards")
+var keepOnFailure = flag.Bool("keep-on-failure", false, "when this flag is given, the machine booted for a failed boot test is left running for debugging, the connection details are printed")
+var strictDegraded = flag.Bool("strict-degraded", false, "when this flag is given, the boot test fails if systemd reports the booted system as degraded")
+var logLevelName = flag.String("log-level", "info", "the minimal level of the harness messages, one of debug, info, warning or error")
+var streamOsbuild = flag.Bool("stream-osbuild", false, "when this flag is given, the osbuild output is printed while the image is being built, not only when the build fails")
+var persistentStore = flag.String("store", "", "when this flag is given, this directory is used as the osbuild store and kept after the run so the downloaded sources are reused, a temporary store is used by default. With -max-parallel, the concurrent builds use the stores STORE-parallel-N next to it.")
+var failFast = flag.Bool("fail-fast", false, "when this flag is given, the remaining test cases are skipped and the running ones are stopped once a test case fails")
+var remoteImageInfo = flag.Bool("remote-image-info", false, "when this flag is given, the image info of images booted in aws is collected by attaching the uploaded image as a second volume of the instance and running image-info over ssh, instead of running it locally")
+var costOutput = flag.String("cost-output", "", "when this flag is given, the instances booted in the clouds are written to this file as JSON with their runtime and estimated cost")
+var pricesPath = flag.String("prices", "", "when this flag is given, the instance prices in USD per hour are read from this TOML or JSON file, they override the built-in ones")
+var teardownWorkers = flag.Int("teardown-workers", 0, "when this flag is given, the images uploaded to clouds are deleted at the end of the run by this many concurrent workers instead of at the end of each test case")
+var snapshotStore = flag.Bool("snapshot-store", false, "when this flag is given, the store is copied before each build and restored from the copy if the build fails")
 
 // runOsbuild runs osbuild with the specified manifest and output-directory.
-func runOsbuild(manifest []byte, store, outputDirectory string) error {
+// The build is killed if it doesn't finish in -build-timeout.
+func runOsbuild(manifest []byte, env map[string]string, store, outputDirectory string, timings *caseTimings) error {
 	cmd := constants.GetOsbuildCommand(store, outputDirectory)
+	cmd.Env = osbuildEnv(env)
 
 	cmd.Stdin = bytes.NewReader(manifest)
 	var outBuffer bytes.Buffer
-	cmd.Stdout = &outBuffer
-	cmd.Stderr = &outBuffer
-
-	err := cmd.Run()
+	var output io.Writer = &outBuffer
+	if *streamOsbuild {
+		// the output is still captured for the pretty-printed error
+		output = io.MultiWriter(&outBuffer, os.Stdout)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// osbuild spawns helpers (e.g. for loop devices), run it in its own
+	// process group so all of them can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	err := cmd.Start()
 	if err != nil {
+		return fmt.Errorf("cannot start osbuild: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-time.After(*buildTimeout):
+		timedOut = true
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-done
+	case <-abortedRun.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return errAborted
+	}
+
+	if err != nil || timedOut {
 		// Pretty print the osbuild error output.
 		buf := new(bytes.Buffer)
 		_ = json.Indent(buf, outBuffer.Bytes(), "", "    ")
 		fmt.Println(buf)
 
+		if timedOut {
+			return fmt.Errorf("osbuild did not finish in %v and was killed", *buildTimeout)
+		}
 		return fmt.Errorf("running osbuild failed: %v", err)
 	}
 
+	timings.recordBuild(time.Since(start), parseStageTimings(outBuffer.Bytes()))
+
 	return nil
 }
 
-// testImageInfo runs image-info on image specified by imageImage and
-// compares the result with expected image info
-func testImageInfo(t *testing.T, imagePath string, rawImageInfoExpected []byte) {
-	var imageInfoExpected interface{}
-	err := json.Unmarshal(rawImageInfoExpected, &imageInfoExpected)
-	require.NoErrorf(t, err, "cannot decode expected image info: %#v", err)
+// generateManifest runs the manifest-generating command and returns its
+// output. The output must be valid JSON, a copy of it is stored in the output
+// directory as manifest.json.
+func generateManifest(mc *manifestCommand, outputDirectory string) ([]byte, error) {
+	if mc.Command == "" {
+		return nil, errors.New("manifest-command has no command specified")
+	}
+
+	cmd := exec.Command(mc.Command, mc.Args...)
+	cmd.Stderr = os.Stderr
+
+	manifest, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running the manifest command %s failed: %v", mc.Command, err)
+	}
+
+	if !json.Valid(manifest) {
+		return nil, fmt.Errorf("the manifest command %s did not produce a valid JSON", mc.Command)
+	}
+
+	err = ioutil.WriteFile(path.Join(outputDirectory, "manifest.json"), manifest, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write the generated manifest: %v", err)
+	}
+
+	return manifest, nil
+}
 
+// runImageInfo runs image-info on the image specified by imagePath
+// and returns its decoded output
+func runImageInfo(imagePath string) (interface{}, error) {
 	cmd := constants.GetImageInfoCommand(imagePath)
 	cmd.Stderr = os.Stderr
 	reader, writer := io.Pipe()
 	cmd.Stdout = writer
 
-	err = cmd.Start()
-	require.NoErrorf(t, err, "image-info cannot start: %#v", err)
+	err := cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("image-info cannot start: %#v", err)
+	}
 
-	var imageInfoGot interface{}
-	err = json.NewDecoder(reader).Decode(&imageInfoGot)
-	require.NoErrorf(t, err, "decoding image-info output failed: %#v", err)
+	var imageInfo interface{}
+	err = json.NewDecoder(reader).Decode(&imageInfo)
+	if err != nil {
+		return nil, fmt.Errorf("decoding image-info output failed: %#v", err)
+	}
 
 	err = cmd.Wait()
-	require.NoErrorf(t, err, "running image-info failed: %#v", err)
+	if err != nil {
+		return nil, fmt.Errorf("running image-info failed: %#v", err)
+	}
+
+	return imageInfo, nil
+}
+
+// compareImageInfo compares the image info with the expected one, the values
+// at the ignored paths are left out of both. If -update-fixtures is given,
+// the image info is written into the testcase file instead.
+func compareImageInfo(t *testing.T, testcasePath string, imageInfoGot interface{}, rawImageInfoExpected []byte, ignorePaths []string) {
+	var imageInfoExpected interface{}
+	err := json.Unmarshal(rawImageInfoExpected, &imageInfoExpected)
+	require.NoErrorf(t, err, "cannot decode expected image info: %#v", err)
+
+	if *updateFixtures {
+		err = updateImageInfoFixture(testcasePath, imageInfoGot)
+		require.NoError(t, err)
+		return
+	}
+
+	imageInfoExpected, err = withoutIgnoredPaths(imageInfoExpected, ignorePaths)
+	require.NoError(t, err)
+	imageInfoGot, err = withoutIgnoredPaths(imageInfoGot, ignorePaths)
+	require.NoError(t, err)
+
+	// the image info is huge, print only the differing parts
+	diff := cmp.Diff(imageInfoExpected, imageInfoGot)
+	if diff != "" {
+		t.Errorf("the image info differs from the expected one (-expected +got):\n%s", diff)
+	}
+}
+
+// testImageInfo runs image-info on image specified by imageImage and
+// compares the result with expected image info
+func testImageInfo(t *testing.T, testcasePath string, imagePath string, rawImageInfoExpected []byte, ignorePaths []string) {
+	imageInfoGot, err := runImageInfo(imagePath)
+	require.NoError(t, err)
 
-	assert.Equal(t, imageInfoExpected, imageInfoGot)
+	compareImageInfo(t, testcasePath, imageInfoGot, rawImageInfoExpected, ignorePaths)
 }
 
 type timeoutError struct{}
 
 func (*timeoutError) Error() string { return "" }
 
-// trySSHOnce tries to test the running image using ssh once
-// It returns timeoutError if ssh command returns 255, if it runs for more
-// that 10 seconds or if systemd-is-running returns starting.
-// It returns nil if systemd-is-running returns running or degraded.
-// It can also return other errors in other error cases.
-func trySSHOnce(address string, privateKey string, ns *netNS) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// startingError is returned when the ssh connection succeeded but the system
+// is still starting up
+type startingError struct{}
+
+func (*startingError) Error() string { return "" }
+
+// degradedError is returned when the system is up but systemd reports it
+// as degraded. It carries the diagnostics collected from the guest.
+type degradedError struct {
+	failedUnits string
+	journal     string
+}
+
+func (e *degradedError) Error() string {
+	return fmt.Sprintf("the system is degraded, failed units:\n%s\nerrors in the journal:\n%s", e.failedUnits, e.journal)
+}
+
+// degradedDiagnosticsMark separates the failed units from the journal in
+// the output of the ssh command run by trySSHOnce
+const degradedDiagnosticsMark = "--- journal ---"
+
+// defaultSSHUser is the user created by the cloud-init user-data
+const defaultSSHUser = "redhat"
+
+// bootSSHUser returns the user used to log into the image booted
+// according to boot
+func bootSSHUser(boot *bootStruct) string {
+	if boot.SSHUser != "" {
+		return boot.SSHUser
+	}
+
+	return defaultSSHUser
+}
+
+// sshKeyTypes are the key types accepted by -ssh-key-type and ssh-key-type
+var sshKeyTypes = []string{"rsa", "ed25519"}
+
+// validateSSHKeyType returns an error if keyType is not one of sshKeyTypes
+func validateSSHKeyType(keyType string) error {
+	for _, t := range sshKeyTypes {
+		if keyType == t {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown ssh key type %q, expected one of %s", keyType, strings.Join(sshKeyTypes, ", "))
+}
+
+// bootSSHKeyType returns the type of the key generated for logging into
+// the image booted according to boot
+func bootSSHKeyType(boot *bootStruct) string {
+	if boot.SSHKeyType != "" {
+		return boot.SSHKeyType
+	}
+
+	return *sshKeyType
+}
+
+// sshTarget describes how to connect to the booted image
+type sshTarget struct {
+	address string
+	// port defaults to 22
+	port int
+	// user defaults to defaultSSHUser
+	user       string
+	privateKey string
+	// ns is the network namespace to run the ssh client in, can be nil
+	ns *netNS
+	// vsockCID is the vsock context id of the guest, if set, the connection
+	// goes over vsock instead of the network
+	vsockCID uint32
+	// jumpHost is the bastion (user@host[:port]) the connection goes
+	// through, jumpKey is the private key used to log into it
+	jumpHost string
+	jumpKey  string
+	// failure returns an error if the machine is known to be unreachable,
+	// testSSH stops trying then, it can be nil
+	failure func() error
+}
+
+// cloudSSHTarget returns the target for an image booted in a cloud, it's
+// reached through -ssh-jump if given
+func cloudSSHTarget(address, privateKey string, boot *bootStruct) sshTarget {
+	return sshTarget{
+		address:    address,
+		user:       bootSSHUser(boot),
+		privateKey: privateKey,
+		jumpHost:   *sshJump,
+		jumpKey:    *sshJumpKey,
+	}
+}
+
+// jumpArgs returns the ssh arguments making the connection go through
+// the jump host. ProxyJump cannot use a different key for the jump host,
+// so a ProxyCommand is used if a key is given.
+func jumpArgs(jumpHost, jumpKey string) []string {
+	if jumpKey == "" {
+		return []string{"-J", jumpHost}
+	}
+
+	host := jumpHost
+	port := "22"
+	if i := strings.LastIndex(jumpHost, ":"); i != -1 {
+		host = jumpHost[:i]
+		port = jumpHost[i+1:]
+	}
+
+	proxyCommand := fmt.Sprintf("ssh -i %s -p %s -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -W %%h:%%p %s", jumpKey, port, host)
+	return []string{"-o", "ProxyCommand=" + proxyCommand}
+}
+
+// privateAddress reports whether the images booted in the clouds should be
+// reached using their private addresses, they don't need public ones then
+func privateAddress() bool {
+	return *sshJump != ""
+}
+
+// sshCommandContext returns an *exec.Cmd running the command in the image
+// booted at the target
+func sshCommandContext(ctx context.Context, target sshTarget, command string) *exec.Cmd {
+	user := target.user
+	if user == "" {
+		user = defaultSSHUser
+	}
+
+	port := target.port
+	if port == 0 {
+		port = 22
+	}
 
 	cmdName := "ssh"
 	cmdArgs := []string{
-		"-p", "22",
-		"-i", privateKey,
+		"-p", strconv.Itoa(port),
+		"-i", target.privateKey,
 		"-o", "StrictHostKeyChecking=no",
 		"-o", "UserKnownHostsFile=/dev/null",
-		"redhat@" + address,
-		"systemctl --wait is-system-running",
 	}
 
-	var cmd *exec.Cmd
+	if target.vsockCID != 0 {
+		cmdArgs = append(cmdArgs, "-o", fmt.Sprintf("ProxyCommand=socat - VSOCK-CONNECT:%d:22", target.vsockCID))
+	} else if target.jumpHost != "" {
+		cmdArgs = append(cmdArgs, jumpArgs(target.jumpHost, target.jumpKey)...)
+	}
+
+	cmdArgs = append(cmdArgs, user+"@"+target.address, command)
 
-	if ns != nil {
-		cmd = ns.NamespacedCommandContext(ctx, cmdName, cmdArgs...)
-	} else {
-		cmd = exec.CommandContext(ctx, cmdName, cmdArgs...)
+	if target.ns != nil {
+		return target.ns.NamespacedCommandContext(ctx, cmdName, cmdArgs...)
 	}
 
+	return exec.CommandContext(ctx, cmdName, cmdArgs...)
+}
+
+// trySSHOnce tries to test the running image using ssh once
+// It returns timeoutError if ssh command returns 255 or if it runs for more
+// that 10 seconds without connecting to the system.
+// It returns startingError if systemd-is-running returns starting or if
+// it's still waiting for the system to start after 10 seconds.
+// It returns nil if systemd-is-running returns running.
+// It returns degradedError if it returns degraded, the failed units and
+// the errors from the journal are collected using the same connection.
+// It can also return other errors in other error cases.
+func trySSHOnce(target sshTarget, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The echo tells us whether the connection was made if the command
+	// times out.
+	const connectedMark = "connected"
+	command := "echo " + connectedMark + "; " +
+		"state=$(systemctl --wait is-system-running); echo \"$state\"; " +
+		"if [ \"$state\" = degraded ]; then " +
+		"systemctl --failed --no-legend; " +
+		"echo '" + degradedDiagnosticsMark + "'; " +
+		"sudo -n journalctl -p err -b --no-pager || journalctl -p err -b --no-pager; " +
+		"fi"
+	cmd := sshCommandContext(ctx, target, command)
 	output, err := cmd.Output()
 
+	outputLines := strings.SplitN(strings.TrimSpace(string(output)), "\n", 3)
+	connected := outputLines[0] == connectedMark
+
 	if ctx.Err() == context.DeadlineExceeded {
+		if connected {
+			return &startingError{}
+		}
 		return &timeoutError{}
 	}
 
@@ -138,223 +607,1287 @@ func trySSHOnce(address string, privateKey string, ns *netNS) error {
 		}
 	}
 
-	outputString := strings.TrimSpace(string(output))
+	var outputString string
+	if len(outputLines) >= 2 {
+		outputString = strings.TrimSpace(outputLines[1])
+	}
+
 	switch outputString {
 	case "running":
 		return nil
 	case "degraded":
-		log.Print("ssh test passed, but the system is degraded")
-		return nil
+		var diagnostics string
+		if len(outputLines) == 3 {
+			diagnostics = outputLines[2]
+		}
+
+		parts := strings.SplitN(diagnostics, degradedDiagnosticsMark, 2)
+		degraded := &degradedError{failedUnits: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			degraded.journal = strings.TrimSpace(parts[1])
+		}
+		return degraded
 	case "starting":
-		return &timeoutError{}
+		return &startingError{}
 	default:
 		return fmt.Errorf("ssh test failed, system status is: %s", outputString)
 	}
 }
 
+// runSSHCommand runs the command in the booted image and returns its
+// standard output. It's meant to be used after testSSH passed.
+func runSSHCommand(target sshTarget, command string) (string, error) {
+	return runSSHCommandWithTimeout(target, command, time.Minute)
+}
+
+// runSSHCommandWithTimeout is runSSHCommand for long running commands
+func runSSHCommandWithTimeout(target sshTarget, command string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := sshCommandContext(ctx, target, command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return string(output), fmt.Errorf("running %q over ssh failed: %v\n%s", command, err, stderr.String())
+	}
+
+	return string(output), nil
+}
+
 // testSSH tests the running image using ssh.
-// It tries 20 attempts before giving up. If a major error occurs, it might
-// return earlier.
-func testSSH(t *testing.T, address string, privateKey string, ns *netNS) {
-	const attempts = 20
-	for i := 0; i < attempts; i++ {
-		err := trySSHOnce(address, privateKey, ns)
+// It tries -ssh-attempts attempts to connect before giving up. Once the system is
+// reachable but still starting, the attempts are no longer counted and
+// the function waits up to -ssh-starting-patience instead. If a major error
+// occurs, it might return earlier.
+func testSSH(t *testing.T, target sshTarget) {
+	attempts := *sshAttempts
+
+	state := "unreachable"
+	var startingSince time.Time
+
+	for i := 0; i < attempts; {
+		if target.failure != nil {
+			if err := target.failure(); err != nil {
+				t.Fatalf("ssh test failure, %v", err)
+			}
+		}
+
+		err := trySSHOnce(target, *sshTimeout)
 		if err == nil {
 			// pass the test
 			return
 		}
 
-		// if any other error than the timeout one happened, fail the test immediately
-		if _, ok := err.(*timeoutError); !ok {
+		switch err := err.(type) {
+		case *degradedError:
+			if *strictDegraded {
+				t.Errorf("ssh test failure, %v", err)
+			} else {
+				t.Logf("ssh test passed, but %v", err)
+			}
+			return
+		case *timeoutError:
+			if state != "unreachable" {
+				harnessLog.Infof("ssh: the system at %s went from %s to unreachable", target.address, state)
+				state = "unreachable"
+			}
+			i++
+		case *startingError:
+			if state != "starting" {
+				harnessLog.Infof("ssh: the system at %s went from %s to starting", target.address, state)
+				state = "starting"
+				startingSince = time.Now()
+			}
+			if time.Since(startingSince) > *sshStartingPatience {
+				t.Fatalf("ssh test failure, the system has been starting for more than %v", *sshStartingPatience)
+			}
+		default:
+			// if any other error than the timeout one happened, fail the test immediately
 			t.Fatal(err)
 		}
 
-		time.Sleep(10 * time.Second)
+		if runAborted() {
+			t.Skip(earlierFailureMessage)
+		}
+
+		time.Sleep(*sshInterval)
 	}
 
 	t.Errorf("ssh test failure, %d attempts were made", attempts)
 }
 
-func testBootUsingQemu(t *testing.T, imagePath string) {
-	if *disableLocalBoot {
-		t.Skip("local booting was disabled by -disable-local-boot, skipping")
-	}
-	err := withNetworkNamespace(func(ns netNS) error {
-		return withBootedQemuImage(imagePath, ns, func() error {
-			testSSH(t, "localhost", constants.TestPaths.PrivateKey, &ns)
-			return nil
-		})
-	})
-	require.NoError(t, err)
-}
+// rebootGuest reboots the guest and waits until it's up again. The boot id
+// is compared to make sure the guest really went through a reboot.
+func rebootGuest(t *testing.T, target sshTarget) {
+	const bootIDCommand = "cat /proc/sys/kernel/random/boot_id"
 
-func testBootUsingNspawnImage(t *testing.T, imagePath string) {
-	err := withNetworkNamespace(func(ns netNS) error {
-		return withBootedNspawnImage(imagePath, ns, func() error {
-			testSSH(t, "localhost", constants.TestPaths.PrivateKey, &ns)
-			return nil
-		})
-	})
+	bootID, err := runSSHCommand(target, bootIDCommand)
 	require.NoError(t, err)
-}
 
-func testBootUsingNspawnDirectory(t *testing.T, imagePath string) {
-	err := withNetworkNamespace(func(ns netNS) error {
-		return withExtractedTarArchive(imagePath, func(dir string) error {
-			return withBootedNspawnDirectory(dir, ns, func() error {
-				testSSH(t, "localhost", constants.TestPaths.PrivateKey, &ns)
-				return nil
-			})
-		})
-	})
-	require.NoError(t, err)
+	// the connection is usually dropped by the reboot, ignore the error
+	_, _ = runSSHCommand(target, "sudo systemctl reboot")
+
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		time.Sleep(10 * time.Second)
+
+		testSSH(t, target)
+		if t.Failed() {
+			return
+		}
+
+		newBootID, err := runSSHCommand(target, bootIDCommand)
+		if err == nil && newBootID != bootID {
+			return
+		}
+	}
+
+	t.Errorf("the guest did not reboot, %d attempts were made", attempts)
 }
 
-func testBootUsingAWS(t *testing.T, imagePath string) {
-	creds, err := getAWSCredentialsFromEnv()
-	require.NoError(t, err)
+// assertGuestCheck fails the test if the guest check failed. Skipped checks
+// are only logged.
+func assertGuestCheck(t *testing.T, err error) {
+	if skipErr, ok := err.(*checkSkippedError); ok {
+		t.Logf("guest check skipped: %s", skipErr.reason)
+		return
+	}
 
-	// if no credentials are given, fall back to qemu
-	if creds == nil {
-		log.Print("no AWS credentials given, falling back to booting using qemu")
-		testBootUsingQemu(t, imagePath)
+	assert.NoError(t, err)
+}
+
+// testBootedImage tests the booted image using ssh and then checks all
+// the expectations from the boot section of the testcase inside the guest.
+// Artifacts of the checks are stored in outputDirectory.
+func testBootedImage(t *testing.T, timings *caseTimings, boot *bootStruct, outputDirectory string, target sshTarget) {
+	// the machine was started just before this function is called
+	start := time.Now()
+	testSSH(t, target)
+	if t.Failed() {
 		return
+	}
+	timings.recordBootToSSH(time.Since(start))
 
+	runner := func(command string) (string, error) {
+		return runSSHCommand(target, command)
+	}
+	// slowRunner is used by the checks whose duration depends on the guest
+	// speed, e.g. on emulated architectures
+	slowRunner := func(command string) (string, error) {
+		return runSSHCommandWithTimeout(target, command, *slowCheckTimeout)
 	}
 
-	imageName, err := generateRandomString("osbuild-image-tests-image-")
-	require.NoError(t, err)
+	// the other checks might depend on the user data being applied
+	if boot.VerifyCloudInit {
+		err := checkCloudInit(slowRunner)
+		assertGuestCheck(t, err)
+	}
 
-	e, err := newEC2(creds)
-	require.NoError(t, err)
+	if boot.ExpectedKernel != "" {
+		err := checkKernelRelease(runner, boot.ExpectedKernel)
+		assertGuestCheck(t, err)
+	}
 
-	// the following line should be done by osbuild-composer at some point
-	err = uploadImageToAWS(creds, imagePath, imageName)
-	require.NoErrorf(t, err, "upload to amazon failed, resources could have been leaked")
+	if len(boot.SSHLogins) > 0 {
+		err := checkSSHLogins(target, boot.SSHLogins)
+		assertGuestCheck(t, err)
+	}
 
-	imageDesc, err := describeEC2Image(e, imageName)
-	require.NoErrorf(t, err, "cannot describe the ec2 image")
+	if boot.MountOptions != nil {
+		err := checkMountOptions(runner, boot.MountOptions)
+		assertGuestCheck(t, err)
+	}
 
-	// delete the image after the test is over
-	defer func() {
-		err = deleteEC2Image(e, imageDesc)
-		require.NoErrorf(t, err, "cannot delete the ec2 image, resources could have been leaked")
-	}()
+	if len(boot.CPUFlags) > 0 {
+		err := checkCPUFlags(runner, boot.CPUFlags)
+		assertGuestCheck(t, err)
+	}
 
-	// boot the uploaded image and try to connect to it
-	err = withSSHKeyPair(func(privateKey, publicKey string) error {
-		return withBootedImageInEC2(e, imageDesc, publicKey, func(address string) error {
-			testSSH(t, address, privateKey, nil)
-			return nil
-		})
-	})
-	require.NoError(t, err)
-}
+	if boot.OpenSCAP != nil {
+		err := checkOpenSCAP(target, boot.OpenSCAP, outputDirectory)
+		assertGuestCheck(t, err)
+	}
 
-func testBootUsingAzure(t *testing.T, imagePath string) {
-	creds, err := azuretest.GetAzureCredentialsFromEnv()
-	require.NoError(t, err)
+	if boot.Firewall != nil {
+		err := checkFirewall(runner, boot.Firewall)
+		assertGuestCheck(t, err)
+	}
 
-	// if no credentials are given, fall back to qemu
-	if creds == nil {
-		log.Print("no Azure credentials given, falling back to booting using qemu")
-		testBootUsingQemu(t, imagePath)
-		return
+	if boot.Sysctl != nil {
+		err := checkSysctl(runner, boot.Sysctl)
+		assertGuestCheck(t, err)
 	}
 
-	// create a random test id to name all the resources used in this test
-	testId, err := generateRandomString("")
-	require.NoError(t, err)
+	if boot.Files != nil {
+		err := checkFiles(runner, boot.Files)
+		assertGuestCheck(t, err)
+	}
 
-	imageName := "image-" + testId + ".vhd"
+	if boot.BuildInfo != nil {
+		err := checkBuildInfo(runner, boot.BuildInfo, outputDirectory)
+		assertGuestCheck(t, err)
+	}
 
-	// the following line should be done by osbuild-composer at some point
-	err = azuretest.UploadImageToAzure(creds, imagePath, imageName)
-	require.NoErrorf(t, err, "upload to azure failed, resources could have been leaked")
+	if boot.Integrity != nil {
+		err := checkIntegrity(runner, boot.Integrity)
+		assertGuestCheck(t, err)
+	}
 
-	// delete the image after the test is over
-	defer func() {
-		err = azuretest.DeleteImageFromAzure(creds, imageName)
-		require.NoErrorf(t, err, "cannot delete the azure image, resources could have been leaked")
-	}()
+	if boot.Repositories != nil {
+		err := checkRepositories(runner, boot.Repositories)
+		assertGuestCheck(t, err)
+	}
 
-	// boot the uploaded image and try to connect to it
-	err = withSSHKeyPair(func(privateKey, publicKey string) error {
-		return azuretest.WithBootedImageInAzure(creds, imageName, testId, publicKey, func(address string) error {
-			testSSH(t, address, privateKey, nil)
-			return nil
-		})
-	})
-	require.NoError(t, err)
-}
+	if boot.GPGKeys != nil {
+		err := checkGPGKeys(runner, boot.GPGKeys)
+		assertGuestCheck(t, err)
+	}
 
-func testBootUsingOpenStack(t *testing.T, imagePath string) {
-	creds, err := openstack.AuthOptionsFromEnv()
+	if boot.CryptoPolicy != "" {
+		err := checkCryptoPolicy(runner, boot.CryptoPolicy)
+		assertGuestCheck(t, err)
+	}
 
-	// if no credentials are given, fall back to qemu
-	if (creds == gophercloud.AuthOptions{}) {
-		log.Print("No OpenStack credentials given, falling back to booting using qemu")
-		testBootUsingQemu(t, imagePath)
-		return
+	if boot.VerifyFIPS {
+		err := checkFIPS(runner)
+		assertGuestCheck(t, err)
 	}
-	require.NoError(t, err)
 
-	// provider is the top-level client that all OpenStack services derive from
-	provider, err := openstack.AuthenticatedClient(creds)
-	require.NoError(t, err)
+	if boot.EtcManagement != "" {
+		err := checkEtcManagement(runner, boot.EtcManagement)
+		assertGuestCheck(t, err)
+	}
 
-	// create a random test id to name all the resources used in this test
-	imageName, err := generateRandomString("osbuild-image-tests-openstack-image-")
-	require.NoError(t, err)
+	if boot.SELinux != nil {
+		err := checkSELinux(runner, boot.SELinux)
+		assertGuestCheck(t, err)
+	}
 
-	// the following line should be done by osbuild-composer at some point
-	image, err := openstacktest.UploadImageToOpenStack(provider, imagePath, imageName)
-	require.NoErrorf(t, err, "Upload to OpenStack failed, resources could have been leaked")
-	require.NotNil(t, image)
+	if boot.VerifySELinux {
+		err := checkSELinuxEnforcing(slowRunner)
+		assertGuestCheck(t, err)
+	}
 
-	// delete the image after the test is over
-	defer func() {
-		err = openstacktest.DeleteImageFromOpenStack(provider, image.ID)
-		require.NoErrorf(t, err, "Cannot delete OpenStack image, resources could have been leaked")
-	}()
+	if boot.KernelModules != nil {
+		err := checkKernelModules(runner, boot.KernelModules)
+		assertGuestCheck(t, err)
+	}
 
-	// boot the uploaded image and try to connect to it
-	err = withSSHKeyPair(func(privateKey, publicKey string) error {
-		userData, err := createUserData(publicKey)
-		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+	if boot.OnlineCPUs != 0 {
+		err := checkOnlineCPUs(runner, boot.OnlineCPUs)
+		assertGuestCheck(t, err)
+	}
 
-		return openstacktest.WithBootedImageInOpenStack(provider, image.ID, userData, func(address string) error {
-			testSSH(t, address, privateKey, nil)
-			return nil
+	if boot.Audit != nil {
+		err := checkAudit(runner, boot.Audit)
+		assertGuestCheck(t, err)
+	}
+
+	if boot.CloudInitSecondBoot != nil {
+		rebootGuest(t, target)
+		if t.Failed() {
+			return
+		}
+
+		err := checkCloudInitSecondBoot(runner, boot.CloudInitSecondBoot)
+		assertGuestCheck(t, err)
+	}
+
+	if boot.Upgrade != nil {
+		testUpgrade(t, target, boot.Upgrade)
+	}
+}
+
+// logConsoleOnFailure logs the end of the guest console if the test failed,
+// it's meant to be deferred so it runs even after t.Fatal
+func logConsoleOnFailure(t *testing.T, consoleLog string) {
+	if t.Failed() {
+		t.Logf("the end of the guest console:\n%s", tailFile(consoleLog, consoleLogLines))
+	}
+}
+
+// bootArtifactPath returns the path of an artifact given relative to the
+// directory with the built image, an empty name is returned unchanged
+func bootArtifactPath(imagePath, name string) string {
+	if name == "" || path.IsAbs(name) {
+		return name
+	}
+
+	return path.Join(path.Dir(imagePath), name)
+}
+
+func testBootUsingQemu(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	if *disableLocalBoot {
+		t.Skip("local booting was disabled by -disable-local-boot, skipping")
+	}
+	skipIfNoLocalBoot(t, boot)
+
+	if len(boot.CPUFlags) > 0 {
+		skipIfHostLacksCPUFlags(t, boot.CPUFlags)
+	}
+
+	require.NoError(t, validateQemuImageFormat(boot.Format), "invalid format")
+
+	opts := qemuOptions{
+		CPU:          boot.CPUModel,
+		Overlay:      useQemuOverlay(*qemuOverlay, *repeat),
+		SMP:          boot.VCPUs,
+		Binary:       *qemuBinary,
+		ArgsTemplate: *qemuArgsTemplate,
+		Format:       boot.Format,
+		Logger:       logger,
+		Memory:       boot.Memory,
+		Machine:      boot.Machine,
+		Kernel:       bootArtifactPath(imagePath, boot.Kernel),
+		Initrd:       bootArtifactPath(imagePath, boot.Initrd),
+		Cmdline:      boot.Cmdline,
+	}
+	require.NoError(t, opts.validate(), "invalid qemu resources in the boot section")
+	for _, artifact := range []string{opts.Kernel, opts.Initrd} {
+		if artifact != "" {
+			_, err := os.Stat(artifact)
+			require.NoError(t, err, "the direct boot artifact is missing")
+		}
+	}
+
+	var privateKey string
+	testVM := func(vm *qemuVM, target sshTarget) error {
+		defer logConsoleOnFailure(t, vm.SerialLog)
+		defer func() {
+			if keepAlive(t) {
+				vm.KeepRunning()
+				// the network namespace is deleted, enter it using the qemu process
+				prefix := ""
+				if target.ns != nil {
+					prefix = fmt.Sprintf("nsenter --net=/proc/%d/ns/net", vm.Pid)
+					target.ns = nil
+				}
+				reportKeptMachine(t, target, prefix, fmt.Sprintf("qemu pid %d", vm.Pid))
+			}
+		}()
+
+		target.user = bootSSHUser(boot)
+		target.privateKey = privateKey
+		target.failure = vm.Failure
+		testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+
+		if boot.ShutdownTimeout != "" && !t.Failed() {
+			testShutdown(t, boot.ShutdownTimeout, target, vm)
+		}
+		return nil
+	}
+
+	// the key is injected using cloud-init like in the clouds, so a broken
+	// key injection fails locally too
+	err := withSSHKeyPair(bootSSHKeyType(boot), func(generatedPrivateKey, publicKey string) error {
+		privateKey = generatedPrivateKey
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		if err != nil {
+			return err
+		}
+		opts.UserData = userData
+
+		return withDecompressedImage(imagePath, func(image string) error {
+			if *microVM {
+				return withBootedMicroVM(image, opts, testVM)
+			}
+
+			if *noNetns {
+				return withBootedQemuImage(image, "", opts, func(vm *qemuVM) error {
+					return testVM(vm, sshTarget{address: "127.0.0.1", port: vm.SSHPort})
+				})
+			}
+
+			err := withNetworkNamespace(func(ns netNS) error {
+				return withBootedQemuImage(image, ns, opts, func(vm *qemuVM) error {
+					return testVM(vm, sshTarget{address: "localhost", port: vm.SSHPort, ns: &ns})
+				})
+			})
+			if _, ok := err.(*netnsError); ok {
+				t.Logf("%v, falling back to a microVM reachable using vsock, pass -microvm to skip this attempt", err)
+				err = withBootedMicroVM(image, opts, testVM)
+			}
+			return err
+		})
+	})
+	require.NoError(t, err)
+}
+
+// testShutdown powers the guest off and checks that qemu exits in
+// the timeout. The end of the serial console is logged if it doesn't.
+func testShutdown(t *testing.T, timeout string, target sshTarget, vm *qemuVM) {
+	shutdownTimeout, err := time.ParseDuration(timeout)
+	require.NoErrorf(t, err, "invalid shutdown-timeout %s", timeout)
+
+	start := time.Now()
+
+	// the connection is usually dropped by the shutdown, ignore the error
+	_, _ = runSSHCommand(target, "sudo systemctl poweroff")
+
+	if !vm.WaitForExit(shutdownTimeout) {
+		t.Errorf("the guest did not power off in %v, the end of the serial console:\n%s", shutdownTimeout, tailFile(vm.SerialLog, consoleLogLines))
+		return
+	}
+
+	t.Logf("the guest powered off in %v", time.Since(start))
+}
+
+func testBootUsingNspawnImage(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	// nspawn finds the root only in images with a single partition or
+	// in images following the discoverable partitions specification,
+	// mount the partitions of the other images according to their fstab
+	partitions, err := imagePartitionCount(imagePath)
+	require.NoError(t, err)
+	if partitions > 1 {
+		testBootUsingNspawnMountedImage(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	err = withNetworkNamespace(func(ns netNS) error {
+		return withBootedNspawnImage(imagePath, ns, func(consoleLog string) error {
+			defer logConsoleOnFailure(t, consoleLog)
+			testBootedImage(t, timings, boot, path.Dir(imagePath), sshTarget{address: "localhost", user: bootSSHUser(boot), privateKey: constants.TestPaths.PrivateKey, ns: &ns})
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingNspawnMountedImage(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	logger.Debugf("booting the partitions of %s mounted according to its fstab", imagePath)
+	err := withNetworkNamespace(func(ns netNS) error {
+		return withMountedImage(imagePath, func(dir string) error {
+			// the partitions are mounted read-only
+			return withBootedNspawnDirectory(dir, ns, true, func(consoleLog string) error {
+				defer logConsoleOnFailure(t, consoleLog)
+				testBootedImage(t, timings, boot, path.Dir(imagePath), sshTarget{address: "localhost", user: bootSSHUser(boot), privateKey: constants.TestPaths.PrivateKey, ns: &ns})
+				return nil
+			})
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingNspawnDirectory(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	err := withNetworkNamespace(func(ns netNS) error {
+		return withExtractedTarArchive(imagePath, func(dir string) error {
+			return withBootedNspawnDirectory(dir, ns, false, func(consoleLog string) error {
+				defer logConsoleOnFailure(t, consoleLog)
+				testBootedImage(t, timings, boot, path.Dir(imagePath), sshTarget{address: "localhost", user: bootSSHUser(boot), privateKey: constants.TestPaths.PrivateKey, ns: &ns})
+				return nil
+			})
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingContainer(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	if *disableLocalBoot {
+		t.Skip("local booting was disabled by -disable-local-boot, skipping")
+	}
+
+	keep := func() bool { return keepAlive(t) }
+	err := withLoadedContainerImage(imagePath, keep, func(image string) error {
+		return withRunningContainer(image, keep, func(id string, port int) error {
+			target := sshTarget{address: "localhost", port: port, user: bootSSHUser(boot), privateKey: constants.TestPaths.PrivateKey}
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "podman container "+id)
+				}
+			}()
+
+			logger.Debugf("the container %s publishes ssh on localhost:%d", id, port)
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+// uploadAttempts and uploadBackoff configure the retries of cloud uploads
+// failing because of network or server-side errors. The uploads to AWS,
+// OpenStack, DigitalOcean and the S3 upload test are retried. The uploads
+// to GCP, VMware, IBM Cloud and OCI run the command line tools of the
+// clouds, whose failures carry no status code telling a transient one.
+// Hetzner Cloud images are written by a temporary server, retrying it
+// would mean creating another one, and the Azure upload keeps no status
+// code either, see testBootUsingAzure.
+const uploadAttempts = 3
+const uploadBackoff = 5 * time.Second
+
+// cloudUploads limits the number of concurrent cloud uploads, it's
+// initialized in TestImages
+var cloudUploads semaphore
+
+// withCloudUploadSlot runs the upload function f once the number of
+// concurrent cloud uploads allows it
+func withCloudUploadSlot(t *testing.T, timings *caseTimings, f func() error) error {
+	if !cloudUploads.tryAcquire() {
+		t.Logf("waiting for one of %d cloud upload slots", cap(cloudUploads))
+		cloudUploads.acquire()
+	}
+	defer cloudUploads.release()
+
+	start := time.Now()
+	err := f()
+	if err == nil {
+		timings.recordUpload(time.Since(start))
+	}
+	return err
+}
+
+func testBootUsingPXE(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	if *disableLocalBoot {
+		t.Skip("local booting was disabled by -disable-local-boot, skipping")
+	}
+	skipIfNoLocalBoot(t, boot)
+	require.NotNil(t, boot.PXE, "the pxe boot type requires the pxe section")
+	require.NotEmpty(t, boot.PXE.Kernel, "the pxe boot type requires a kernel")
+	require.NotEmpty(t, boot.PXE.Initrd, "the pxe boot type requires an initrd")
+
+	memory := boot.Memory
+	if memory == 0 {
+		memory = defaultQemuMemory()
+	}
+
+	outputDirectory := path.Dir(imagePath)
+	err := withNetworkNamespace(func(ns netNS) error {
+		return withBootedPXEImage(outputDirectory, *boot.PXE, memory, ns, func(vm *qemuVM) error {
+			defer logConsoleOnFailure(t, vm.SerialLog)
+
+			target := sshTarget{address: "localhost", port: vm.SSHPort, user: bootSSHUser(boot), privateKey: constants.TestPaths.PrivateKey, ns: &ns}
+			target.failure = vm.Failure
+			testBootedImage(t, timings, boot, outputDirectory, target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingAWS(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	require.NoError(t, validateAWSImportMode(boot.AWSImportMode), "invalid aws-import-mode")
+
+	creds, err := getAWSCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no AWS credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+
+	}
+
+	imageName, err := generateRandomString(resourcePrefix + "image-")
+	require.NoError(t, err)
+
+	e, err := newEC2(creds)
+	require.NoError(t, err)
+
+	// the following line should be done by osbuild-composer at some point
+	// the upload is retried by uploadImageToAWS
+	err = withCloudUploadSlot(t, timings, func() error {
+		return uploadImageToAWS(creds, imagePath, imageName, boot.AWSImportMode)
+	})
+	require.NoErrorf(t, err, "upload to amazon failed, resources could have been leaked")
+
+	imageDesc, err := describeEC2Image(e, imageName)
+	require.NoErrorf(t, err, "cannot describe the ec2 image")
+
+	// delete the image after the test is over
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the ec2 image "+imageName, func() error {
+			return deleteEC2Image(e, imageDesc)
+		})
+	}()
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		start := time.Now()
+		defer recordInstanceUsage(t, "aws", ec2InstanceType, creds.Region, start)
+
+		return withBootedImageInEC2(e, imageDesc, publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot), privateAddress(), keep, func(instanceId, address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the aws instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+
+			if boot.remoteImageInfo != nil && !t.Failed() {
+				testRemoteImageInfo(t, e, instanceId, imageDesc, target, boot.remoteImageInfo)
+			}
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingAzure(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := azuretest.GetAzureCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no Azure credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	if len(bootExtraSSHKeys(boot)) > 0 {
+		logger.Infof("the extra ssh keys are not authorized in azure, only the generated key is")
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId + ".vhd"
+
+	// the following line should be done by osbuild-composer at some point
+	// the upload is not retried, internal/upload/azure doesn't keep the
+	// errors of azblob, whose pipeline retries the failed requests itself
+	err = withCloudUploadSlot(t, timings, func() error {
+		return azuretest.UploadImageToAzure(creds, imagePath, imageName)
+	})
+	require.NoErrorf(t, err, "upload to azure failed, resources could have been leaked")
+
+	// delete the image after the test is over
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the azure image "+imageName, func() error {
+			return azuretest.DeleteImageFromAzure(creds, imageName)
+		})
+	}()
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		start := time.Now()
+		defer recordInstanceUsage(t, "azure", azuretest.VMSize, creds.Location, start)
+
+		return azuretest.WithBootedImageInAzure(creds, imageName, testId, publicKey, bootSSHUser(boot), privateAddress(), keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the azure instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingGCP(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := gcptest.GetGCPCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no GCP credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	// the following line should be done by osbuild-composer at some point
+	err = withCloudUploadSlot(t, timings, func() error {
+		return gcptest.UploadImageToGCP(creds, imagePath, imageName)
+	})
+	require.NoErrorf(t, err, "upload to gcp failed, resources could have been leaked")
+
+	// delete the image after the test is over
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the gcp image "+imageName, func() error {
+			return gcptest.DeleteImageFromGCP(creds, imageName)
+		})
+	}()
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		start := time.Now()
+		defer recordInstanceUsage(t, "gcp", creds.MachineType, creds.Zone, start)
+
+		return gcptest.WithBootedImageInGCP(creds, imageName, testId, publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot), privateAddress(), keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the gcp instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingOpenStack(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := openstack.AuthOptionsFromEnv()
+
+	// if no credentials are given, fall back to qemu
+	if (creds == gophercloud.AuthOptions{}) {
+		logger.Infof("no OpenStack credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+	require.NoError(t, err)
+
+	// provider is the top-level client that all OpenStack services derive from
+	provider, err := openstack.AuthenticatedClient(creds)
+	require.NoError(t, err)
+
+	// create a random test id to name all the resources used in this test
+	imageName, err := generateRandomString(resourcePrefix + "openstack-image-")
+	require.NoError(t, err)
+
+	// the following line should be done by osbuild-composer at some point
+	var image *images.Image
+	err = withCloudUploadSlot(t, timings, func() error {
+		return retryWithBackoff(uploadAttempts, uploadBackoff, func() error {
+			var err error
+			image, err = openstacktest.UploadImageToOpenStack(provider, imagePath, imageName)
+			if err != nil && image != nil {
+				// the next attempt creates a new image
+				deleteErr := openstacktest.DeleteImageFromOpenStack(provider, image.ID)
+				if deleteErr != nil {
+					logger.Warningf("cannot delete the partially uploaded image %s, it could have been leaked: %v", image.ID, deleteErr)
+				}
+				image = nil
+			}
+			return err
+		})
+	})
+	require.NoErrorf(t, err, "Upload to OpenStack failed, resources could have been leaked")
+	require.NotNil(t, image)
+
+	// delete the image after the test is over
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the openstack image "+image.ID, func() error {
+			return openstacktest.DeleteImageFromOpenStack(provider, image.ID)
+		})
+	}()
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+		opts := openstacktest.InstanceOptionsFromEnv()
+		start := time.Now()
+		defer recordInstanceUsage(t, "openstack", opts.Flavor, os.Getenv("OS_REGION_NAME"), start)
+
+		return openstacktest.WithBootedImageInOpenStack(provider, image.ID, userData, opts, keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the openstack instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingVMware(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := vmwaretest.GetVMwareCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no VMware credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	// the following line should be done by osbuild-composer at some point
+	err = withCloudUploadSlot(t, timings, func() error {
+		return vmwaretest.UploadImageToVMware(creds, imagePath, imageName)
+	})
+	require.NoErrorf(t, err, "upload to vmware failed, resources could have been leaked")
+
+	// delete the image after the test is over
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the vmware image "+imageName, func() error {
+			return vmwaretest.DeleteImageFromVMware(creds, imageName)
+		})
+	}()
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+		start := time.Now()
+		defer recordInstanceUsage(t, "vmware", "", creds.Datacenter, start)
+
+		return vmwaretest.WithBootedImageInVMware(creds, imageName, testId, userData, keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the vmware instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingIBMCloud(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := ibmtest.GetIBMCloudCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no IBM Cloud credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	err = ibmtest.WithIBMCloudSession(creds, func() error {
+		// the following line should be done by osbuild-composer at some point
+		err := withCloudUploadSlot(t, timings, func() error {
+			return ibmtest.UploadImageToIBMCloud(creds, imagePath, imageName)
+		})
+		require.NoErrorf(t, err, "upload to ibmcloud failed, resources could have been leaked")
+
+		// delete the image after the test is over
+		defer func() {
+			if keepAlive(t) {
+				t.Log("keeping the uploaded image for the machine left running")
+				return
+			}
+
+			// the deletion might run after this session is over, it logs
+			// in again using a copy of the credentials
+			sessionCreds := *creds
+			teardownCloudResource(t, "the ibmcloud image "+imageName, func() error {
+				return ibmtest.WithIBMCloudSession(&sessionCreds, func() error {
+					return ibmtest.DeleteImageFromIBMCloud(&sessionCreds, imageName)
+				})
+			})
+		}()
+
+		keep := func() bool {
+			return keepAlive(t)
+		}
+
+		// boot the uploaded image and try to connect to it
+		return withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+			userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+			require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+			start := time.Now()
+			defer recordInstanceUsage(t, "ibmcloud", creds.Profile, creds.Region, start)
+
+			return ibmtest.WithBootedImageInIBMCloud(creds, imageName, testId, publicKey, userData, privateAddress(), keep, func(address string) error {
+				target := cloudSSHTarget(address, privateKey, boot)
+				defer func() {
+					if keepAlive(t) {
+						reportKeptMachine(t, target, "", "the ibmcloud instance at "+address)
+					}
+				}()
+				testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+				return nil
+			})
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingDigitalOcean(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := dotest.GetDigitalOceanCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no DigitalOcean credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	// the following line should be done by osbuild-composer at some point
+	var imageID int
+	err = withCloudUploadSlot(t, timings, func() error {
+		return retryWithBackoff(uploadAttempts, uploadBackoff, func() error {
+			var err error
+			imageID, err = dotest.UploadImageToDigitalOcean(creds, imagePath, imageName)
+			if err != nil && imageID != 0 {
+				// the next attempt imports a new image, the object is
+				// uploaded again under the same key
+				deleteErr := dotest.DeleteImageFromDigitalOcean(creds, imagePath, imageName, imageID)
+				if deleteErr != nil {
+					logger.Warningf("cannot delete the partially imported image %d, it could have been leaked: %v", imageID, deleteErr)
+				}
+				imageID = 0
+			}
+			return err
+		})
+	})
+
+	// delete the image after the test is over, the uploaded object exists
+	// even if the import failed
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the digitalocean image "+imageName, func() error {
+			return dotest.DeleteImageFromDigitalOcean(creds, imagePath, imageName, imageID)
+		})
+	}()
+
+	require.NoErrorf(t, err, "upload to digitalocean failed, resources could have been leaked")
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+		start := time.Now()
+		defer recordInstanceUsage(t, "digitalocean", creds.Size, creds.Region, start)
+
+		return dotest.WithBootedImageInDigitalOcean(creds, imageID, testId, publicKey, userData, privateAddress(), keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the digitalocean droplet at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingHetzner(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := hetznertest.GetHetznerCredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no Hetzner credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	// the following line should be done by osbuild-composer at some point
+	var imageID int
+	err = withCloudUploadSlot(t, timings, func() error {
+		// the key pair is used to log into the rescue system writing the
+		// image
+		return withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+			var err error
+			imageID, err = hetznertest.UploadImageToHetzner(creds, imagePath, imageName, publicKey, privateKey)
+			return err
+		})
+	})
+
+	// delete the snapshot after the test is over, it might exist even if
+	// the upload failed
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the hetzner snapshot "+imageName, func() error {
+			return hetznertest.DeleteImageFromHetzner(creds, imageID)
+		})
+	}()
+
+	require.NoErrorf(t, err, "upload to hetzner failed, resources could have been leaked")
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+		start := time.Now()
+		defer recordInstanceUsage(t, "hetzner", creds.ServerType, creds.Location, start)
+
+		return hetznertest.WithBootedImageInHetzner(creds, imageID, testId, publicKey, userData, privateAddress(), keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the hetzner server at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testBootUsingOCI(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	creds, err := ocitest.GetOCICredentialsFromEnv()
+	require.NoError(t, err)
+
+	// if no credentials are given, fall back to qemu
+	if creds == nil {
+		logger.Infof("no Oracle Cloud credentials given, falling back to booting using qemu")
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	// create a random test id to name all the resources used in this test
+	testId, err := generateRandomString("")
+	require.NoError(t, err)
+
+	imageName := resourcePrefix + "image-" + testId
+
+	// the following line should be done by osbuild-composer at some point
+	var imageID string
+	err = withCloudUploadSlot(t, timings, func() error {
+		var err error
+		imageID, err = ocitest.UploadImageToOCI(creds, imagePath, imageName)
+		return err
+	})
+
+	// delete the image after the test is over, the uploaded object exists
+	// even if the import failed
+	defer func() {
+		if keepAlive(t) {
+			t.Log("keeping the uploaded image for the machine left running")
+			return
+		}
+
+		teardownCloudResource(t, "the oci image "+imageName, func() error {
+			return ocitest.DeleteImageFromOCI(creds, imageName, imageID)
+		})
+	}()
+
+	require.NoErrorf(t, err, "upload to oci failed, resources could have been leaked")
+
+	keep := func() bool {
+		return keepAlive(t)
+	}
+
+	// boot the uploaded image and try to connect to it
+	err = withSSHKeyPair(bootSSHKeyType(boot), func(privateKey, publicKey string) error {
+		userData, err := createUserData(publicKey, bootSSHUser(boot), bootExtraSSHKeys(boot))
+		require.NoErrorf(t, err, "Creating user data failed: %v", err)
+
+		start := time.Now()
+		defer recordInstanceUsage(t, "oci", creds.Shape, creds.Region, start)
+
+		return ocitest.WithBootedImageInOCI(creds, imageID, testId, publicKey, userData, privateAddress(), keep, func(address string) error {
+			target := cloudSSHTarget(address, privateKey, boot)
+			defer func() {
+				if keepAlive(t) {
+					reportKeptMachine(t, target, "", "the oci instance at "+address)
+				}
+			}()
+			testBootedImage(t, timings, boot, path.Dir(imagePath), target)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+}
+
+// testUploadUsingS3 uploads the image to an S3-compatible object storage and
+// verifies the uploaded object, nothing is booted
+func testUploadUsingS3(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string) {
+	creds, err := s3test.GetS3CredentialsFromEnv()
+	require.NoError(t, err)
+
+	if creds == nil {
+		t.Skip("no S3 credentials given, skipping the upload test")
+	}
+
+	key, err := generateRandomString(resourcePrefix + "image-")
+	require.NoError(t, err)
+	key += path.Ext(imagePath)
+
+	err = withCloudUploadSlot(t, timings, func() error {
+		return retryWithBackoff(uploadAttempts, uploadBackoff, func() error {
+			return s3test.UploadImageToS3(creds, imagePath, key)
 		})
 	})
+
+	// delete the object after the test is over, a failed upload might
+	// have created it too
+	defer func() {
+		teardownCloudResource(t, "the s3 object "+key, func() error {
+			return s3test.DeleteImageFromS3(creds, key)
+		})
+	}()
+
+	require.NoErrorf(t, err, "upload to s3 failed, resources could have been leaked")
+
+	logger.Debugf("uploaded the image to %s/%s/%s", creds.Endpoint, creds.Bucket, key)
+	err = s3test.VerifyImageInS3(creds, imagePath, key)
 	require.NoError(t, err)
 }
 
+// testBootUsingTarget runs the boot test against the machine given
+// by -target-address instead of booting the image
+func testBootUsingTarget(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	privateKey := *sshPrivateKey
+	if privateKey == "" {
+		privateKey = constants.TestPaths.PrivateKey
+	}
+
+	t.Logf("not booting the image, testing the running machine at %s instead", *targetAddress)
+	testBootedImage(t, timings, boot, path.Dir(imagePath), sshTarget{
+		address:    *targetAddress,
+		port:       *targetPort,
+		user:       *targetUser,
+		privateKey: privateKey,
+	})
+}
+
 // testBoot tests if the image is able to successfully boot
-// Before the test it boots the image respecting the specified bootType.
+// Before the test it boots the image respecting the specified boot type.
 // The test passes if the function is able to connect to the image via ssh
-// in defined number of attempts and systemd-is-running returns running
-// or degraded status.
-func testBoot(t *testing.T, imagePath string, bootType string) {
-	switch bootType {
+// in defined number of attempts, systemd-is-running returns running
+// or degraded status and all the expectations from the boot section hold.
+func testBoot(t *testing.T, logger *leveledLogger, timings *caseTimings, imagePath string, boot *bootStruct) {
+	if *targetAddress != "" {
+		testBootUsingTarget(t, logger, timings, imagePath, boot)
+		return
+	}
+
+	require.NoError(t, validateSSHKeyType(bootSSHKeyType(boot)), "invalid ssh-key-type")
+
+	switch boot.Type {
 	case "qemu":
-		testBootUsingQemu(t, imagePath)
+		testBootUsingQemu(t, logger, timings, imagePath, boot)
 
 	case "nspawn":
-		testBootUsingNspawnImage(t, imagePath)
+		testBootUsingNspawnImage(t, logger, timings, imagePath, boot)
 
 	case "nspawn-extract":
-		testBootUsingNspawnDirectory(t, imagePath)
+		testBootUsingNspawnDirectory(t, logger, timings, imagePath, boot)
+
+	case "container":
+		testBootUsingContainer(t, logger, timings, imagePath, boot)
+
+	case "pxe":
+		testBootUsingPXE(t, logger, timings, imagePath, boot)
 
 	case "aws":
-		testBootUsingAWS(t, imagePath)
+		testBootUsingAWS(t, logger, timings, imagePath, boot)
 
 	case "azure":
-		testBootUsingAzure(t, imagePath)
+		testBootUsingAzure(t, logger, timings, imagePath, boot)
 
 	case "openstack":
-		testBootUsingOpenStack(t, imagePath)
+		testBootUsingOpenStack(t, logger, timings, imagePath, boot)
+
+	case "gcp":
+		testBootUsingGCP(t, logger, timings, imagePath, boot)
+
+	case "vmware":
+		testBootUsingVMware(t, logger, timings, imagePath, boot)
+
+	case "ibmcloud":
+		testBootUsingIBMCloud(t, logger, timings, imagePath, boot)
+
+	case "digitalocean":
+		testBootUsingDigitalOcean(t, logger, timings, imagePath, boot)
+
+	case "oci-oracle":
+		testBootUsingOCI(t, logger, timings, imagePath, boot)
+
+	case "hetzner":
+		testBootUsingHetzner(t, logger, timings, imagePath, boot)
+
+	case "s3-upload-only":
+		testUploadUsingS3(t, logger, timings, imagePath)
 
 	default:
 		panic("unknown boot type!")
@@ -376,44 +1909,434 @@ func kvmAvailable() bool {
 	}
 }
 
+// localBootSkipReason returns why images of the arch cannot be booted
+// locally in qemu, or an empty string if they can. Without KVM, qemu
+// falls back to TCG which is too slow to boot an image in a reasonable time.
+func localBootSkipReason(imageArch string) string {
+	arch := common.CurrentArch()
+	// images built by a remote builder might have a different arch
+	if imageArch != "" && imageArch != arch {
+		return fmt.Sprintf("booting %s images locally on %s is not supported, use a cloud boot type", imageArch, arch)
+	}
+
+	switch arch {
+	case "x86_64":
+		return ""
+	case "aarch64":
+		if !kvmAvailable() {
+			return "KVM is not available on aarch64"
+		}
+		return ""
+	default:
+		return fmt.Sprintf("booting %s images locally in qemu is not supported, use a cloud boot type", arch)
+	}
+}
+
+// skipIfNoLocalBoot skips the boot test if images cannot be booted locally
+// in qemu on the current arch
+func skipIfNoLocalBoot(t *testing.T, boot *bootStruct) {
+	if reason := localBootSkipReason(boot.imageArch); reason != "" {
+		t.Skipf("%s, skipping the boot test", reason)
+	}
+}
+
+// skipIfHostLacksCPUFlags skips the test if the host cannot pass the CPU
+// flags to the guest. That's the case when KVM is not available (qemu falls
+// back to TCG) or when the host CPU doesn't have the flags itself.
+func skipIfHostLacksCPUFlags(t *testing.T, flags []string) {
+	if !kvmAvailable() {
+		t.Skip("KVM is not available, the required CPU flags cannot be tested under TCG, skipping")
+	}
+
+	cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo")
+	require.NoError(t, err)
+
+	missing := missingCPUFlags(string(cpuinfo), flags)
+	if len(missing) > 0 {
+		t.Skipf("the host CPU is missing flags %s, skipping", strings.Join(missing, ", "))
+	}
+}
+
+// imageInfoSource returns the image info of the tested image
+type imageInfoSource func() (interface{}, error)
+
+// lazyImageInfo returns an imageInfoSource running image-info on the image
+// when it's called for the first time, image-info mounts the whole image so
+// it's run at most once per testcase
+func lazyImageInfo(imagePath string) imageInfoSource {
+	var once sync.Once
+	var imageInfo interface{}
+	var err error
+	return func() (interface{}, error) {
+		once.Do(func() {
+			imageInfo, err = runImageInfo(imagePath)
+		})
+		return imageInfo, err
+	}
+}
+
+// testImageInfoAssertions runs the partition, service, bootloader and package
+// assertions of the testcase, all of them check the same image info
+func testImageInfoAssertions(t *testing.T, testcase testcaseStruct, imagePath string, getImageInfo imageInfoSource, recorder *caseRecorder) {
+	if testcase.PartitionAssertions != nil {
+		recorder.Run(t, "partitions", func(t *testing.T) {
+			imageInfo, err := getImageInfo()
+			require.NoError(t, err)
+
+			err = testPartitions(imageInfo, testcase.PartitionAssertions)
+			assert.NoError(t, err)
+		})
+	}
+
+	if testcase.ServiceAssertions != nil {
+		recorder.Run(t, "services", func(t *testing.T) {
+			imageInfo, err := getImageInfo()
+			require.NoError(t, err)
+
+			err = testServices(imageInfo, testcase.ServiceAssertions)
+			assert.NoError(t, err)
+		})
+	}
+
+	if testcase.BootloaderAssertions != nil {
+		recorder.Run(t, "bootloader", func(t *testing.T) {
+			imageInfo, err := getImageInfo()
+			require.NoError(t, err)
+
+			err = testBootloader(imageInfo, testcase.BootloaderAssertions)
+			assert.NoError(t, err)
+
+			if len(testcase.BootloaderAssertions.EFIBinaries) > 0 {
+				err = checkEFIBinaries(imagePath, imageInfo, testcase.BootloaderAssertions.EFIBinaries)
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	if len(testcase.RequirePackages) > 0 || len(testcase.ForbidPackages) > 0 {
+		recorder.Run(t, "packages", func(t *testing.T) {
+			imageInfo, err := getImageInfo()
+			require.NoError(t, err)
+
+			err = testPackages(imageInfo, testcase.RequirePackages, testcase.ForbidPackages)
+			assert.NoError(t, err)
+		})
+	}
+}
+
 // testImage performs a series of tests specified in the testcase
 // on an image
-func testImage(t *testing.T, testcase testcaseStruct, imagePath string) {
-	if testcase.ImageInfo != nil {
-		t.Run("image info", func(t *testing.T) {
-			testImageInfo(t, imagePath, testcase.ImageInfo)
+func testImage(t *testing.T, testcase testcaseStruct, imagePath string, recorder *caseRecorder) {
+	if *buildOnly {
+		t.Log("the image was built, skipping its tests because of -build-only")
+		return
+	}
+
+	getImageInfo := lazyImageInfo(imagePath)
+
+	if testcase.ImageInfo != nil && remoteImageInfoAvailable(testcase.Boot) {
+		t.Log("the image info is collected in the booted aws instance because of -remote-image-info")
+		testcase.Boot.remoteImageInfo = &remoteImageInfoCheck{
+			testcasePath: testcase.path,
+			expected:     testcase.ImageInfo,
+			ignorePaths:  testcase.IgnorePaths,
+		}
+	} else if testcase.ImageInfo != nil {
+		recorder.Run(t, "image info", func(t *testing.T) {
+			imageInfo, err := getImageInfo()
+			require.NoError(t, err)
+
+			compareImageInfo(t, testcase.path, imageInfo, testcase.ImageInfo, testcase.IgnorePaths)
+		})
+	}
+
+	testImageInfoAssertions(t, testcase, imagePath, getImageInfo, recorder)
+
+	if testcase.SBOM != nil {
+		recorder.Run(t, "sbom", func(t *testing.T) {
+			packages := testcase.SBOM.Packages
+			if len(packages) == 0 {
+				imageInfo, err := getImageInfo()
+				require.NoError(t, err)
+
+				packages, err = imageInfoPackages(imageInfo)
+				require.NoError(t, err)
+			}
+
+			err := checkSBOM(path.Dir(imagePath), testcase.SBOM, packages)
+			assert.NoError(t, err)
 		})
 	}
 
 	if testcase.Boot != nil {
-		if common.CurrentArch() == "aarch64" && !kvmAvailable() {
-			t.Log("Running on aarch64 without KVM support, skipping the boot test.")
-			return
-		}
-		t.Run("boot", func(t *testing.T) {
-			testBoot(t, imagePath, testcase.Boot.Type)
+		testcase.Boot.imageArch = testcase.ComposeRequest.Arch
+		logger := newCaseLogger(testcase)
+		event := newCaseEvent(t, eventBootStarted, testcase)
+		event.BootType = testcase.Boot.Type
+		emitEvent(event)
+		recorder.Run(t, "boot", func(t *testing.T) {
+			testBoot(t, logger, &recorder.timings, imagePath, testcase.Boot)
 		})
 	}
 }
 
-// runTestcase builds the pipeline specified in the testcase and then it
-// tests the result
-func runTestcase(t *testing.T, testcase testcaseStruct, store string) {
+// testImageArtifact checks that the built image is not empty and matches
+// the expected size and checksum if the testcase specifies them. It stops
+// the testcase early because there's no point in testing a broken image.
+func testImageArtifact(t *testing.T, testcase testcaseStruct, imagePath string) {
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err, "cannot stat the built image")
+	require.NotZero(t, info.Size(), "the built image is empty")
+
+	if testcase.ExpectedSize != 0 {
+		require.Equal(t, testcase.ExpectedSize, info.Size(), "the built image has an unexpected size")
+	}
+
+	if testcase.SHA256 != "" {
+		digest, err := sha256File(imagePath)
+		require.NoError(t, err)
+		require.Equal(t, testcase.SHA256, digest, "the built image has an unexpected checksum")
+	}
+}
+
+// osbuildEnv returns the inherited environment with the variables of the
+// testcase set on top of it
+func osbuildEnv(env map[string]string) []string {
+	result := os.Environ()
+	if len(env) == 0 {
+		return result
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	// keep the environment stable between runs
+	sort.Strings(names)
+
+	for _, name := range names {
+		result = append(result, name+"="+env[name])
+	}
+
+	return result
+}
+
+// buildImage runs osbuild using a store from the pool, taking a snapshot
+// of the store beforehand if requested
+func buildImage(manifest []byte, env map[string]string, stores storePool, outputDirectory string, timings *caseTimings) error {
+	return stores.withStore(func(store string) error {
+		var err error
+		if *snapshotStore {
+			err = withStoreSnapshot(store, func() error {
+				return runOsbuild(manifest, env, store, outputDirectory, timings)
+			})
+		} else {
+			err = runOsbuild(manifest, env, store, outputDirectory, timings)
+		}
+		if err != nil {
+			return err
+		}
+
+		version, err := getOsbuildVersion()
+		if err != nil {
+			return err
+		}
+
+		return recordOsbuildVersion(outputDirectory, version)
+	})
+}
+
+// createOutputDirectory creates a directory for the image and the other
+// artifacts of a testcase
+func createOutputDirectory(t *testing.T) string {
 	_ = os.Mkdir("/var/lib/osbuild-composer-tests", 0755)
 	outputDirectory, err := ioutil.TempDir("/var/lib/osbuild-composer-tests", "osbuild-image-tests-*")
 	require.NoError(t, err, "error creating temporary output directory")
 
-	defer func() {
-		err := os.RemoveAll(outputDirectory)
-		require.NoError(t, err, "error removing temporary output directory")
-	}()
+	return outputDirectory
+}
+
+// buildTestcase builds the pipeline specified in the testcase into the output
+// directory and returns the path of the image and the built manifest
+func buildTestcase(t *testing.T, testcase testcaseStruct, stores storePool, outputDirectory string, timings *caseTimings) (string, []byte) {
+	var err error
+	manifest := []byte(testcase.Manifest)
+	if testcase.ManifestCommand != nil {
+		require.Nil(t, testcase.Manifest, "manifest and manifest-command cannot be used at the same time")
 
-	err = runOsbuild(testcase.Manifest, store, outputDirectory)
+		manifest, err = generateManifest(testcase.ManifestCommand, outputDirectory)
+		require.NoError(t, err)
+	} else if len(extraRepos) > 0 {
+		// the rpmmd cache lives in the store
+		err = stores.withStore(func(store string) error {
+			var err error
+			manifest, err = manifestWithExtraRepos(testcase.RawComposeRequest, extraRepos, path.Join(store, "rpmmd"))
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	// fail fast instead of letting osbuild fail deep into the build
+	err = validateManifest(manifest)
 	require.NoError(t, err)
 
 	imagePath := fmt.Sprintf("%s/%s", outputDirectory, testcase.ComposeRequest.Filename)
 
-	testImage(t, testcase, imagePath)
+	for name := range testcase.Env {
+		if _, exists := os.LookupEnv(name); exists {
+			t.Logf("osbuild runs with %s from the testcase, overriding the inherited value", name)
+		} else {
+			t.Logf("osbuild runs with %s from the testcase", name)
+		}
+	}
+
+	build := func() error {
+		return buildManifest(t, testcase, manifest, stores, outputDirectory, timings)
+	}
+
+	if *imageCacheURL != "" {
+		err = withImageCache(*imageCacheURL, manifest, testcase.Env, outputDirectory, testcase.ComposeRequest.Filename, timings, build)
+	} else {
+		err = build()
+	}
+	if err != nil && runAborted() {
+		t.Skip(earlierFailureMessage)
+	}
+	require.NoError(t, err)
+
+	return imagePath, manifest
+}
+
+// buildManifest builds the manifest of the testcase into the output
+// directory, either locally or on the remote builder of its arch
+func buildManifest(t *testing.T, testcase testcaseStruct, manifest []byte, stores storePool, outputDirectory string, timings *caseTimings) error {
+	if builder, remote := remoteBuilderFor(testcase.ComposeRequest.Arch); remote {
+		t.Logf("building the image on the remote builder %s", builder)
+		return runRemoteOsbuild(builder, manifest, testcase.Env, outputDirectory, timings)
+	}
+
+	return buildImage(manifest, testcase.Env, stores, outputDirectory, timings)
+}
+
+// runTestcase builds the pipeline specified in the testcase and then it
+// tests the result. If shared is not nil, the image is built only by
+// the first run of the testcase and reused by the others.
+func runTestcase(t *testing.T, testcase testcaseStruct, stores storePool, recorder *caseRecorder, shared *sharedBuild) {
+	if *depsolveOnly {
+		testDepsolve(t, testcase, stores)
+		return
+	}
+
+	build := func(outputDirectory string) (string, []byte) {
+		start := time.Now()
+		imagePath, manifest := buildTestcase(t, testcase, stores, outputDirectory, &recorder.timings)
+
+		event := newCaseEvent(t, eventBuildDone, testcase)
+		event.Duration = time.Since(start).Seconds()
+		emitEvent(event)
+		return imagePath, manifest
+	}
+
+	var imagePath string
+	var manifest []byte
+	if shared != nil {
+		shared.once.Do(func() {
+			shared.outputDirectory = createOutputDirectory(t)
+			shared.imagePath, shared.manifest = build(shared.outputDirectory)
+		})
+		if shared.imagePath == "" && runAborted() {
+			recorder.Skipf(t, earlierFailureMessage)
+		}
+		require.NotEmpty(t, shared.imagePath, "the reused image failed to build in an earlier run")
+		imagePath = shared.imagePath
+		manifest = shared.manifest
+	} else {
+		outputDirectory := createOutputDirectory(t)
+		defer func() {
+			err := os.RemoveAll(outputDirectory)
+			require.NoError(t, err, "error removing temporary output directory")
+		}()
+
+		imagePath, manifest = build(outputDirectory)
+	}
+
+	testImageArtifact(t, testcase, imagePath)
+
+	if *reproducibilityCheck {
+		recorder.Run(t, "reproducibility", func(t *testing.T) {
+			testReproducibility(t, testcase, manifest, stores, imagePath)
+		})
+	}
+
+	testImage(t, testcase, imagePath, recorder)
+}
+
+// matchesDistro reports whether the testcase is valid for the distro
+func matchesDistro(testcase testcaseStruct, distro string) (bool, error) {
+	patterns := testcase.AcceptableDistros
+	if len(patterns) == 0 {
+		patterns = []string{testcase.ComposeRequest.Distro}
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, distro)
+		if err != nil {
+			return false, fmt.Errorf("invalid distro pattern %s: %v", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// filterMismatch returns a description of the first -filter-* flag
+// the testcase doesn't match, or an empty string if it matches all of them
+func filterMismatch(testcase testcaseStruct) (string, error) {
+	filters := []struct {
+		flag    string
+		pattern string
+		value   string
+	}{
+		{"-filter-distro", *filterDistro, testcase.ComposeRequest.Distro},
+		{"-filter-arch", *filterArch, testcase.ComposeRequest.Arch},
+		{"-filter-name", *filterName, testcase.ComposeRequest.Filename},
+	}
+
+	for _, filter := range filters {
+		if filter.pattern == "" {
+			continue
+		}
+
+		matched, err := path.Match(filter.pattern, filter.value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s pattern %s: %v", filter.flag, filter.pattern, err)
+		}
+		if !matched {
+			return fmt.Sprintf("%s does not match %s %s", filter.value, filter.flag, filter.pattern), nil
+		}
+	}
+
+	return "", nil
+}
+
+// rawComposeRequest returns the undecoded compose request of the testcase
+func rawComposeRequest(testcasePath string) (json.RawMessage, error) {
+	content, err := ioutil.ReadFile(testcasePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the test case: %v", err)
+	}
+
+	var testcase struct {
+		ComposeRequest json.RawMessage `json:"compose-request"`
+	}
+	err = json.Unmarshal(content, &testcase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the test case: %v", err)
+	}
+
+	return testcase.ComposeRequest, nil
 }
 
 // getAllCases returns paths to all testcases in the testcase directory
@@ -436,40 +2359,252 @@ func getAllCases() ([]string, error) {
 	return casesPaths, nil
 }
 
-// runTests opens, parses and runs all the specified testcases
-func runTests(t *testing.T, cases []string) {
-	_ = os.Mkdir("/var/lib/osbuild-composer-tests", 0755)
-	store, err := ioutil.TempDir("/var/lib/osbuild-composer-tests", "osbuild-image-tests-*")
-	require.NoError(t, err, "error creating temporary store")
+// parallelCases limits the number of test cases run concurrently
+var parallelCases semaphore
+
+// runTests opens, parses and runs all the specified testcases and returns
+// a summary of the results
+func runTests(t *testing.T, cases []string) *summary.Summary {
+	store := *persistentStore
+	if store != "" {
+		// the store is kept after the run so the sources are cached
+		err := os.MkdirAll(store, 0755)
+		require.NoError(t, err, "error creating the store")
+	} else {
+		_ = os.Mkdir("/var/lib/osbuild-composer-tests", 0755)
+		var err error
+		store, err = ioutil.TempDir("/var/lib/osbuild-composer-tests", "osbuild-image-tests-*")
+		require.NoError(t, err, "error creating temporary store")
+
+		defer func() {
+			err := os.RemoveAll(store)
+			require.NoError(t, err, "error removing temporary store")
+		}()
+	}
 
+	// the concurrently run test cases build using stores next to the main
+	// one, they are kept along with it
+	storeDirectories := []string{store}
+	for i := 1; i < *maxParallel; i++ {
+		parallelStore := fmt.Sprintf("%s-parallel-%d", store, i)
+		err := os.MkdirAll(parallelStore, 0755)
+		require.NoError(t, err, "error creating the store")
+		if *persistentStore == "" {
+			defer func() {
+				err := os.RemoveAll(parallelStore)
+				require.NoError(t, err, "error removing temporary store")
+			}()
+		}
+		storeDirectories = append(storeDirectories, parallelStore)
+	}
+	stores := newStorePool(storeDirectories)
+
+	// the postponed cloud deletions run even if the run fails
 	defer func() {
-		err := os.RemoveAll(store)
-		require.NoError(t, err, "error removing temporary store")
+		err := runCloudTeardowns(t)
+		assert.NoError(t, err)
 	}()
 
-	for _, p := range cases {
-		t.Run(path.Base(p), func(t *testing.T) {
-			f, err := os.Open(p)
-			if err != nil {
-				t.Skipf("%s: cannot open test case: %#v", p, err)
-			}
+	host, err := getHostDistro()
+	require.NoError(t, err)
 
-			var testcase testcaseStruct
-			err = json.NewDecoder(f).Decode(&testcase)
-			require.NoErrorf(t, err, "%s: cannot decode test case", p)
+	results := &summary.Summary{Cases: []summary.Case{}}
+	counts := make(map[string]repeatCounts)
+	var timingCases []timingReportCase
+	var resultsLock sync.Mutex
+
+	// the builds shared by the runs of each testcase, removed once all
+	// the runs are over
+	sharedBuilds := make(map[string]*sharedBuild)
+	if *reuseImage {
+		for _, p := range cases {
+			sharedBuilds[p] = &sharedBuild{}
+		}
 
-			currentArch := common.CurrentArch()
-			if testcase.ComposeRequest.Arch != currentArch {
-				t.Skipf("the required arch is %s, the current arch is %s", testcase.ComposeRequest.Arch, currentArch)
+		defer func() {
+			for _, shared := range sharedBuilds {
+				if shared.outputDirectory != "" {
+					err := os.RemoveAll(shared.outputDirectory)
+					require.NoError(t, err, "error removing temporary output directory")
+				}
 			}
+		}()
+	}
 
-			runTestcase(t, testcase, store)
-		})
+	runCases := func(t *testing.T) {
+		for _, p := range cases {
+			for run := 1; run <= *repeat; run++ {
+				p := p
+				name := repeatedCaseName(path.Base(p), run, *repeat)
+				t.Run(name, func(t *testing.T) {
+					if *maxParallel > 1 {
+						t.Parallel()
+						parallelCases.acquire()
+						defer parallelCases.release()
+					}
+
+					var testcase testcaseStruct
+					recorder := &caseRecorder{}
+					start := time.Now()
+					// runs even if the test case is skipped or fails
+					defer func() {
+						resultsLock.Lock()
+						defer resultsLock.Unlock()
+						c := recorder.summaryCase(t, name, testcase, time.Since(start))
+						results.Cases = append(results.Cases, c)
+
+						event := newCaseEvent(t, eventCaseResult, testcase)
+						event.Result = string(c.Result)
+						event.Message = c.Message
+						event.Duration = c.Duration
+						emitEvent(event)
+						if *failFast && c.Result == summary.Failed {
+							abortRun()
+						}
+						if c.Result != summary.Skipped {
+							timingCases = append(timingCases, timingReportCase{
+								Name:        name,
+								Distro:      testcase.ComposeRequest.Distro,
+								Arch:        testcase.ComposeRequest.Arch,
+								caseTimings: &recorder.timings,
+							})
+						}
+
+						if counts[path.Base(p)] == nil {
+							counts[path.Base(p)] = make(repeatCounts)
+						}
+						counts[path.Base(p)][c.Result]++
+					}()
+
+					f, err := os.Open(p)
+					if err != nil {
+						recorder.Skipf(t, "%s: cannot open test case: %#v", p, err)
+					}
+
+					err = json.NewDecoder(f).Decode(&testcase)
+					require.NoErrorf(t, err, "%s: cannot decode test case", p)
+					emitEvent(newCaseEvent(t, eventCaseStarted, testcase))
+
+					if runAborted() {
+						recorder.Skipf(t, earlierFailureMessage)
+					}
+					testcase.path = p
+					testcase.RawComposeRequest, err = rawComposeRequest(p)
+					require.NoError(t, err)
+
+					if *targetDistro != "" {
+						matches, err := matchesDistro(testcase, *targetDistro)
+						require.NoError(t, err)
+						if !matches {
+							recorder.Skipf(t, "the test case is not valid for %s", *targetDistro)
+						}
+					}
+
+					mismatch, err := filterMismatch(testcase)
+					require.NoError(t, err)
+					if mismatch != "" {
+						recorder.Skipf(t, "the test case is filtered out: %s", mismatch)
+					}
+
+					if *replayDirectory != "" {
+						replayTestcase(t, testcase, *replayDirectory, recorder)
+						return
+					}
+
+					buildable, err := buildableOnHost(testcase.ComposeRequest.Distro, host)
+					require.NoError(t, err)
+					if !buildable {
+						recorder.Skipf(t, "the test case distro %s cannot be built on the host distro %s", testcase.ComposeRequest.Distro, host)
+					}
+
+					currentArch := common.CurrentArch()
+					_, remote := remoteBuilderFor(testcase.ComposeRequest.Arch)
+					if testcase.ComposeRequest.Arch != currentArch && !remote {
+						recorder.Skipf(t, "the required arch is %s, the current arch is %s, pass -remote-builder to build it remotely", testcase.ComposeRequest.Arch, currentArch)
+					}
+
+					runTestcase(t, testcase, stores, recorder, sharedBuilds[p])
+				})
+			}
+		}
+	}
+
+	if *maxParallel > 1 {
+		// parallel subtests run only after the function passed to t.Run
+		// returns, the group makes runTests wait for them before
+		// the store is removed
+		t.Run("parallel", runCases)
+	} else {
+		runCases(t)
+	}
+
+	if *repeat > 1 {
+		t.Logf("results of the repeated runs:\n%s", formatRepeatCounts(counts))
+	}
 
+	if *timingOutput != "" {
+		err := writeTimingReport(*timingOutput, timingCases)
+		require.NoError(t, err)
 	}
+
+	err = reportCloudUsage(t)
+	require.NoError(t, err)
+
+	return results
+}
+
+func init() {
+	flag.Var(remoteBuilders, "remote-builder", "a host building the images of another arch than the current one over ssh, the value is ARCH=USER@HOST, can be repeated")
+	flag.Var(&extraSSHKeys, "extra-ssh-key", "a public key file whose keys are authorized for the user logging into the images booted using cloud-init besides the generated key, can be repeated")
+	flag.Var(&extraRepos, "extra-repo", "a repository added to every manifest, the value is BASEURL or BASEURL,gpgkey=PATH, can be repeated")
 }
 
 func TestImages(t *testing.T) {
+	level, err := parseLogLevel(*logLevelName)
+	require.NoError(t, err, "invalid -log-level")
+	minLogLevel = level
+
+	if *credentialsPath != "" {
+		err := loadCredentialsFile(*credentialsPath)
+		require.NoError(t, err, "invalid -credentials")
+	}
+
+	if *cleanup {
+		err := cleanupLeakedResources(*cleanupAge)
+		require.NoError(t, err)
+		return
+	}
+
+	if *mergeSummaries != "" {
+		err := mergeSummaryFiles(flag.Args(), *mergeSummaries, *mergedJUnit)
+		require.NoError(t, err)
+		return
+	}
+
+	if *prebuiltImage != "" {
+		require.NotEmpty(t, *expectedInfo, "-image requires -expected-info")
+		testPrebuiltImage(t, *prebuiltImage, *expectedInfo)
+		return
+	}
+
+	for _, repo := range extraRepos {
+		require.NoError(t, checkRepoReachable(repo.BaseURL))
+	}
+
+	if *qemuArgsTemplate != "" {
+		require.NoError(t, validateQemuArgsTemplate(*qemuArgsTemplate))
+	}
+
+	require.Greater(t, *sshAttempts, 0, "-ssh-attempts must be positive")
+	require.NoError(t, validateSSHKeyType(*sshKeyType), "invalid -ssh-key-type")
+
+	require.Greater(t, *maxParallel, 0, "-max-parallel must be positive")
+	require.Greater(t, *repeat, 0, "-repeat must be positive")
+	parallelCases = newSemaphore(*maxParallel)
+
+	require.Greater(t, *maxCloudUploads, 0, "-max-cloud-uploads must be positive")
+	cloudUploads = newSemaphore(*maxCloudUploads)
+
 	cases := flag.Args()
 	// if no cases were specified, run the default set
 	if len(cases) == 0 {
@@ -478,5 +2613,75 @@ func TestImages(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	runTests(t, cases)
+	if *eventsOutput != "" {
+		err := openEventsOutput(*eventsOutput)
+		require.NoError(t, err, "invalid -events-output")
+		defer func() {
+			err := closeEventsOutput()
+			assert.NoError(t, err)
+		}()
+	}
+
+	results := runTests(t, cases)
+
+	if *summaryJSON != "" {
+		err := results.Save(*summaryJSON)
+		require.NoError(t, err)
+	}
+
+	if *junitOutput != "" {
+		f, err := os.Create(*junitOutput)
+		require.NoError(t, err, "cannot create the junit report")
+		defer f.Close()
+
+		err = results.WriteJUnit(f)
+		require.NoError(t, err, "cannot write the junit report")
+	}
+}
+
+func TestJumpArgs(t *testing.T) {
+	assert.Equal(t, []string{"-J", "user@bastion:2222"}, jumpArgs("user@bastion:2222", ""))
+	assert.Equal(t,
+		[]string{"-o", "ProxyCommand=ssh -i /keys/jump -p 2222 -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -W %h:%p user@bastion"},
+		jumpArgs("user@bastion:2222", "/keys/jump"))
+	assert.Equal(t,
+		[]string{"-o", "ProxyCommand=ssh -i /keys/jump -p 22 -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -W %h:%p bastion"},
+		jumpArgs("bastion", "/keys/jump"))
+}
+
+func TestFilterMismatch(t *testing.T) {
+	distro, arch, name := *filterDistro, *filterArch, *filterName
+	defer func() {
+		*filterDistro, *filterArch, *filterName = distro, arch, name
+	}()
+
+	var testcase testcaseStruct
+	testcase.ComposeRequest.Distro = "fedora-32"
+	testcase.ComposeRequest.Arch = "x86_64"
+	testcase.ComposeRequest.Filename = "disk.qcow2"
+
+	tests := []struct {
+		distro, arch, name string
+		mismatch           string
+		invalid            bool
+	}{
+		{"", "", "", "", false},
+		{"fedora-*", "x86_64", "*.qcow2", "", false},
+		{"rhel-*", "", "", "fedora-32 does not match -filter-distro rhel-*", false},
+		{"", "aarch64", "", "x86_64 does not match -filter-arch aarch64", false},
+		{"fedora-*", "", "*.raw", "disk.qcow2 does not match -filter-name *.raw", false},
+		{"[", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		*filterDistro, *filterArch, *filterName = test.distro, test.arch, test.name
+
+		mismatch, err := filterMismatch(testcase)
+		if test.invalid {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.mismatch, mismatch)
+	}
 }
@@ -0,0 +1,212 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// schemaNode is the subset of JSON schema needed to describe the osbuild
+// manifest formats. Stage and assembler options are not checked, their
+// schemas live in the osbuild modules.
+type schemaNode struct {
+	// Type is object, array or string
+	Type     string
+	Required []string
+	// Properties are the allowed keys of an object, unless
+	// AdditionalProperties is set, other keys are rejected
+	Properties           map[string]*schemaNode
+	AdditionalProperties bool
+	// Items describes the elements of an array
+	Items *schemaNode
+	// Enum lists the allowed values of a string
+	Enum []string
+}
+
+// anyObject accepts any object, e.g. options or sources
+var anyObject = &schemaNode{Type: "object", AdditionalProperties: true}
+
+// manifestV1Schema mirrors osbuild1.json from osbuild
+var manifestV1Schema = func() *schemaNode {
+	module := &schemaNode{
+		Type:     "object",
+		Required: []string{"name"},
+		Properties: map[string]*schemaNode{
+			"name":    {Type: "string"},
+			"options": anyObject,
+		},
+	}
+
+	pipeline := &schemaNode{Type: "object"}
+	build := &schemaNode{
+		Type:     "object",
+		Required: []string{"pipeline", "runner"},
+		Properties: map[string]*schemaNode{
+			"pipeline": pipeline,
+			"runner":   {Type: "string"},
+		},
+	}
+	pipeline.Properties = map[string]*schemaNode{
+		"build":     build,
+		"stages":    {Type: "array", Items: module},
+		"assembler": module,
+	}
+
+	return &schemaNode{
+		Type: "object",
+		Properties: map[string]*schemaNode{
+			"pipeline": pipeline,
+			"sources":  anyObject,
+		},
+	}
+}()
+
+// manifestV2Schema mirrors osbuild2.json from osbuild
+var manifestV2Schema = &schemaNode{
+	Type:     "object",
+	Required: []string{"version"},
+	Properties: map[string]*schemaNode{
+		"version": {Type: "string", Enum: []string{"2"}},
+		"sources": anyObject,
+		"pipelines": {
+			Type: "array",
+			Items: &schemaNode{
+				Type: "object",
+				Properties: map[string]*schemaNode{
+					"name":         {Type: "string"},
+					"build":        {Type: "string"},
+					"runner":       {Type: "string"},
+					"source-epoch": {Type: "number"},
+					"stages": {
+						Type: "array",
+						Items: &schemaNode{
+							Type:     "object",
+							Required: []string{"type"},
+							Properties: map[string]*schemaNode{
+								"type":    {Type: "string"},
+								"id":      {Type: "string"},
+								"devices": anyObject,
+								"inputs":  anyObject,
+								"mounts":  {},
+								"options": anyObject,
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// jsonType returns the JSON schema type of a value decoded by encoding/json
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// validate checks the value against the schema node, path is the JSON path
+// of the value used in the error
+func (node *schemaNode) validate(value interface{}, path string) error {
+	if node.Type != "" && jsonType(value) != node.Type {
+		return fmt.Errorf("%s: expected %s, got %s", path, node.Type, jsonType(value))
+	}
+
+	if len(node.Enum) > 0 {
+		s, _ := value.(string)
+		found := false
+		for _, allowed := range node.Enum {
+			if s == allowed {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: expected one of %s, got %q", path, strings.Join(node.Enum, ", "), s)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range node.Required {
+			if _, ok := v[key]; !ok {
+				return fmt.Errorf("%s: the required property %q is missing", path, key)
+			}
+		}
+
+		// sorted so the first error is always the same one
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			property, ok := node.Properties[key]
+			if !ok {
+				if node.AdditionalProperties {
+					continue
+				}
+				return fmt.Errorf("%s: unknown property %q", path, key)
+			}
+
+			err := property.validate(v[key], path+"."+key)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if node.Items == nil {
+			return nil
+		}
+
+		for i, item := range v {
+			err := node.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateManifest checks the manifest against the schema of its format
+// version, manifests with a version property are v2, the rest are v1.
+// The error points to the offending property.
+func validateManifest(manifest []byte) error {
+	var decoded interface{}
+	err := json.Unmarshal(manifest, &decoded)
+	if err != nil {
+		return fmt.Errorf("the manifest is not valid JSON: %v", err)
+	}
+
+	schema := manifestV1Schema
+	if object, ok := decoded.(map[string]interface{}); ok {
+		if _, ok := object["version"]; ok {
+			schema = manifestV2Schema
+		}
+	}
+
+	err = schema.validate(decoded, "$")
+	if err != nil {
+		return fmt.Errorf("the manifest does not match the osbuild schema: %v", err)
+	}
+
+	return nil
+}
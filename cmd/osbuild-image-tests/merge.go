@@ -0,0 +1,59 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/summary"
+)
+
+// mergeSummaryFiles merges the summary files into the output file and
+// optionally writes the JUnit XML report too. An error is returned if
+// the summaries contain conflicting results.
+func mergeSummaryFiles(paths []string, output, junitOutput string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no summaries to merge were given")
+	}
+
+	var summaries []*summary.Summary
+	for _, p := range paths {
+		s, err := summary.Load(p)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, s)
+	}
+
+	merged := summary.Merge(summaries)
+	err := merged.Save(output)
+	if err != nil {
+		return err
+	}
+
+	if junitOutput != "" {
+		f, err := os.Create(junitOutput)
+		if err != nil {
+			return fmt.Errorf("cannot create the junit report: %v", err)
+		}
+		defer f.Close()
+
+		err = merged.WriteJUnit(f)
+		if err != nil {
+			return fmt.Errorf("cannot write the junit report: %v", err)
+		}
+	}
+
+	conflicts := merged.Conflicts()
+	if len(conflicts) > 0 {
+		var names []string
+		for _, c := range conflicts {
+			names = append(names, c.Name+" ("+c.Arch+")")
+		}
+		return fmt.Errorf("the summaries contain conflicting results for: %s", strings.Join(names, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/osbuild/osbuild-composer/internal/common"
+)
+
+// lastVsockCID is the last context id handed to a guest, the ids must be
+// unique on the host so they are derived from the pid of the test binary
+var lastVsockCID = uint32(1000 + os.Getpid()%100000*16)
+
+// nextVsockCID returns an unused vsock context id for a new guest
+func nextVsockCID() uint32 {
+	return atomic.AddUint32(&lastVsockCID, 1)
+}
+
+// microVMDevices returns the names of the block and vsock devices, only
+// virtio-mmio devices are available in the x86_64 microvm machine, aarch64
+// uses the already minimal virt machine with pci devices
+func microVMDevices() (string, string) {
+	if common.CurrentArch() == "x86_64" {
+		return "virtio-blk-device", "vhost-vsock-device"
+	}
+	return "virtio-blk-pci", "vhost-vsock-pci"
+}
+
+// microVMMachineArgs returns the qemu arguments selecting a microVM
+func microVMMachineArgs() []string {
+	var args []string
+	if common.CurrentArch() == "x86_64" {
+		args = append(args, "-M", "microvm")
+	}
+
+	return append(args, "-nodefaults", "-no-user-config")
+}
+
+// microVMDiskArgs returns the qemu arguments attaching the image and
+// the cloud-init iso to a microVM, qemu probes the image format if empty
+func microVMDiskArgs(image, format, cloudInitISO string) []string {
+	blockDevice, _ := microVMDevices()
+	root := "id=root,if=none,file=" + image
+	if format != "" {
+		root += ",format=" + format
+	}
+
+	return []string{
+		"-drive", root,
+		"-device", blockDevice + ",drive=root",
+		"-drive", "id=cidata,if=none,format=raw,readonly=on,file=" + cloudInitISO,
+		"-device", blockDevice + ",drive=cidata",
+	}
+}
+
+// microVMNetdevArgs returns the qemu arguments giving a microVM no
+// networking, only a vsock device. The guest must accept ssh connections
+// on the vsock port 22 (e.g. using systemd's sshd-vsock.socket).
+func microVMNetdevArgs(cid uint32) []string {
+	_, vsockDevice := microVMDevices()
+	return []string{
+		"-nic", "none",
+		"-device", fmt.Sprintf("%s,guest-cid=%d", vsockDevice, cid),
+	}
+}
+
+// withBootedMicroVM boots the image in a microVM reachable using vsock,
+// no network namespace is needed. The VM is killed immediately after
+// the function returns.
+func withBootedMicroVM(image string, opts qemuOptions, f func(vm *qemuVM, target sshTarget) error) error {
+	opts.VsockCID = nextVsockCID()
+	target := sshTarget{
+		address:  fmt.Sprintf("vsock-%d", opts.VsockCID),
+		vsockCID: opts.VsockCID,
+	}
+
+	return withBootedQemuImage(image, "", opts, func(vm *qemuVM) error {
+		return f(vm, target)
+	})
+}
@@ -18,6 +18,16 @@ import (
 
 const netnsDir = "/var/run/netns"
 
+// netnsError is returned when a network namespace cannot be created,
+// e.g. in containers without CAP_NET_ADMIN
+type netnsError struct {
+	err error
+}
+
+func (e *netnsError) Error() string {
+	return fmt.Sprintf("cannot create a network namespace: %v", e.err)
+}
+
 // Network namespace abstraction
 type netNS string
 
@@ -59,7 +69,7 @@ func newNetworkNamespace() (netNS, error) {
 		if !initOK {
 			err := os.Remove(f.Name())
 			if err != nil {
-				log.Printf("cannot remove the temporary namespace: %#v", err)
+				harnessLog.Warningf("cannot remove the temporary namespace: %#v", err)
 			}
 		}
 	}()
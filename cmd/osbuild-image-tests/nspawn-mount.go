@@ -0,0 +1,169 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// withLoopDevice attaches the image to a read-only loop device with its
+// partitions scanned and passes the device and its partitions to the
+// function f. The device is detached after the function returns.
+func withLoopDevice(image string, f func(device string, partitions []string) error) error {
+	out, err := exec.Command("losetup", "--find", "--show", "--partscan", "--read-only", image).Output()
+	if err != nil {
+		return fmt.Errorf("cannot attach the image to a loop device: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+
+	defer func() {
+		err := exec.Command("losetup", "--detach", device).Run()
+		if err != nil {
+			harnessLog.Warningf("cannot detach the loop device %s: %v", device, err)
+		}
+	}()
+
+	// the partition devices are created asynchronously
+	_ = exec.Command("udevadm", "settle").Run()
+
+	partitions, err := filepath.Glob(device + "p*")
+	if err != nil {
+		return fmt.Errorf("cannot list the partitions of %s: %v", device, err)
+	}
+	sort.Strings(partitions)
+
+	return f(device, partitions)
+}
+
+// blkidValue returns the value of the tag (e.g. UUID or TYPE) of the block
+// device, or an empty string if the device doesn't have it
+func blkidValue(device, tag string) string {
+	out, err := exec.Command("blkid", "--output", "value", "--match-tag", tag, device).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// mountReadOnly mounts the device read-only at the directory
+func mountReadOnly(device, dir string) error {
+	out, err := exec.Command("mount", "--read-only", device, dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot mount %s at %s: %v\n%s", device, dir, err, out)
+	}
+
+	return nil
+}
+
+// unmount unmounts the directory, errors are only logged because it's
+// called during cleanups
+func unmount(dir string) {
+	out, err := exec.Command("umount", dir).CombinedOutput()
+	if err != nil {
+		harnessLog.Warningf("cannot unmount %s: %v\n%s", dir, err, out)
+	}
+}
+
+// fstabDevice returns the partition matching the device of an fstab entry
+// given as UUID=, LABEL= or PARTUUID=, or an empty string if none does
+func fstabDevice(spec string, partitions []string) string {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	for _, partition := range partitions {
+		if blkidValue(partition, parts[0]) == parts[1] {
+			return partition
+		}
+	}
+
+	return ""
+}
+
+// withMountedImage mounts the root filesystem of a partitioned image and
+// the other filesystems listed in its fstab (e.g. /boot) read-only into
+// a temporary directory and passes it to the function f. The root is the
+// first partition with an /etc/fstab. Everything is unmounted after the
+// function returns.
+func withMountedImage(image string, f func(dir string) error) error {
+	return withLoopDevice(image, func(device string, partitions []string) error {
+		return withTempDir("", "nspawn-root", func(dir string) error {
+			root := ""
+			for _, partition := range partitions {
+				fstype := blkidValue(partition, "TYPE")
+				if fstype == "" || fstype == "swap" || fstype == "vfat" {
+					continue
+				}
+
+				err := mountReadOnly(partition, dir)
+				if err != nil {
+					continue
+				}
+				if _, err := os.Stat(path.Join(dir, "etc/fstab")); err == nil {
+					root = partition
+					break
+				}
+				unmount(dir)
+			}
+			if root == "" {
+				return fmt.Errorf("no partition of %s contains a root filesystem", image)
+			}
+			defer unmount(dir)
+
+			fstab, err := ioutil.ReadFile(path.Join(dir, "etc/fstab"))
+			if err != nil {
+				return fmt.Errorf("cannot read the fstab of the image: %v", err)
+			}
+
+			specs := make(map[string]string)
+			var mountpoints []string
+			for _, line := range strings.Split(string(fstab), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || !strings.HasPrefix(fields[1], "/") || fields[1] == "/" {
+					continue
+				}
+				specs[fields[1]] = fields[0]
+				mountpoints = append(mountpoints, fields[1])
+			}
+			// mount the parents first, e.g. /boot before /boot/efi
+			sort.Strings(mountpoints)
+
+			for _, mountpoint := range mountpoints {
+				partition := fstabDevice(specs[mountpoint], partitions)
+				if partition == "" {
+					// e.g. tmpfs or a device outside of the image
+					continue
+				}
+
+				target := path.Join(dir, mountpoint)
+				err := mountReadOnly(partition, target)
+				if err != nil {
+					return err
+				}
+				defer unmount(target)
+			}
+
+			return f(dir)
+		})
+	})
+}
+
+// imagePartitionCount returns the number of partitions of the image
+func imagePartitionCount(image string) (int, error) {
+	count := 0
+	err := withLoopDevice(image, func(device string, partitions []string) error {
+		count = len(partitions)
+		return nil
+	})
+
+	return count, err
+}
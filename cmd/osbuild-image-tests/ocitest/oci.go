@@ -0,0 +1,309 @@
+// +build integration
+
+package ocitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+const (
+	defaultShape = "VM.Standard2.1"
+
+	// maxWaitSeconds is the maximal time the oci cli waits for a resource
+	// to reach the requested lifecycle state
+	maxWaitSeconds = "1800"
+)
+
+// ociCredentials are the Oracle Cloud Infrastructure resources used by the
+// tests. The authentication is left to the oci cli, i.e. its configuration
+// file or its OCI_CLI_* environment variables.
+type ociCredentials struct {
+	Region string
+	// CompartmentID is the OCID of the compartment of all the resources
+	CompartmentID      string
+	AvailabilityDomain string
+	SubnetID           string
+	// Bucket is the Object Storage bucket the images are imported from
+	Bucket string
+	// Shape is the instance shape, e.g. VM.Standard2.1
+	Shape string
+}
+
+// GetOCICredentialsFromEnv gets the credentials from environment variables
+// If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// OCI_SHAPE is optional.
+func GetOCICredentialsFromEnv() (*ociCredentials, error) {
+	region, rExists := os.LookupEnv("OCI_REGION")
+	compartmentID, cExists := os.LookupEnv("OCI_COMPARTMENT_ID")
+	availabilityDomain, adExists := os.LookupEnv("OCI_AVAILABILITY_DOMAIN")
+	subnetID, sExists := os.LookupEnv("OCI_SUBNET_ID")
+	bucket, bExists := os.LookupEnv("OCI_BUCKET")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !rExists && !cExists && !adExists && !sExists && !bExists {
+		return nil, nil
+	}
+	// If only some of them are not set, then fail
+	if !rExists || !cExists || !adExists || !sExists || !bExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	shape, exists := os.LookupEnv("OCI_SHAPE")
+	if !exists {
+		shape = defaultShape
+	}
+
+	return &ociCredentials{
+		Region:             region,
+		CompartmentID:      compartmentID,
+		AvailabilityDomain: availabilityDomain,
+		SubnetID:           subnetID,
+		Bucket:             bucket,
+		Shape:              shape,
+	}, nil
+}
+
+// runOCI runs the oci cli in the region given by the credentials and
+// returns its standard output
+func runOCI(c *ociCredentials, args ...string) (string, error) {
+	cmd := exec.Command("oci", append(args, "--region", c.Region)...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("oci %s failed: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runOCIJSON runs the oci cli and decodes the data field of its JSON
+// output into v
+func runOCIJSON(c *ociCredentials, v interface{}, args ...string) error {
+	out, err := runOCI(c, args...)
+	if err != nil {
+		return err
+	}
+
+	response := struct {
+		Data interface{} `json:"data"`
+	}{v}
+	err = json.Unmarshal([]byte(out), &response)
+	if err != nil {
+		return fmt.Errorf("cannot decode the output of oci %s: %v", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
+
+// objectName returns the name of the uploaded image in the bucket
+func objectName(imageName string) string {
+	return imageName + ".qcow2"
+}
+
+// UploadImageToOCI uploads the image to the bucket and imports it as
+// a custom image, it returns the OCID of the image. Raw images are converted
+// to qcow2 first.
+func UploadImageToOCI(c *ociCredentials, imagePath string, imageName string) (string, error) {
+	qcow2 := imagePath
+	if path.Ext(imagePath) != ".qcow2" {
+		dir, err := ioutil.TempDir("", "oci-image-")
+		if err != nil {
+			return "", fmt.Errorf("cannot create a temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		qcow2 = path.Join(dir, "image.qcow2")
+		cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", imagePath, qcow2)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("cannot convert the image to qcow2: %v", err)
+		}
+	}
+
+	_, err := runOCI(c, "os", "object", "put",
+		"--bucket-name", c.Bucket,
+		"--name", objectName(imageName),
+		"--file", qcow2,
+		"--force",
+	)
+	if err != nil {
+		return "", fmt.Errorf("upload to oci failed: %v", err)
+	}
+
+	var namespace string
+	err = runOCIJSON(c, &namespace, "os", "ns", "get")
+	if err != nil {
+		return "", fmt.Errorf("cannot get the object storage namespace: %v", err)
+	}
+
+	var image struct {
+		ID string `json:"id"`
+	}
+	err = runOCIJSON(c, &image, "compute", "image", "import", "from-object",
+		"--compartment-id", c.CompartmentID,
+		"--namespace", namespace,
+		"--bucket-name", c.Bucket,
+		"--name", objectName(imageName),
+		"--display-name", imageName,
+		"--source-image-type", "QCOW2",
+		"--launch-mode", "PARAVIRTUALIZED",
+	)
+	if err != nil {
+		return "", fmt.Errorf("cannot import the custom image: %v", err)
+	}
+
+	// the id is returned even if the import fails, so the image can be
+	// deleted
+	_, err = runOCI(c, "compute", "image", "get",
+		"--image-id", image.ID,
+		"--wait-for-state", "AVAILABLE",
+		"--max-wait-seconds", maxWaitSeconds,
+	)
+	if err != nil {
+		return image.ID, fmt.Errorf("the custom image didn't become available: %v", err)
+	}
+
+	return image.ID, nil
+}
+
+// DeleteImageFromOCI deletes the custom image and the uploaded object
+// (created by UploadImageToOCI method). The image id is empty if the import
+// failed.
+func DeleteImageFromOCI(c *ociCredentials, imageName, imageID string) error {
+	var retErr error
+
+	if imageID != "" {
+		_, err := runOCI(c, "compute", "image", "delete", "--image-id", imageID, "--force")
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot delete the custom image: %v", err)
+		}
+	}
+
+	_, err := runOCI(c, "os", "object", "delete",
+		"--bucket-name", c.Bucket,
+		"--object-name", objectName(imageName),
+		"--force",
+	)
+	if err != nil {
+		retErr = wrapErrorf(retErr, "cannot delete the uploaded image: %v", err)
+	}
+
+	return retErr
+}
+
+// WithBootedImageInOCI runs the function f in the context of booted image
+// in Oracle Cloud Infrastructure. The public key is authorized for the
+// default user of the image and the user data are passed to cloud-init.
+// If privateAddress is true, the instance gets no public ip and f gets its
+// private address. If keep returns true after f, the instance is left
+// running.
+func WithBootedImageInOCI(c *ociCredentials, imageID, testId, publicKeyFile, userData string, privateAddress bool, keep func() bool, f func(address string) error) (retErr error) {
+	userDataFile, err := ioutil.TempFile("", "oci-user-data-")
+	if err != nil {
+		return fmt.Errorf("cannot create the user data file: %v", err)
+	}
+	defer os.Remove(userDataFile.Name())
+
+	_, err = userDataFile.WriteString(userData)
+	userDataFile.Close()
+	if err != nil {
+		return fmt.Errorf("cannot write the user data file: %v", err)
+	}
+
+	instanceName := "vm-" + testId
+
+	var instance struct {
+		ID string `json:"id"`
+	}
+	err = runOCIJSON(c, &instance, "compute", "instance", "launch",
+		"--compartment-id", c.CompartmentID,
+		"--availability-domain", c.AvailabilityDomain,
+		"--shape", c.Shape,
+		"--subnet-id", c.SubnetID,
+		"--image-id", imageID,
+		"--display-name", instanceName,
+		"--assign-public-ip", fmt.Sprintf("%t", !privateAddress),
+		"--ssh-authorized-keys-file", publicKeyFile,
+		"--user-data-file", userDataFile.Name(),
+	)
+	if err != nil {
+		return fmt.Errorf("creating an instance failed: %v", err)
+	}
+
+	// Let's register the clean-up function as soon as possible, the instance
+	// must be gone before the image can be deleted.
+	defer func() {
+		if keep() {
+			log.Printf("keeping the instance %s running", instance.ID)
+			return
+		}
+
+		_, err := runOCI(c, "compute", "instance", "terminate",
+			"--instance-id", instance.ID,
+			"--preserve-boot-volume", "false",
+			"--force",
+			"--wait-for-state", "TERMINATED",
+			"--max-wait-seconds", maxWaitSeconds,
+		)
+		if err != nil {
+			retErr = wrapErrorf(retErr, "cannot terminate the instance %s: %v", instance.ID, err)
+		}
+	}()
+
+	_, err = runOCI(c, "compute", "instance", "get",
+		"--instance-id", instance.ID,
+		"--wait-for-state", "RUNNING",
+		"--max-wait-seconds", maxWaitSeconds,
+	)
+	if err != nil {
+		return fmt.Errorf("the instance didn't start: %v", err)
+	}
+
+	var vnics []struct {
+		PublicIP  string `json:"public-ip"`
+		PrivateIP string `json:"private-ip"`
+	}
+	err = runOCIJSON(c, &vnics, "compute", "instance", "list-vnics", "--instance-id", instance.ID)
+	if err != nil {
+		return fmt.Errorf("cannot get the instance address: %v", err)
+	}
+	if len(vnics) == 0 {
+		return fmt.Errorf("the instance %s has no vnic", instance.ID)
+	}
+
+	if privateAddress {
+		return f(vnics[0].PrivateIP)
+	}
+
+	if vnics[0].PublicIP == "" {
+		return fmt.Errorf("the instance %s has no public ip address", instance.ID)
+	}
+
+	return f(vnics[0].PublicIP)
+}
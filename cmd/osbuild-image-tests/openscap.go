@@ -0,0 +1,203 @@
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+const openSCAPResultsPath = "/tmp/osbuild-image-tests-oscap-results.xml"
+const openSCAPReportPath = "/tmp/osbuild-image-tests-oscap-report.html"
+
+// openSCAPExpectation describes an OpenSCAP scan run in the booted image
+type openSCAPExpectation struct {
+	// Profile is the XCCDF profile id
+	Profile string
+	// Datastream is a path to the SCAP source datastream in the image
+	Datastream string
+	// Packages are installed before the scan, e.g. scap-security-guide
+	Packages []string
+	// MinPassRate is the minimal ratio of passed rules to passed and failed
+	// rules, between 0 and 1
+	MinPassRate float64 `json:"min-pass-rate"`
+	// Rules must pass, the rule ids can be given without the
+	// xccdf_org.ssgproject.content_rule_ prefix
+	Rules []string
+	// Timeout bounds the installation of the packages and the scan, each
+	// of them, 30 minutes are used if empty
+	Timeout string
+}
+
+type openSCAPRuleResult struct {
+	IDRef  string `xml:"idref,attr"`
+	Result string `xml:"result"`
+}
+
+// parseOpenSCAPResults returns a map from a rule id to its result from
+// the XCCDF results file
+func parseOpenSCAPResults(results []byte) (map[string]string, error) {
+	var ruleResults []openSCAPRuleResult
+
+	decoder := xml.NewDecoder(bytes.NewReader(results))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot parse the results file: %v", err)
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "rule-result" {
+			continue
+		}
+
+		var ruleResult openSCAPRuleResult
+		err = decoder.DecodeElement(&ruleResult, &element)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode a rule result: %v", err)
+		}
+		ruleResults = append(ruleResults, ruleResult)
+	}
+
+	if len(ruleResults) == 0 {
+		return nil, fmt.Errorf("the results file contains no rule results")
+	}
+
+	resultMap := make(map[string]string)
+	for _, r := range ruleResults {
+		resultMap[r.IDRef] = r.Result
+	}
+
+	return resultMap, nil
+}
+
+// findRuleResult looks the rule up either by its full id or by its
+// short name
+func findRuleResult(results map[string]string, rule string) (string, bool) {
+	if result, exists := results[rule]; exists {
+		return result, true
+	}
+
+	for id, result := range results {
+		if strings.HasSuffix(id, "_rule_"+rule) {
+			return result, true
+		}
+	}
+
+	return "", false
+}
+
+// checkOpenSCAP runs the OpenSCAP scan in the booted image and copies
+// the report into the output directory. It's skipped if oscap or
+// the datastream isn't available in the image.
+func checkOpenSCAP(target sshTarget, expected *openSCAPExpectation, outputDirectory string) error {
+	if expected.Profile == "" || expected.Datastream == "" {
+		return fmt.Errorf("openscap: both profile and datastream must be specified")
+	}
+
+	timeout := 30 * time.Minute
+	if expected.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(expected.Timeout)
+		if err != nil {
+			return fmt.Errorf("openscap: invalid timeout: %v", err)
+		}
+	}
+
+	run := func(command string) (string, error) {
+		return runSSHCommand(target, command)
+	}
+
+	if len(expected.Packages) > 0 {
+		_, err := runSSHCommandWithTimeout(target, "sudo dnf -y install "+strings.Join(expected.Packages, " "), timeout)
+		if err != nil {
+			return fmt.Errorf("openscap: cannot install the content: %v", err)
+		}
+	}
+
+	_, err := run(fmt.Sprintf("command -v oscap && test -f %s", expected.Datastream))
+	if err != nil {
+		return &checkSkippedError{"oscap or the datastream is not available in the image"}
+	}
+
+	// the results of an earlier scan must not be taken for the results of
+	// this one
+	_, err = run(fmt.Sprintf("sudo rm -f %s %s", openSCAPResultsPath, openSCAPReportPath))
+	if err != nil {
+		return fmt.Errorf("openscap: cannot remove the previous results: %v", err)
+	}
+
+	// oscap exits with 2 if any rule fails, this is evaluated below
+	_, err = runSSHCommandWithTimeout(target, fmt.Sprintf(
+		"sudo oscap xccdf eval --profile %s --results %s --report %s %s >/dev/null; test -f %s",
+		expected.Profile, openSCAPResultsPath, openSCAPReportPath, expected.Datastream, openSCAPResultsPath,
+	), timeout)
+	if err != nil {
+		return fmt.Errorf("openscap: the scan failed: %v", err)
+	}
+
+	report, err := run("sudo cat " + openSCAPReportPath)
+	if err != nil {
+		return fmt.Errorf("openscap: cannot read the report: %v", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(outputDirectory, "oscap-report.html"), []byte(report), 0644)
+	if err != nil {
+		return fmt.Errorf("openscap: cannot save the report: %v", err)
+	}
+
+	rawResults, err := run("sudo cat " + openSCAPResultsPath)
+	if err != nil {
+		return fmt.Errorf("openscap: cannot read the results: %v", err)
+	}
+
+	results, err := parseOpenSCAPResults([]byte(rawResults))
+	if err != nil {
+		return fmt.Errorf("openscap: %v", err)
+	}
+
+	var problems []string
+
+	passed, failed := 0, 0
+	for _, result := range results {
+		switch result {
+		case "pass":
+			passed++
+		case "fail", "error":
+			failed++
+		}
+	}
+
+	// a wrong profile or datastream evaluates nothing, which must not pass
+	if passed+failed == 0 {
+		return fmt.Errorf("openscap: no rules evaluated using profile %s, check the profile and the datastream", expected.Profile)
+	}
+
+	passRate := float64(passed) / float64(passed+failed)
+	if passRate < expected.MinPassRate {
+		problems = append(problems, fmt.Sprintf("pass rate %.2f is lower than %.2f (%d passed, %d failed)", passRate, expected.MinPassRate, passed, failed))
+	}
+
+	for _, rule := range expected.Rules {
+		result, exists := findRuleResult(results, rule)
+		if !exists {
+			problems = append(problems, fmt.Sprintf("rule %s was not evaluated", rule))
+		} else if result != "pass" {
+			problems = append(problems, fmt.Sprintf("rule %s: %s", rule, result))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("openscap scan using profile %s did not meet the expectations:\n%s", expected.Profile, strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
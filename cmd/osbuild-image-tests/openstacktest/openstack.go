@@ -5,12 +5,15 @@ package openstacktest
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/cloudtest"
 )
 
 const WaitTimeout = 600 // in seconds
@@ -20,7 +23,7 @@ func UploadImageToOpenStack(p *gophercloud.ProviderClient, imagePath string, ima
 		Region: os.Getenv("OS_REGION_NAME"),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("Error creating ImageService client: %v", err)
+		return nil, cloudtest.Wrapf(err, "Error creating ImageService client")
 	}
 
 	// create a new image which gives us the ID
@@ -30,7 +33,7 @@ func UploadImageToOpenStack(p *gophercloud.ProviderClient, imagePath string, ima
 		ContainerFormat: "bare",
 	}).Extract()
 	if err != nil {
-		return image, fmt.Errorf("Creating image failed: %v", err)
+		return image, cloudtest.Wrapf(err, "Creating image failed")
 	}
 
 	// then upload the actual binary data
@@ -42,7 +45,7 @@ func UploadImageToOpenStack(p *gophercloud.ProviderClient, imagePath string, ima
 
 	err = imagedata.Upload(client, image.ID, imageData).ExtractErr()
 	if err != nil {
-		return image, fmt.Errorf("Upload to OpenStack failed: %v", err)
+		return image, cloudtest.Wrapf(err, "Upload to OpenStack failed")
 	}
 
 	// wait for the status to change from Queued to Active
@@ -51,12 +54,41 @@ func UploadImageToOpenStack(p *gophercloud.ProviderClient, imagePath string, ima
 		return actual.Status == images.ImageStatusActive, err
 	})
 	if err != nil {
-		return image, fmt.Errorf("Waiting for image to become Active failed: %v", err)
+		return image, cloudtest.Wrapf(err, "Waiting for image to become Active failed")
 	}
 
 	return image, nil
 }
 
+// ListImagesInOpenStack returns the images whose names start with the prefix
+func ListImagesInOpenStack(p *gophercloud.ProviderClient, prefix string) ([]images.Image, error) {
+	client, err := openstack.NewImageServiceV2(p, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating ImageService client: %v", err)
+	}
+
+	pages, err := images.List(client, images.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the images: %v", err)
+	}
+
+	allImages, err := images.ExtractImages(pages)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract the images: %v", err)
+	}
+
+	var result []images.Image
+	for _, image := range allImages {
+		if strings.HasPrefix(image.Name, prefix) {
+			result = append(result, image)
+		}
+	}
+
+	return result, nil
+}
+
 func DeleteImageFromOpenStack(p *gophercloud.ProviderClient, imageUUID string) error {
 	client, err := openstack.NewImageServiceV2(p, gophercloud.EndpointOpts{
 		Region: os.Getenv("OS_REGION_NAME"),
@@ -73,7 +105,92 @@ func DeleteImageFromOpenStack(p *gophercloud.ProviderClient, imageUUID string) e
 	return nil
 }
 
-func WithBootedImageInOpenStack(p *gophercloud.ProviderClient, imageID, userData string, f func(address string) error) (retErr error) {
+const (
+	defaultFlavor  = "77b8cf27-be16-40d9-95b1-81db4522be1e" // ci.m1.medium.ephemeral
+	defaultNetwork = "74e8faa7-87ba-41b2-a000-438013194814" // provider_net_cci_2
+)
+
+// InstanceOptions selects the flavor and the network of the booted instance,
+// both can be given either by name or by ID
+type InstanceOptions struct {
+	Flavor  string
+	Network string
+}
+
+// InstanceOptionsFromEnv reads the instance options from OS_FLAVOR and
+// OS_NETWORK, the defaults are used for the unset ones
+func InstanceOptionsFromEnv() InstanceOptions {
+	opts := InstanceOptions{
+		Flavor:  os.Getenv("OS_FLAVOR"),
+		Network: os.Getenv("OS_NETWORK"),
+	}
+
+	if opts.Flavor == "" {
+		opts.Flavor = defaultFlavor
+	}
+	if opts.Network == "" {
+		opts.Network = defaultNetwork
+	}
+
+	return opts
+}
+
+// namedResource is a flavor or a network as returned by the list calls
+type namedResource struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// findResource returns the resource whose ID or name is wanted. If there's
+// none, the error lists the available ones.
+func findResource(kind, wanted string, available []namedResource) (*namedResource, error) {
+	var names []string
+	for i, r := range available {
+		if r.ID == wanted || r.Name == wanted {
+			return &available[i], nil
+		}
+		names = append(names, fmt.Sprintf("%s (%s)", r.Name, r.ID))
+	}
+
+	return nil, fmt.Errorf("The %s %s does not exist, available: %s", kind, wanted, strings.Join(names, ", "))
+}
+
+// resolveFlavor returns the flavor given by name or ID. The flavors
+// package of gophercloud is not vendored, so the API is called directly.
+func resolveFlavor(client *gophercloud.ServiceClient, flavor string) (*namedResource, error) {
+	var body struct {
+		Flavors []namedResource `json:"flavors"`
+	}
+	_, err := client.Get(client.ServiceURL("flavors"), &body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list flavors: %v", err)
+	}
+
+	return findResource("flavor", flavor, body.Flavors)
+}
+
+// resolveNetwork returns the network given by name or ID. The networking
+// package of gophercloud is not vendored, so the API is called directly.
+func resolveNetwork(p *gophercloud.ProviderClient, network string) (*namedResource, error) {
+	client, err := openstack.NewNetworkV2(p, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Network client: %v", err)
+	}
+
+	var body struct {
+		Networks []namedResource `json:"networks"`
+	}
+	_, err = client.Get(client.ServiceURL("networks"), &body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list networks: %v", err)
+	}
+
+	return findResource("network", network, body.Networks)
+}
+
+func WithBootedImageInOpenStack(p *gophercloud.ProviderClient, imageID, userData string, opts InstanceOptions, keep func() bool, f func(address string) error) (retErr error) {
 	client, err := openstack.NewComputeV2(p, gophercloud.EndpointOpts{
 		Region: os.Getenv("OS_REGION_NAME"),
 	})
@@ -81,11 +198,21 @@ func WithBootedImageInOpenStack(p *gophercloud.ProviderClient, imageID, userData
 		return fmt.Errorf("Error creating Compute client: %v", err)
 	}
 
+	flavor, err := resolveFlavor(client, opts.Flavor)
+	if err != nil {
+		return err
+	}
+
+	network, err := resolveNetwork(p, opts.Network)
+	if err != nil {
+		return err
+	}
+
 	server, err := servers.Create(client, servers.CreateOpts{
 		Name:      "osbuild-composer-vm-for-" + imageID,
-		FlavorRef: "77b8cf27-be16-40d9-95b1-81db4522be1e", // ci.m1.medium.ephemeral
-		Networks: []servers.Network{  // provider_net_cci_2
-			servers.Network{UUID: "74e8faa7-87ba-41b2-a000-438013194814"},
+		FlavorRef: flavor.ID,
+		Networks: []servers.Network{
+			servers.Network{UUID: network.ID},
 		},
 		ImageRef:  imageID,
 		UserData: []byte(userData),
@@ -96,6 +223,11 @@ func WithBootedImageInOpenStack(p *gophercloud.ProviderClient, imageID, userData
 
 	// cleanup
 	defer func(){
+		if keep() {
+			fmt.Printf("Keeping instance %s running\n", server.ID)
+			return
+		}
+
 		err := servers.ForceDelete(client, server.ID).ExtractErr()
 		if err != nil {
 			fmt.Printf("Force deleting instance %s failed: %v", server.ID, err)
@@ -118,7 +250,11 @@ func WithBootedImageInOpenStack(p *gophercloud.ProviderClient, imageID, userData
 	// server.AccessIPv4 is empty so list all addresses and
 	// get the first fixed one. ssh should be equally happy with v4 or v6
 	var fixedIP string
-	for _, networkAddresses := range server.Addresses["provider_net_cci_2"].([]interface{}) {
+	addresses, ok := server.Addresses[network.Name].([]interface{})
+	if !ok {
+		return fmt.Errorf("Instance %s has no addresses in the network %s", server.ID, network.Name)
+	}
+	for _, networkAddresses := range addresses {
 		address := networkAddresses.(map[string]interface{})
 		if address["OS-EXT-IPS:type"] == "fixed" {
 			fixedIP = address["addr"].(string)
@@ -0,0 +1,71 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// packageSpecs returns the specs matching the package given as
+// name-version-release.arch by image-info: the name, name-version,
+// name-version-release and the full string
+func packageSpecs(pkg string) []string {
+	specs := []string{pkg}
+
+	nvr := pkg
+	if i := strings.LastIndex(nvr, "."); i != -1 {
+		nvr = nvr[:i]
+	}
+	specs = append(specs, nvr)
+
+	i := strings.LastIndex(nvr, "-")
+	if i == -1 {
+		return specs
+	}
+	nv := nvr[:i]
+	specs = append(specs, nv)
+
+	i = strings.LastIndex(nv, "-")
+	if i == -1 {
+		return specs
+	}
+
+	return append(specs, nv[:i])
+}
+
+// testPackages checks that the required packages are installed in the image
+// and the forbidden ones are not. The packages are given by their name,
+// optionally pinned to a version using name-version or
+// name-version-release.
+func testPackages(imageInfo interface{}, required, forbidden []string) error {
+	packages, err := imageInfoPackages(imageInfo)
+	if err != nil {
+		return err
+	}
+
+	installed := make(map[string][]string)
+	for _, pkg := range packages {
+		for _, spec := range packageSpecs(pkg) {
+			installed[spec] = append(installed[spec], pkg)
+		}
+	}
+
+	var failures []string
+	for _, spec := range required {
+		if len(installed[spec]) == 0 {
+			failures = append(failures, fmt.Sprintf("%s is not installed", spec))
+		}
+	}
+	for _, spec := range forbidden {
+		if matches := installed[spec]; len(matches) > 0 {
+			failures = append(failures, fmt.Sprintf("%s is installed (%s)", spec, strings.Join(matches, ", ")))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("the packages don't match the expectations:\n%s", strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultSizeTolerance is the relative difference between the expected
+// and the actual partition size allowed if the expectation doesn't set one
+const defaultSizeTolerance = 0.05
+
+// partitionAssertions describes the expected partition layout of the image,
+// only the given fields are checked
+type partitionAssertions struct {
+	// PartitionTable is the expected type of the partition table, e.g. gpt
+	// or dos
+	PartitionTable string `json:"partition-table"`
+	// Partitions must all be present in the image, other partitions are
+	// allowed
+	Partitions []partitionExpectation `json:"partitions"`
+}
+
+// partitionExpectation describes one partition, empty fields are not checked
+type partitionExpectation struct {
+	Label  string `json:"label"`
+	FSType string `json:"fstype"`
+	// Mountpoint is looked up in the fstab of the image, use "swap"
+	// for swap partitions
+	Mountpoint string `json:"mountpoint"`
+	// Size is the approximate size in bytes
+	Size int64 `json:"size"`
+	// SizeTolerance is the allowed relative difference from Size,
+	// defaultSizeTolerance is used if zero
+	SizeTolerance float64 `json:"size-tolerance"`
+}
+
+// imageInfoPartition is a partition as reported by image-info
+type imageInfoPartition struct {
+	Label  *string `json:"label"`
+	FSType *string `json:"fstype"`
+	UUID   *string `json:"uuid"`
+	Size   int64   `json:"size"`
+}
+
+// String returns a short description of the partition used in errors
+func (p imageInfoPartition) String() string {
+	str := func(s *string) string {
+		if s == nil {
+			return "-"
+		}
+		return *s
+	}
+
+	return fmt.Sprintf("label=%s fstype=%s uuid=%s size=%d", str(p.Label), str(p.FSType), str(p.UUID), p.Size)
+}
+
+// imageInfoLayout is the subset of the image-info output describing
+// the partitions
+type imageInfoLayout struct {
+	PartitionTable string               `json:"partition-table"`
+	Partitions     []imageInfoPartition `json:"partitions"`
+	Fstab          [][]string           `json:"fstab"`
+}
+
+// parseImageInfoLayout extracts the partition table from the image-info output
+func parseImageInfoLayout(imageInfo interface{}) (*imageInfoLayout, error) {
+	// the image info is already decoded, encode it again to decode only
+	// the interesting parts into a struct
+	raw, err := json.Marshal(imageInfo)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode the image info: %v", err)
+	}
+
+	var layout imageInfoLayout
+	err = json.Unmarshal(raw, &layout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the partitions from the image info: %v", err)
+	}
+
+	return &layout, nil
+}
+
+// mountpoint returns the mountpoint of the partition according to fstab,
+// or an empty string if the partition is not listed in it
+func (l *imageInfoLayout) mountpoint(p imageInfoPartition) string {
+	for _, entry := range l.Fstab {
+		if len(entry) < 2 {
+			continue
+		}
+
+		device := entry[0]
+		if p.UUID != nil && device == "UUID="+*p.UUID {
+			return entry[1]
+		}
+		if p.Label != nil && device == "LABEL="+*p.Label {
+			return entry[1]
+		}
+	}
+
+	return ""
+}
+
+// matches returns true if the partition satisfies all fields of the
+// expectation
+func (l *imageInfoLayout) matches(p imageInfoPartition, expected partitionExpectation) bool {
+	if expected.Label != "" && (p.Label == nil || *p.Label != expected.Label) {
+		return false
+	}
+
+	if expected.FSType != "" && (p.FSType == nil || *p.FSType != expected.FSType) {
+		return false
+	}
+
+	if expected.Mountpoint != "" && l.mountpoint(p) != expected.Mountpoint {
+		return false
+	}
+
+	if expected.Size != 0 {
+		tolerance := expected.SizeTolerance
+		if tolerance == 0 {
+			tolerance = defaultSizeTolerance
+		}
+
+		diff := float64(p.Size - expected.Size)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > tolerance*float64(expected.Size) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// testPartitions checks the partition layout reported by image-info against
+// the assertions. Every expected partition must match a different partition
+// of the image.
+func testPartitions(imageInfo interface{}, assertions *partitionAssertions) error {
+	layout, err := parseImageInfoLayout(imageInfo)
+	if err != nil {
+		return err
+	}
+
+	if assertions.PartitionTable != "" && layout.PartitionTable != assertions.PartitionTable {
+		return fmt.Errorf("expected a %s partition table, the image has %q", assertions.PartitionTable, layout.PartitionTable)
+	}
+
+	used := make([]bool, len(layout.Partitions))
+	var unmatched []string
+	for _, expected := range assertions.Partitions {
+		found := false
+		for i, p := range layout.Partitions {
+			if !used[i] && layout.matches(p, expected) {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			unmatched = append(unmatched, fmt.Sprintf("%+v", expected))
+		}
+	}
+
+	if len(unmatched) > 0 {
+		var partitions []string
+		for _, p := range layout.Partitions {
+			partitions = append(partitions, p.String())
+		}
+
+		return fmt.Errorf("no partition matches %s, the image has partitions:\n%s", strings.Join(unmatched, ", "), strings.Join(partitions, "\n"))
+	}
+
+	return nil
+}
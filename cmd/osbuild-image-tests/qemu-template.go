@@ -0,0 +1,56 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The placeholders of a qemu arguments template, the harness replaces them
+// with the arguments it manages. All of them are mandatory.
+const (
+	qemuDiskPlaceholder   = "{disk}"
+	qemuNetdevPlaceholder = "{netdev}"
+	qemuSerialPlaceholder = "{serial}"
+)
+
+// validateQemuArgsTemplate checks that every placeholder is used exactly
+// once as a standalone argument
+func validateQemuArgsTemplate(template string) error {
+	for _, placeholder := range []string{qemuDiskPlaceholder, qemuNetdevPlaceholder, qemuSerialPlaceholder} {
+		count := 0
+		for _, arg := range strings.Fields(template) {
+			if arg == placeholder {
+				count++
+			}
+		}
+
+		if count != 1 {
+			return fmt.Errorf("the qemu arguments template must contain %s exactly once as a separate argument", placeholder)
+		}
+	}
+
+	return nil
+}
+
+// expandQemuArgsTemplate splits the whitespace-separated template into
+// arguments and replaces the placeholders with the managed arguments.
+// The template must be validated using validateQemuArgsTemplate.
+func expandQemuArgsTemplate(template string, diskArgs, netdevArgs, serialArgs []string) []string {
+	var args []string
+	for _, arg := range strings.Fields(template) {
+		switch arg {
+		case qemuDiskPlaceholder:
+			args = append(args, diskArgs...)
+		case qemuNetdevPlaceholder:
+			args = append(args, netdevArgs...)
+		case qemuSerialPlaceholder:
+			args = append(args, serialArgs...)
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	return args
+}
@@ -0,0 +1,205 @@
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/osbuild/osbuild-composer/internal/common"
+)
+
+// remoteBuildersFlag implements flag.Value for the repeatable
+// -remote-builder flag. The value is ARCH=USER@HOST.
+type remoteBuildersFlag map[string]string
+
+func (f remoteBuildersFlag) String() string {
+	var builders []string
+	for arch, host := range f {
+		builders = append(builders, arch+"="+host)
+	}
+	sort.Strings(builders)
+	return strings.Join(builders, " ")
+}
+
+func (f remoteBuildersFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid remote builder %s, use ARCH=USER@HOST", value)
+	}
+
+	if _, exists := f[parts[0]]; exists {
+		return fmt.Errorf("more than one remote builder given for %s", parts[0])
+	}
+
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// remoteBuilders are the hosts building the images of the other arches
+// than the current one, by arch
+var remoteBuilders = remoteBuildersFlag{}
+
+// remoteBuilderFor returns the remote builder of the arch, images of the
+// current arch are always built locally
+func remoteBuilderFor(arch string) (string, bool) {
+	if arch == common.CurrentArch() {
+		return "", false
+	}
+
+	builder, exists := remoteBuilders[arch]
+	return builder, exists
+}
+
+// remoteCommand returns the command running the shell command on the
+// builder. The builder must be reachable without a password and its user
+// must be allowed to use sudo without a password.
+func remoteCommand(ctx context.Context, builder, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh",
+		"-o", "BatchMode=yes",
+		builder,
+		command,
+	)
+}
+
+// runRemoteCommand runs the shell command on the builder and returns its
+// standard output
+func runRemoteCommand(builder, command string) (string, error) {
+	cmd := remoteCommand(context.Background(), builder, command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running %q on %s failed: %v\n%s", command, builder, err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// remoteEnvPrefix returns the env command setting the variables on the
+// builder, the values are quoted for the remote shell
+func remoteEnvPrefix(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assignments := []string{"env"}
+	for _, name := range names {
+		assignments = append(assignments, name+"='"+strings.Replace(env[name], "'", `'\''`, -1)+"'")
+	}
+
+	return strings.Join(assignments, " ") + " "
+}
+
+// runRemoteOsbuild builds the manifest on the builder and copies the
+// artifacts into the output directory. The builder uses a temporary store
+// and output directory, both are removed afterwards.
+func runRemoteOsbuild(builder string, manifest []byte, env map[string]string, outputDirectory string, timings *caseTimings) error {
+	dir, err := runRemoteCommand(builder, "mktemp -d /var/tmp/osbuild-image-tests-XXXXXX")
+	if err != nil {
+		return fmt.Errorf("cannot create a build directory on the remote builder: %v", err)
+	}
+
+	defer func() {
+		_, err := runRemoteCommand(builder, "sudo -n rm -rf "+dir)
+		if err != nil {
+			harnessLog.Warningf("cannot remove the build directory on %s: %v", builder, err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *buildTimeout)
+	defer cancel()
+
+	// the build is stopped as soon as the run is aborted
+	go func() {
+		select {
+		case <-abortedRun.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	command := fmt.Sprintf("sudo -n %sosbuild --store %s/store --output-directory %s/output --json -", remoteEnvPrefix(env), dir, dir)
+	cmd := remoteCommand(ctx, builder, command)
+	cmd.Stdin = bytes.NewReader(manifest)
+
+	var outBuffer bytes.Buffer
+	var output io.Writer = &outBuffer
+	if *streamOsbuild {
+		output = io.MultiWriter(&outBuffer, os.Stdout)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err = cmd.Run()
+	if runAborted() && ctx.Err() != nil {
+		return errAborted
+	}
+	if err != nil {
+		fmt.Println(outBuffer.String())
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("osbuild did not finish on %s in %v and was killed", builder, *buildTimeout)
+		}
+		return fmt.Errorf("running osbuild on %s failed: %v", builder, err)
+	}
+	timings.recordBuild(time.Since(start), parseStageTimings(outBuffer.Bytes()))
+
+	version, err := runRemoteCommand(builder, "osbuild --version")
+	if err != nil {
+		return fmt.Errorf("cannot get the osbuild version on %s: %v", builder, err)
+	}
+
+	// stream the artifacts back, the output directory is owned by root
+	pull := remoteCommand(context.Background(), builder, "sudo -n tar -C "+dir+"/output -cf - .")
+	extract := exec.Command("tar", "-C", outputDirectory, "-xf", "-")
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("cannot create a pipe: %v", err)
+	}
+
+	var pullStderr, extractStderr bytes.Buffer
+	pull.Stdout = writer
+	pull.Stderr = &pullStderr
+	extract.Stdin = reader
+	extract.Stderr = &extractStderr
+
+	err = extract.Start()
+	if err != nil {
+		reader.Close()
+		writer.Close()
+		return fmt.Errorf("cannot extract the artifacts: %v", err)
+	}
+	// only the child processes use the pipe now
+	reader.Close()
+
+	pullErr := pull.Start()
+	if pullErr == nil {
+		pullErr = pull.Wait()
+	}
+	writer.Close()
+	extractErr := extract.Wait()
+	if pullErr != nil {
+		return fmt.Errorf("cannot pull the artifacts from %s: %v\n%s", builder, pullErr, pullStderr.String())
+	}
+	if extractErr != nil {
+		return fmt.Errorf("cannot extract the artifacts: %v\n%s", extractErr, extractStderr.String())
+	}
+
+	return recordOsbuildVersion(outputDirectory, version)
+}
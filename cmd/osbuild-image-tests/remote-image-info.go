@@ -0,0 +1,140 @@
+// +build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/constants"
+)
+
+// remoteImageInfoTimeout is the maximal time image-info can run in the guest
+const remoteImageInfoTimeout = 30 * time.Minute
+
+// remoteImageInfoPath is where image-info is copied in the guest
+const remoteImageInfoPath = "/tmp/image-info"
+
+// remoteImageInfoCheck is the image info expected from the image, it's
+// verified by the boot test when -remote-image-info is given
+type remoteImageInfoCheck struct {
+	testcasePath string
+	expected     []byte
+	ignorePaths  []string
+}
+
+// remoteImageInfoAvailable returns true if the image info of the testcase
+// can be collected in the cloud instead of locally. Only aws supports it,
+// and only if the image is really booted there instead of in qemu.
+func remoteImageInfoAvailable(boot *bootStruct) bool {
+	if !*remoteImageInfo || boot == nil || boot.Type != "aws" || *targetAddress != "" {
+		return false
+	}
+
+	creds, err := getAWSCredentialsFromEnv()
+	return err == nil && creds != nil
+}
+
+// guestVolumeDevice returns the block device of the attached volume in the
+// guest. NVMe volumes have the volume id without the dash as their serial,
+// Xen instances show the volume under its attachment name.
+func guestVolumeDevice(run guestCommandRunner, volumeId string) (string, error) {
+	out, err := run("lsblk --nodeps --noheadings --output NAME,SERIAL")
+	if err != nil {
+		return "", fmt.Errorf("cannot list the block devices of the guest: %v", err)
+	}
+
+	serial := strings.Replace(volumeId, "-", "", 1)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == serial {
+			return "/dev/" + fields[0], nil
+		}
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "xvdf" {
+			return "/dev/xvdf", nil
+		}
+	}
+
+	return "", fmt.Errorf("the volume %s is not visible in the guest:\n%s", volumeId, out)
+}
+
+// copyImageInfoToGuest copies the local image-info to the guest
+func copyImageInfoToGuest(target sshTarget) error {
+	imageInfo, err := os.Open(constants.TestPaths.ImageInfo)
+	if err != nil {
+		return fmt.Errorf("cannot open image-info: %v", err)
+	}
+	defer imageInfo.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cmd := sshCommandContext(ctx, target, "cat > "+remoteImageInfoPath)
+	cmd.Stdin = imageInfo
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot copy image-info to the guest: %v\n%s", err, out)
+	}
+
+	return nil
+}
+
+// runRemoteImageInfo runs image-info on the block device of the guest,
+// the guest must provide the tools image-info needs (python3, qemu-img)
+func runRemoteImageInfo(target sshTarget, device string) (interface{}, error) {
+	err := copyImageInfoToGuest(target)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runSSHCommandWithTimeout(target, "sudo python3 "+remoteImageInfoPath+" "+device, remoteImageInfoTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var imageInfo interface{}
+	err = json.Unmarshal([]byte(out), &imageInfo)
+	if err != nil {
+		return nil, fmt.Errorf("decoding image-info output failed: %#v", err)
+	}
+
+	return imageInfo, nil
+}
+
+// testRemoteImageInfo attaches a volume created from the snapshot of the
+// uploaded image to the booted instance, runs image-info on it over ssh
+// and compares the result with the expected image info. This avoids
+// downloading multi-gigabyte images to inspect them.
+func testRemoteImageInfo(t *testing.T, e *ec2.EC2, instanceId string, imageDesc *imageDescription, target sshTarget, check *remoteImageInfoCheck) {
+	runner := func(command string) (string, error) {
+		return runSSHCommand(target, command)
+	}
+
+	err := withAttachedEC2Volume(e, instanceId, *imageDesc.SnapshotId, func(volumeId string) error {
+		device, err := guestVolumeDevice(runner, volumeId)
+		if err != nil {
+			return err
+		}
+
+		imageInfoGot, err := runRemoteImageInfo(target, device)
+		if err != nil {
+			return err
+		}
+
+		compareImageInfo(t, check.testcasePath, imageInfoGot, check.expected, check.ignorePaths)
+		return nil
+	})
+	require.NoError(t, err, "cannot collect the image info in the aws instance")
+}
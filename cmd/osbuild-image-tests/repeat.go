@@ -0,0 +1,62 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/summary"
+)
+
+// sharedBuild is the image built by the first run of a testcase and reused
+// by the other runs when -reuse-image is given
+type sharedBuild struct {
+	once            sync.Once
+	outputDirectory string
+	// imagePath is empty if the build failed
+	imagePath string
+	manifest  []byte
+}
+
+// repeatedCaseName returns the name of the nth run of the testcase, the name
+// is unchanged if the testcase runs only once
+func repeatedCaseName(name string, run, repeat int) string {
+	if repeat == 1 {
+		return name
+	}
+
+	return fmt.Sprintf("%s:run-%d", name, run)
+}
+
+// useQemuOverlay returns whether qemu boots the images from a temporary
+// overlay. The runs of a repeated testcase can boot the same image, each of
+// them has to start from the built image, not from the state left by the
+// previous run.
+func useQemuOverlay(overlay bool, repeat int) bool {
+	return overlay || repeat > 1
+}
+
+// repeatCounts counts the results of all the runs of a testcase
+type repeatCounts map[summary.Result]int
+
+// formatRepeatCounts returns a report of the pass/fail counts of each
+// testcase, sorted by the testcase name
+func formatRepeatCounts(counts map[string]repeatCounts) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		c := counts[name]
+		runs := c[summary.Passed] + c[summary.Failed] + c[summary.Skipped]
+		lines = append(lines, fmt.Sprintf("%s: %d passed, %d failed, %d skipped of %d runs", name, c[summary.Passed], c[summary.Failed], c[summary.Skipped], runs))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,16 @@
+// +build integration
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseQemuOverlay(t *testing.T) {
+	assert.False(t, useQemuOverlay(false, 1))
+	assert.True(t, useQemuOverlay(true, 1))
+	assert.True(t, useQemuOverlay(false, 2))
+	assert.True(t, useQemuOverlay(true, 3))
+}
@@ -0,0 +1,72 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// capturedImageInfoFile is the name of the file holding the image info
+// in the artifacts directory of a testcase
+const capturedImageInfoFile = "image-info.json"
+
+// artifactsDirectory returns the directory holding the artifacts of
+// the testcase, it's named after the testcase file
+func artifactsDirectory(root string, testcase testcaseStruct) string {
+	return path.Join(root, strings.TrimSuffix(path.Base(testcase.path), ".json"))
+}
+
+// loadArtifacts checks that the artifacts directory contains everything
+// needed to replay the testcase and returns the captured image info
+func loadArtifacts(directory string, testcase testcaseStruct) (interface{}, error) {
+	imagePath := path.Join(directory, testcase.ComposeRequest.Filename)
+	_, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("the stored artifacts are incomplete, the image is missing: %v", err)
+	}
+
+	rawImageInfo, err := ioutil.ReadFile(path.Join(directory, capturedImageInfoFile))
+	if err != nil {
+		return nil, fmt.Errorf("the stored artifacts are incomplete, the image info is missing: %v", err)
+	}
+
+	var imageInfo interface{}
+	err = json.Unmarshal(rawImageInfo, &imageInfo)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the stored image info: %v", err)
+	}
+
+	return imageInfo, nil
+}
+
+// replayTestcase runs the image info, partition, service and package
+// assertions of the testcase against previously stored artifacts, nothing
+// is built or booted
+func replayTestcase(t *testing.T, testcase testcaseStruct, root string, recorder *caseRecorder) {
+	if testcase.ImageInfo == nil && testcase.PartitionAssertions == nil && testcase.ServiceAssertions == nil &&
+		testcase.BootloaderAssertions == nil && len(testcase.RequirePackages) == 0 && len(testcase.ForbidPackages) == 0 {
+		recorder.Skipf(t, "the test case has no image info assertions, nothing to replay")
+	}
+
+	imageInfo, err := loadArtifacts(artifactsDirectory(root, testcase), testcase)
+	require.NoError(t, err)
+
+	if testcase.ImageInfo != nil {
+		recorder.Run(t, "image info", func(t *testing.T) {
+			compareImageInfo(t, testcase.path, imageInfo, testcase.ImageInfo, testcase.IgnorePaths)
+		})
+	}
+
+	imagePath := path.Join(artifactsDirectory(root, testcase), testcase.ComposeRequest.Filename)
+	testImageInfoAssertions(t, testcase, imagePath, func() (interface{}, error) {
+		return imageInfo, nil
+	}, recorder)
+}
@@ -0,0 +1,122 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+)
+
+// harnessOutputFiles are written into the output directory by the harness,
+// not by osbuild
+var harnessOutputFiles = map[string]bool{
+	"manifest.json":     true,
+	"oscap-report.html": true,
+	osbuildVersionFile:  true,
+}
+
+// outputDigests returns the sha256 digests of the regular files written by
+// osbuild into the output directory, by their path relative to it
+func outputDigests(outputDirectory string) (map[string]string, error) {
+	digests := make(map[string]string)
+	err := filepath.Walk(outputDirectory, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(outputDirectory, filePath)
+		if err != nil {
+			return err
+		}
+
+		if harnessOutputFiles[relative] {
+			return nil
+		}
+
+		digests[relative], err = sha256File(filePath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute the digests of %s: %v", outputDirectory, err)
+	}
+
+	return digests, nil
+}
+
+// compareDigests returns the files present in only one of the outputs or
+// with different digests, sorted by their path
+func compareDigests(first, second map[string]string) []string {
+	var problems []string
+	for file, digest := range first {
+		other, exists := second[file]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("%s: only in the first build", file))
+		} else if other != digest {
+			problems = append(problems, fmt.Sprintf("%s: sha256 %s in the first build, %s in the second one", file, digest, other))
+		}
+	}
+	for file := range second {
+		if _, exists := first[file]; !exists {
+			problems = append(problems, fmt.Sprintf("%s: only in the second build", file))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// testReproducibility builds the manifest a second time, bypassing the
+// image cache, and compares the image info and the file digests of both
+// builds. The ignore paths of the testcase are left out of the image info
+// comparison.
+func testReproducibility(t *testing.T, testcase testcaseStruct, manifest []byte, stores storePool, imagePath string) {
+	outputDirectory := createOutputDirectory(t)
+	defer func() {
+		err := os.RemoveAll(outputDirectory)
+		require.NoError(t, err, "error removing temporary output directory")
+	}()
+
+	// the timings of the second build are not reported
+	err := buildManifest(t, testcase, manifest, stores, outputDirectory, &caseTimings{})
+	if err != nil && runAborted() {
+		t.Skip(earlierFailureMessage)
+	}
+	require.NoError(t, err, "the second build failed")
+
+	secondImagePath := path.Join(outputDirectory, testcase.ComposeRequest.Filename)
+
+	firstInfo, err := runImageInfo(imagePath)
+	require.NoError(t, err)
+	secondInfo, err := runImageInfo(secondImagePath)
+	require.NoError(t, err)
+
+	firstInfo, err = withoutIgnoredPaths(firstInfo, testcase.IgnorePaths)
+	require.NoError(t, err)
+	secondInfo, err = withoutIgnoredPaths(secondInfo, testcase.IgnorePaths)
+	require.NoError(t, err)
+
+	diff := cmp.Diff(firstInfo, secondInfo)
+	if diff != "" {
+		t.Errorf("the image info differs between the builds (-first +second):\n%s", diff)
+	}
+
+	firstDigests, err := outputDigests(path.Dir(imagePath))
+	require.NoError(t, err)
+	secondDigests, err := outputDigests(outputDirectory)
+	require.NoError(t, err)
+
+	if problems := compareDigests(firstDigests, secondDigests); len(problems) > 0 {
+		t.Errorf("the artifacts differ between the builds:\n%s", strings.Join(problems, "\n"))
+	}
+}
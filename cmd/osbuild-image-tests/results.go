@@ -0,0 +1,98 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/summary"
+)
+
+// caseRecorder collects the details of a test case result which cannot
+// be retrieved from testing.T, they are needed for the summary and for
+// the JUnit report
+type caseRecorder struct {
+	mutex      sync.Mutex
+	skipReason string
+	subtests   []summary.Case
+	timings    caseTimings
+}
+
+// Skipf records the reason and skips the test case
+func (r *caseRecorder) Skipf(t *testing.T, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+
+	r.mutex.Lock()
+	r.skipReason = reason
+	r.mutex.Unlock()
+
+	t.Skip(reason)
+}
+
+// Run runs f as a subtest of the test case and records its result
+func (r *caseRecorder) Run(t *testing.T, name string, f func(t *testing.T)) {
+	t.Run(name, func(t *testing.T) {
+		start := time.Now()
+		// runs even if the subtest is skipped or fails
+		defer func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.subtests = append(r.subtests, summary.Case{
+				Name:     name,
+				Result:   testResult(t),
+				Duration: time.Since(start).Seconds(),
+			})
+		}()
+
+		f(t)
+	})
+}
+
+// testResult returns the result of the finished test
+func testResult(t *testing.T) summary.Result {
+	if t.Failed() {
+		return summary.Failed
+	} else if t.Skipped() {
+		return summary.Skipped
+	}
+	return summary.Passed
+}
+
+// summaryCase returns the summary of the finished testcase
+func (r *caseRecorder) summaryCase(t *testing.T, name string, testcase testcaseStruct, duration time.Duration) summary.Case {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	c := summary.Case{
+		Name:     name,
+		Distro:   testcase.ComposeRequest.Distro,
+		Arch:     testcase.ComposeRequest.Arch,
+		Result:   testResult(t),
+		Duration: duration.Seconds(),
+		Subtests: r.subtests,
+	}
+
+	switch c.Result {
+	case summary.Skipped:
+		c.Message = r.skipReason
+	case summary.Failed:
+		var failed []string
+		for _, subtest := range r.subtests {
+			if subtest.Result == summary.Failed {
+				failed = append(failed, subtest.Name)
+			}
+		}
+
+		if len(failed) > 0 {
+			c.Message = "failed subtests: " + strings.Join(failed, ", ")
+		} else {
+			c.Message = "the test case failed, see the test output for details"
+		}
+	}
+
+	return c
+}
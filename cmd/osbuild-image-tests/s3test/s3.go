@@ -0,0 +1,211 @@
+// +build integration
+
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/osbuild/osbuild-composer/cmd/osbuild-image-tests/cloudtest"
+)
+
+const (
+	defaultRegion = "us-east-1"
+
+	// partSize is the size of the parts of multipart uploads, it's needed
+	// to compute the expected etag of the uploaded object
+	partSize = 16 * 1024 * 1024
+)
+
+type s3Credentials struct {
+	// Endpoint is the URL of the S3-compatible service, e.g. a MinIO server
+	Endpoint        string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	// Region is ignored by most S3-compatible services but required
+	// by the client
+	Region string
+}
+
+// GetS3CredentialsFromEnv gets the credentials from environment variables
+// If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// S3_REGION is optional.
+func GetS3CredentialsFromEnv() (*s3Credentials, error) {
+	endpoint, eExists := os.LookupEnv("S3_ENDPOINT")
+	bucket, bExists := os.LookupEnv("S3_BUCKET")
+	accessKeyId, akExists := os.LookupEnv("S3_ACCESS_KEY_ID")
+	secretAccessKey, sakExists := os.LookupEnv("S3_SECRET_ACCESS_KEY")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !eExists && !bExists && !akExists && !sakExists {
+		return nil, nil
+	}
+	// If only some of them are not set, then fail
+	if !eExists || !bExists || !akExists || !sakExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	region, exists := os.LookupEnv("S3_REGION")
+	if !exists {
+		region = defaultRegion
+	}
+
+	return &s3Credentials{
+		Endpoint:        endpoint,
+		Bucket:          bucket,
+		AccessKeyId:     accessKeyId,
+		SecretAccessKey: secretAccessKey,
+		Region:          region,
+	}, nil
+}
+
+// newSession returns a session of the S3-compatible service, path-style
+// addressing is used because not all services support bucket subdomains
+func newSession(c *s3Credentials) (*session.Session, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials(c.AccessKeyId, c.SecretAccessKey, ""),
+		Endpoint:         aws.String(c.Endpoint),
+		Region:           aws.String(c.Region),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the s3 session: %v", err)
+	}
+
+	return sess, nil
+}
+
+// UploadImageToS3 uploads the image to the bucket under the key
+func UploadImageToS3(c *s3Credentials, imagePath, key string) error {
+	sess, err := newSession(c)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("cannot open the image: %v", err)
+	}
+	defer file.Close()
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+	if err != nil {
+		return cloudtest.Wrapf(err, "upload to s3 failed")
+	}
+
+	return nil
+}
+
+// expectedETag returns the etag of the file uploaded by UploadImageToS3.
+// It's the MD5 digest of the file for single part uploads, and the MD5
+// digest of the part digests followed by the number of parts for
+// multipart uploads.
+func expectedETag(imagePath string) (string, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot open the image: %v", err)
+	}
+	defer file.Close()
+
+	var partDigests []byte
+	parts := 0
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("cannot read the image: %v", err)
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+
+		partDigests = append(partDigests, part.Sum(nil)...)
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+
+	if parts == 1 {
+		return hex.EncodeToString(partDigests), nil
+	}
+
+	digest := md5.Sum(partDigests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(digest[:]), parts), nil
+}
+
+// VerifyImageInS3 checks that the uploaded object has the size and the etag
+// of the image
+func VerifyImageInS3(c *s3Credentials, imagePath, key string) error {
+	sess, err := newSession(c)
+	if err != nil {
+		return err
+	}
+
+	head, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get the uploaded object: %v", err)
+	}
+
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return fmt.Errorf("cannot stat the image: %v", err)
+	}
+
+	if head.ContentLength == nil || *head.ContentLength != info.Size() {
+		return fmt.Errorf("the uploaded object has the size %d, the image has %d", aws.Int64Value(head.ContentLength), info.Size())
+	}
+
+	etag, err := expectedETag(imagePath)
+	if err != nil {
+		return err
+	}
+
+	got := strings.Trim(aws.StringValue(head.ETag), "\"")
+	if got != etag {
+		return fmt.Errorf("the uploaded object has the etag %s, expected %s", got, etag)
+	}
+
+	return nil
+}
+
+// DeleteImageFromS3 deletes the object uploaded by UploadImageToS3
+func DeleteImageFromS3(c *s3Credentials, key string) error {
+	sess, err := newSession(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete the uploaded object: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// sbomExpectation describes the SBOM produced alongside the image
+type sbomExpectation struct {
+	// Path of the SPDX JSON document relative to the output directory
+	Path string
+	// Packages is the expected list of packages in the name-version-release.arch
+	// format, the packages reported by image-info are used if it's empty
+	Packages []string
+}
+
+// spdxDocument is the subset of SPDX 2.x JSON documents needed to list
+// the packages
+type spdxDocument struct {
+	Packages []struct {
+		Name         string `json:"name"`
+		VersionInfo  string `json:"versionInfo"`
+		ExternalRefs []struct {
+			ReferenceType    string `json:"referenceType"`
+			ReferenceLocator string `json:"referenceLocator"`
+		} `json:"externalRefs"`
+	} `json:"packages"`
+}
+
+// purlArch returns the arch qualifier of an rpm package url
+func purlArch(purl string) string {
+	index := strings.Index(purl, "?")
+	if !strings.HasPrefix(purl, "pkg:rpm/") || index == -1 {
+		return ""
+	}
+
+	qualifiers, err := url.ParseQuery(purl[index+1:])
+	if err != nil {
+		return ""
+	}
+
+	return qualifiers.Get("arch")
+}
+
+// parseSPDXPackages returns the rpm packages of an SPDX document in the
+// name-version-release.arch format used by image-info
+func parseSPDXPackages(content []byte) ([]string, error) {
+	var document spdxDocument
+	err := json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the sbom: %v", err)
+	}
+
+	var packages []string
+	for _, pkg := range document.Packages {
+		arch := ""
+		for _, ref := range pkg.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				arch = purlArch(ref.ReferenceLocator)
+			}
+		}
+		// only rpm packages are compared
+		if arch == "" {
+			continue
+		}
+
+		version := pkg.VersionInfo
+		if index := strings.Index(version, ":"); index != -1 {
+			version = version[index+1:]
+		}
+
+		packages = append(packages, fmt.Sprintf("%s-%s.%s", pkg.Name, version, arch))
+	}
+
+	return packages, nil
+}
+
+// imageInfoPackages returns the packages listed in the image-info output
+func imageInfoPackages(imageInfo interface{}) ([]string, error) {
+	info, ok := imageInfo.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected image info format")
+	}
+
+	rawPackages, ok := info["packages"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the image info does not list packages")
+	}
+
+	var packages []string
+	for _, pkg := range rawPackages {
+		packages = append(packages, fmt.Sprint(pkg))
+	}
+
+	return packages, nil
+}
+
+// checkSBOM compares the packages listed in the SBOM with the expected
+// ones, both missing and extra packages are reported
+func checkSBOM(outputDirectory string, expected *sbomExpectation, imagePackages []string) error {
+	content, err := ioutil.ReadFile(path.Join(outputDirectory, expected.Path))
+	if err != nil {
+		return fmt.Errorf("cannot read the sbom: %v", err)
+	}
+
+	sbomPackages, err := parseSPDXPackages(content)
+	if err != nil {
+		return err
+	}
+
+	inSBOM := make(map[string]bool)
+	for _, pkg := range sbomPackages {
+		inSBOM[pkg] = true
+	}
+
+	inImage := make(map[string]bool)
+	var problems []string
+	for _, pkg := range imagePackages {
+		inImage[pkg] = true
+		if !inSBOM[pkg] {
+			problems = append(problems, fmt.Sprintf("%s is in the image but missing from the sbom", pkg))
+		}
+	}
+
+	for _, pkg := range sbomPackages {
+		if !inImage[pkg] {
+			problems = append(problems, fmt.Sprintf("%s is in the sbom but not in the image", pkg))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("the sbom does not match the image:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// serviceAssertions are the systemd units expected in the image, only the
+// named units are checked. Units are named with their suffix, e.g.
+// sshd.service.
+type serviceAssertions struct {
+	// Enabled units must be reported as enabled by image-info
+	Enabled []string `json:"enabled"`
+	// Disabled units must be reported as disabled by image-info
+	Disabled []string `json:"disabled"`
+	// Present units must be installed, no matter if enabled or not
+	Present []string `json:"present"`
+}
+
+// imageInfoServices is the subset of the image-info output listing the
+// installed units
+type imageInfoServices struct {
+	Enabled  []string `json:"services-enabled"`
+	Disabled []string `json:"services-disabled"`
+}
+
+// testServices checks the units reported by image-info against the
+// assertions, all the failed checks are reported at once
+func testServices(imageInfo interface{}, assertions *serviceAssertions) error {
+	// the image info is already decoded, encode it again to decode only
+	// the interesting parts into a struct
+	raw, err := json.Marshal(imageInfo)
+	if err != nil {
+		return fmt.Errorf("cannot encode the image info: %v", err)
+	}
+
+	var services imageInfoServices
+	err = json.Unmarshal(raw, &services)
+	if err != nil {
+		return fmt.Errorf("cannot decode the services from the image info: %v", err)
+	}
+
+	enabled := make(map[string]bool)
+	for _, unit := range services.Enabled {
+		enabled[unit] = true
+	}
+	disabled := make(map[string]bool)
+	for _, unit := range services.Disabled {
+		disabled[unit] = true
+	}
+
+	var failures []string
+	for _, unit := range assertions.Enabled {
+		if !enabled[unit] {
+			failures = append(failures, fmt.Sprintf("%s is not enabled", unit))
+		}
+	}
+	for _, unit := range assertions.Disabled {
+		if !disabled[unit] {
+			failures = append(failures, fmt.Sprintf("%s is not disabled", unit))
+		}
+	}
+	for _, unit := range assertions.Present {
+		if !enabled[unit] && !disabled[unit] {
+			failures = append(failures, fmt.Sprintf("%s is not installed", unit))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("the services don't match the assertions:\n%s", strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
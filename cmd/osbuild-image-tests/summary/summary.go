@@ -0,0 +1,213 @@
+// +build integration
+
+// Package summary defines the machine readable summary of an image test
+// run and allows merging the summaries of several runs
+package summary
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Result is the outcome of a test case
+type Result string
+
+const (
+	Passed  Result = "passed"
+	Failed  Result = "failed"
+	Skipped Result = "skipped"
+)
+
+// Case is the result of a single test case
+type Case struct {
+	// Name is the file name of the test case
+	Name   string `json:"name"`
+	Distro string `json:"distro"`
+	Arch   string `json:"arch"`
+	Result Result `json:"result"`
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+	// Message is the skip reason or a description of the failure
+	Message string `json:"message,omitempty"`
+	// Conflict is set by Merge if the runs disagree on the result
+	Conflict bool `json:"conflict,omitempty"`
+	// Subtests are the results of the parts of the test case, e.g. boot
+	Subtests []Case `json:"subtests,omitempty"`
+}
+
+// Summary is the summary of one or more test runs
+type Summary struct {
+	Cases []Case `json:"cases"`
+}
+
+// Load reads a summary from a JSON file
+func Load(path string) (*Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the summary: %v", err)
+	}
+	defer f.Close()
+
+	var s Summary
+	err = json.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the summary %s: %v", path, err)
+	}
+
+	return &s, nil
+}
+
+// Save writes the summary into a JSON file
+func (s *Summary) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode the summary: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write the summary: %v", err)
+	}
+
+	return nil
+}
+
+type caseKey struct {
+	name string
+	arch string
+}
+
+// Merge merges the summaries into one, a case is identified by its name
+// and arch. A case skipped in some runs takes the result of the runs
+// that actually ran it. If the runs disagree, the case is marked as
+// a conflict and considered failed.
+func Merge(summaries []*Summary) *Summary {
+	merged := make(map[caseKey]*Case)
+	var order []caseKey
+
+	for _, s := range summaries {
+		for _, c := range s.Cases {
+			key := caseKey{c.Name, c.Arch}
+			existing, exists := merged[key]
+			if !exists {
+				c := c
+				merged[key] = &c
+				order = append(order, key)
+				continue
+			}
+
+			switch {
+			case c.Result == Skipped || c.Result == existing.Result:
+				continue
+			case existing.Result == Skipped:
+				*existing = c
+			default:
+				existing.Conflict = true
+				existing.Result = Failed
+			}
+		}
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].name != order[j].name {
+			return order[i].name < order[j].name
+		}
+		return order[i].arch < order[j].arch
+	})
+
+	result := &Summary{Cases: []Case{}}
+	for _, key := range order {
+		result.Cases = append(result.Cases, *merged[key])
+	}
+
+	return result
+}
+
+// Conflicts returns the cases with conflicting results
+func (s *Summary) Conflicts() []Case {
+	var conflicts []Case
+	for _, c := range s.Cases {
+		if c.Conflict {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return conflicts
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+}
+
+// addJUnitTestcase adds the case to the suite, the subtests are added
+// as separate test cases named after the case
+func (suite *junitTestsuite) addJUnitTestcase(c Case, name, classname string) {
+	tc := junitTestcase{
+		Name:      name,
+		Classname: classname,
+		Time:      c.Duration,
+	}
+
+	switch c.Result {
+	case Failed:
+		message := c.Message
+		if c.Conflict {
+			message = "the test case has conflicting results across runs"
+		} else if message == "" {
+			message = "the test case failed"
+		}
+		tc.Failure = &junitMessage{Message: message}
+		suite.Failures++
+	case Skipped:
+		tc.Skipped = &junitMessage{Message: c.Message}
+		suite.Skipped++
+	}
+
+	suite.Tests++
+	suite.Testcases = append(suite.Testcases, tc)
+
+	for _, subtest := range c.Subtests {
+		suite.addJUnitTestcase(subtest, name+"/"+subtest.Name, classname)
+	}
+}
+
+// WriteJUnit writes the summary as a JUnit XML test suite
+func (s *Summary) WriteJUnit(w io.Writer) error {
+	suite := junitTestsuite{Name: "osbuild-image-tests"}
+	for _, c := range s.Cases {
+		suite.addJUnitTestcase(c, c.Name, c.Distro+"."+c.Arch)
+		suite.Time += c.Duration
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(suite)
+}
@@ -0,0 +1,117 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cloudTeardown is the deletion of a resource uploaded to a cloud by
+// a testcase
+type cloudTeardown struct {
+	testcase string
+	// resource describes the deleted resource in the errors
+	resource string
+	delete   func() error
+}
+
+// cloudTeardowns collects the deletions postponed to the end of the run
+// because of -teardown-workers
+var cloudTeardowns struct {
+	mutex sync.Mutex
+	list  []cloudTeardown
+}
+
+// teardownCloudResource deletes the resource uploaded by the testcase. If
+// -teardown-workers is given, the deletion is postponed to the end of the
+// run, when the deletions of all the testcases run concurrently. The
+// instances are always terminated by the testcase, the uploaded resources
+// cannot be deleted before them.
+func teardownCloudResource(t *testing.T, resource string, delete func() error) {
+	if *teardownWorkers <= 0 {
+		err := delete()
+		require.NoErrorf(t, err, "cannot delete %s, resources could have been leaked", resource)
+		return
+	}
+
+	cloudTeardowns.mutex.Lock()
+	defer cloudTeardowns.mutex.Unlock()
+
+	cloudTeardowns.list = append(cloudTeardowns.list, cloudTeardown{
+		testcase: t.Name(),
+		resource: resource,
+		delete:   delete,
+	})
+}
+
+// run runs the deletion, a panic is turned into an error so it doesn't
+// stop the other deletions
+func (d cloudTeardown) run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return d.delete()
+}
+
+// runCloudTeardowns runs the postponed deletions using -teardown-workers
+// concurrent workers. Every deletion is attempted, the returned error lists
+// all the failed ones.
+func runCloudTeardowns(t *testing.T) error {
+	cloudTeardowns.mutex.Lock()
+	teardowns := cloudTeardowns.list
+	cloudTeardowns.list = nil
+	cloudTeardowns.mutex.Unlock()
+
+	if len(teardowns) == 0 {
+		return nil
+	}
+
+	t.Logf("deleting %d cloud resources using %d workers", len(teardowns), *teardownWorkers)
+	start := time.Now()
+
+	queue := make(chan cloudTeardown)
+	var problems []string
+	var problemsLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < *teardownWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range queue {
+				err := d.run()
+				if err == nil {
+					continue
+				}
+
+				problemsLock.Lock()
+				problems = append(problems, fmt.Sprintf("%s: cannot delete %s: %v", d.testcase, d.resource, err))
+				problemsLock.Unlock()
+			}
+		}()
+	}
+
+	for _, d := range teardowns {
+		queue <- d
+	}
+	close(queue)
+	wg.Wait()
+
+	t.Logf("the cloud resources were deleted in %v", time.Since(start).Round(time.Second))
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%d of %d cloud resources could not be deleted, resources could have been leaked:\n%s", len(problems), len(teardowns), strings.Join(problems, "\n"))
+	}
+
+	return nil
+}
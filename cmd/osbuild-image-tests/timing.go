@@ -0,0 +1,169 @@
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stageTiming is the duration of a single osbuild stage
+type stageTiming struct {
+	Pipeline string  `json:"pipeline"`
+	Stage    string  `json:"stage"`
+	Duration float64 `json:"duration"`
+}
+
+// caseTimings collects the durations of the phases of a testcase run,
+// all durations are in seconds. The zero value is ready to use.
+type caseTimings struct {
+	mutex sync.Mutex
+	// Build is the duration of the osbuild run, zero if the image came
+	// from the image cache
+	Build float64 `json:"build,omitempty"`
+	// CacheRestore is the duration of restoring the output from the image
+	// cache, zero if the image was built
+	CacheRestore float64 `json:"cache-restore,omitempty"`
+	// Upload is the duration of the upload to a cloud
+	Upload float64 `json:"upload,omitempty"`
+	// BootToSSH is the time between the machine being started and ssh
+	// reporting a running system
+	BootToSSH float64 `json:"boot-to-ssh,omitempty"`
+	// Stages are reported only by osbuild versions including stage
+	// durations in their --json output
+	Stages []stageTiming `json:"stages,omitempty"`
+}
+
+// recordBuild records the duration of the osbuild run and of its stages
+func (c *caseTimings) recordBuild(d time.Duration, stages []stageTiming) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Build = d.Seconds()
+	c.Stages = stages
+}
+
+// recordCacheRestore records the duration of restoring the output from
+// the image cache
+func (c *caseTimings) recordCacheRestore(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.CacheRestore = d.Seconds()
+}
+
+// recordUpload records the duration of the upload to a cloud
+func (c *caseTimings) recordUpload(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Upload = d.Seconds()
+}
+
+// recordBootToSSH records the time it took the booted machine to be
+// reachable using ssh
+func (c *caseTimings) recordBootToSSH(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.BootToSSH = d.Seconds()
+}
+
+// osbuildStageResult is a stage in the --json output of osbuild
+type osbuildStageResult struct {
+	Name string `json:"name"`
+	// Type is the name of the stage in the v2 manifest format
+	Type     string   `json:"type"`
+	Duration *float64 `json:"duration"`
+}
+
+// osbuildResult is the subset of the --json output of osbuild needed to
+// extract the stage durations, the build pipeline is nested
+type osbuildResult struct {
+	Build     *osbuildResult       `json:"build"`
+	Stages    []osbuildStageResult `json:"stages"`
+	Assembler *osbuildStageResult  `json:"assembler"`
+}
+
+// stages returns the timings of the stages of the pipeline and its build
+// pipelines, stages without a duration are omitted
+func (r *osbuildResult) stages(pipeline string) []stageTiming {
+	var timings []stageTiming
+	if r.Build != nil {
+		timings = append(timings, r.Build.stages(pipeline+"/build")...)
+	}
+
+	all := r.Stages
+	if r.Assembler != nil {
+		all = append(all, *r.Assembler)
+	}
+
+	for _, stage := range all {
+		if stage.Duration == nil {
+			continue
+		}
+
+		name := stage.Name
+		if name == "" {
+			name = stage.Type
+		}
+		timings = append(timings, stageTiming{
+			Pipeline: pipeline,
+			Stage:    name,
+			Duration: *stage.Duration,
+		})
+	}
+
+	return timings
+}
+
+// parseStageTimings extracts the stage durations from the osbuild output.
+// The output might contain diagnostics printed before the JSON result,
+// they are skipped. It returns nil if the output cannot be parsed.
+func parseStageTimings(output []byte) []stageTiming {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return nil
+	}
+
+	var result osbuildResult
+	err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&result)
+	if err != nil {
+		return nil
+	}
+
+	return result.stages("tree")
+}
+
+// timingReport is the content of the -timing-output file
+type timingReport struct {
+	Cases []timingReportCase `json:"cases"`
+}
+
+type timingReportCase struct {
+	Name   string `json:"name"`
+	Distro string `json:"distro"`
+	Arch   string `json:"arch"`
+	*caseTimings
+}
+
+// writeTimingReport writes the timings of all testcases as JSON, sorted
+// by the testcase name
+func writeTimingReport(path string, cases []timingReportCase) error {
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].Name < cases[j].Name
+	})
+
+	content, err := json.MarshalIndent(timingReport{Cases: cases}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode the timings: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write the timings: %v", err)
+	}
+
+	return nil
+}
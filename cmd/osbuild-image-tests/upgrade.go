@@ -0,0 +1,117 @@
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upgradeExpectation describes an in-place upgrade of the booted image
+type upgradeExpectation struct {
+	// Method is either "dnf" or "rpm-ostree"
+	Method string
+	// Repo is the base URL of an additional repository with the updates,
+	// it's used only by the dnf method
+	Repo string
+	// Package is the package whose version is checked after the upgrade,
+	// it's used only by the dnf method
+	Package string
+	// Version is a regular expression matching the package version-release
+	// or the booted ostree deployment version after the upgrade
+	Version string
+	// Timeout bounds the upgrade command, 30 minutes are used if empty
+	Timeout string
+}
+
+// upgradeCommand returns the command upgrading the guest
+func upgradeCommand(expected *upgradeExpectation) (string, error) {
+	switch expected.Method {
+	case "dnf":
+		if expected.Repo == "" {
+			return "sudo dnf upgrade -y", nil
+		}
+		return fmt.Sprintf("sudo dnf upgrade -y --repofrompath=upgrade-test,%s --setopt=upgrade-test.gpgcheck=0", expected.Repo), nil
+	case "rpm-ostree":
+		return "sudo rpm-ostree upgrade", nil
+	default:
+		return "", fmt.Errorf("unknown upgrade method %s", expected.Method)
+	}
+}
+
+// upgradedVersion returns the version reported by the guest after
+// the upgrade
+func upgradedVersion(target sshTarget, expected *upgradeExpectation) (string, error) {
+	if expected.Method == "dnf" {
+		out, err := runSSHCommand(target, "rpm -q --qf '%{VERSION}-%{RELEASE}' "+expected.Package)
+		if err != nil {
+			return "", fmt.Errorf("cannot get the version of %s: %v", expected.Package, err)
+		}
+		return strings.TrimSpace(out), nil
+	}
+
+	out, err := runSSHCommand(target, "rpm-ostree status --booted --json")
+	if err != nil {
+		return "", fmt.Errorf("cannot get the rpm-ostree status: %v", err)
+	}
+
+	var status struct {
+		Deployments []struct {
+			Version string
+			Booted  bool
+		}
+	}
+	err = json.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode the rpm-ostree status: %v", err)
+	}
+
+	for _, deployment := range status.Deployments {
+		if deployment.Booted {
+			return deployment.Version, nil
+		}
+	}
+
+	return "", fmt.Errorf("no booted deployment found")
+}
+
+// testUpgrade upgrades the guest in place, reboots it and checks that
+// it reports the upgraded version
+func testUpgrade(t *testing.T, target sshTarget, expected *upgradeExpectation) {
+	if expected.Method == "dnf" {
+		require.NotEmpty(t, expected.Package, "the package to check must be given for the dnf upgrade method")
+	}
+
+	command, err := upgradeCommand(expected)
+	require.NoError(t, err)
+
+	timeout := 30 * time.Minute
+	if expected.Timeout != "" {
+		timeout, err = time.ParseDuration(expected.Timeout)
+		require.NoError(t, err, "invalid upgrade timeout")
+	}
+
+	versionRegexp, err := regexp.Compile(expected.Version)
+	require.NoError(t, err, "invalid expected version")
+
+	t.Logf("upgrading the guest using %s", expected.Method)
+	_, err = runSSHCommandWithTimeout(target, command, timeout)
+	require.NoError(t, err, "the upgrade failed")
+
+	rebootGuest(t, target)
+	if t.Failed() {
+		return
+	}
+
+	version, err := upgradedVersion(target, expected)
+	require.NoError(t, err)
+
+	assert.Truef(t, versionRegexp.MatchString(version), "unexpected version after the upgrade: expected %s, got %s", expected.Version, version)
+}
@@ -0,0 +1,187 @@
+// +build integration
+
+package vmwaretest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// wrapErrorf returns error constructed using fmt.Errorf from format and any
+// other args. If innerError != nil, it's appended at the end of the new
+// error.
+func wrapErrorf(innerError error, format string, a ...interface{}) error {
+	if innerError != nil {
+		a = append(a, innerError)
+		return fmt.Errorf(format+"\n\ninner error: %#s", a...)
+	}
+
+	return fmt.Errorf(format, a...)
+}
+
+type vmwareCredentials struct {
+	URL        string
+	Username   string
+	Password   string
+	Datacenter string
+	Datastore  string
+	Network    string
+	// Insecure disables the verification of the vCenter certificate
+	Insecure bool
+}
+
+// GetVMwareCredentialsFromEnv gets the credentials from environment variables
+// If none of the environment variables is set, it returns nil.
+// If some but not all environment variables are set, it returns an error.
+// GOVC_INSECURE is optional.
+func GetVMwareCredentialsFromEnv() (*vmwareCredentials, error) {
+	url, uExists := os.LookupEnv("GOVC_URL")
+	username, unExists := os.LookupEnv("GOVC_USERNAME")
+	password, pExists := os.LookupEnv("GOVC_PASSWORD")
+	datacenter, dcExists := os.LookupEnv("GOVC_DATACENTER")
+	datastore, dsExists := os.LookupEnv("GOVC_DATASTORE")
+	network, nExists := os.LookupEnv("GOVC_NETWORK")
+
+	// Workaround Travis security feature. If non of the variables is set, just ignore the test
+	if !uExists && !unExists && !pExists && !dcExists && !dsExists && !nExists {
+		return nil, nil
+	}
+	// If only one/two of them are not set, then fail
+	if !uExists || !unExists || !pExists || !dcExists || !dsExists || !nExists {
+		return nil, errors.New("not all required env variables were set")
+	}
+
+	return &vmwareCredentials{
+		URL:        url,
+		Username:   username,
+		Password:   password,
+		Datacenter: datacenter,
+		Datastore:  datastore,
+		Network:    network,
+		Insecure:   os.Getenv("GOVC_INSECURE") == "1" || os.Getenv("GOVC_INSECURE") == "true",
+	}, nil
+}
+
+// runGovc runs the govc tool from govmomi authenticated using
+// the credentials and returns its standard output
+func runGovc(c *vmwareCredentials, args ...string) (string, error) {
+	cmd := exec.Command("govc", args...)
+	cmd.Env = append(os.Environ(),
+		"GOVC_URL="+c.URL,
+		"GOVC_USERNAME="+c.Username,
+		"GOVC_PASSWORD="+c.Password,
+		"GOVC_DATACENTER="+c.Datacenter,
+		"GOVC_DATASTORE="+c.Datastore,
+		"GOVC_NETWORK="+c.Network,
+		fmt.Sprintf("GOVC_INSECURE=%t", c.Insecure),
+	)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("govc %s failed: %v\n%s", args[0], err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// UploadImageToVMware uploads the image to the datastore and registers
+// a powered off virtual machine named imageName using it. Both ova and
+// vmdk images are supported.
+func UploadImageToVMware(c *vmwareCredentials, imagePath string, imageName string) error {
+	if strings.HasSuffix(imagePath, ".ova") {
+		_, err := runGovc(c, "import.ova", "-name", imageName, imagePath)
+		if err != nil {
+			return fmt.Errorf("upload to vmware failed: %v", err)
+		}
+
+		return nil
+	}
+
+	// the disk is uploaded into a directory named after the image
+	_, err := runGovc(c, "import.vmdk", imagePath, imageName)
+	if err != nil {
+		return fmt.Errorf("upload to vmware failed: %v", err)
+	}
+
+	_, err = runGovc(c, "vm.create",
+		"-on=false",
+		"-m", "2048",
+		"-c", "2",
+		"-g", "rhel8_64Guest",
+		"-disk.controller", "pvscsi",
+		"-disk", path.Join(imageName, path.Base(imagePath)),
+		imageName,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot create the virtual machine: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteImageFromVMware deletes the virtual machine and its disks created
+// by UploadImageToVMware method.
+func DeleteImageFromVMware(c *vmwareCredentials, imageName string) error {
+	_, err := runGovc(c, "vm.destroy", imageName)
+	if err != nil {
+		return fmt.Errorf("cannot delete the virtual machine: %v", err)
+	}
+
+	return nil
+}
+
+// WithBootedImageInVMware runs the function f in the context of booted
+// image in VMware. The user data are passed to cloud-init using guestinfo.
+// If keep returns true after f, the virtual machine is left powered on.
+func WithBootedImageInVMware(c *vmwareCredentials, imageName, testId, userData string, keep func() bool, f func(address string) error) (retErr error) {
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: vm-%s\n", testId, testId)
+
+	_, err := runGovc(c, "vm.change",
+		"-vm", imageName,
+		"-e", "guestinfo.metadata="+base64.StdEncoding.EncodeToString([]byte(metaData)),
+		"-e", "guestinfo.metadata.encoding=base64",
+		"-e", "guestinfo.userdata="+base64.StdEncoding.EncodeToString([]byte(userData)),
+		"-e", "guestinfo.userdata.encoding=base64",
+	)
+	if err != nil {
+		return fmt.Errorf("cannot set the cloud-init data: %v", err)
+	}
+
+	_, err = runGovc(c, "vm.power", "-on", imageName)
+
+	// Let's register the clean-up function as soon as possible.
+	defer func() {
+		if keep() {
+			log.Printf("keeping the virtual machine %s powered on", imageName)
+			return
+		}
+
+		_, err := runGovc(c, "vm.power", "-off", "-force", imageName)
+		if err != nil {
+			log.Printf("powering off the virtual machine %s errored: %v", imageName, err)
+			retErr = wrapErrorf(retErr, "cannot power off the virtual machine %s: %v", imageName, err)
+		}
+	}()
+
+	if err != nil {
+		return fmt.Errorf("cannot power on the virtual machine: %v", err)
+	}
+
+	// vm.ip waits for the vmware tools to report the address
+	address, err := runGovc(c, "vm.ip", "-v4", "-wait", "10m", imageName)
+	if err != nil {
+		return fmt.Errorf("cannot get the ip address of the virtual machine: %v", err)
+	}
+
+	return f(address)
+}
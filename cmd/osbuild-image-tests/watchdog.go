@@ -0,0 +1,108 @@
+// +build integration
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hungGuestSignatures are the lines of the serial console showing that
+// the guest will never be reachable using ssh
+var hungGuestSignatures = []string{
+	"Kernel panic - not syncing",
+	"You are in emergency mode",
+	"Give root password for maintenance",
+	"Cannot open access to console, the root account is locked",
+	"Entering emergency mode",
+	"grub rescue>",
+}
+
+// watchdogInterval is the delay between two checks of the serial console
+const watchdogInterval = time.Second
+
+// watchdogContextLines is the number of console lines reported with
+// a hung guest
+const watchdogContextLines = 30
+
+// consoleWatchdog watches the serial console of a guest for the signatures
+// of a hung boot
+type consoleWatchdog struct {
+	serialLog string
+	stop      chan struct{}
+
+	mutex   sync.Mutex
+	failure error
+}
+
+// hungGuestSignature returns the first signature of a hung guest found in
+// the console output, or an empty string if there's none
+func hungGuestSignature(console string) string {
+	for _, signature := range hungGuestSignatures {
+		if strings.Contains(console, signature) {
+			return signature
+		}
+	}
+
+	return ""
+}
+
+// startConsoleWatchdog checks the serial console every watchdogInterval
+// until Stop is called. Once a signature of a hung guest is found, the
+// failure is recorded and onHung is called.
+func startConsoleWatchdog(serialLog string, onHung func()) *consoleWatchdog {
+	w := &consoleWatchdog{
+		serialLog: serialLog,
+		stop:      make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+
+			// the console log of a hung boot is small, read it whole
+			console, err := ioutil.ReadFile(w.serialLog)
+			if err != nil {
+				continue
+			}
+
+			signature := hungGuestSignature(string(console))
+			if signature == "" {
+				continue
+			}
+
+			w.mutex.Lock()
+			w.failure = fmt.Errorf("the guest is hung, the console shows %q:\n%s", signature, tailFile(w.serialLog, watchdogContextLines))
+			w.mutex.Unlock()
+
+			onHung()
+			return
+		}
+	}()
+
+	return w
+}
+
+// Failure returns the error describing the hung guest, or nil if the
+// watchdog didn't find any problem
+func (w *consoleWatchdog) Failure() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.failure
+}
+
+// Stop stops watching the console
+func (w *consoleWatchdog) Stop() {
+	close(w.stop)
+}